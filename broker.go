@@ -0,0 +1,264 @@
+package bulkai
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+)
+
+// DefaultRetention is how long the events of a job are kept after it ends so
+// late subscribers can still read them.
+const DefaultRetention = time.Minute
+
+// MessageBroker delivers the events of each job to its subscribers.
+type MessageBroker struct {
+	lck        sync.Mutex
+	containers map[string]*Container
+	// retention is how long ended containers are kept
+	retention time.Duration
+}
+
+// NewMessageBroker creates a broker that removes the containers of the jobs
+// once the retention has passed since they ended.
+func NewMessageBroker(retention time.Duration) *MessageBroker {
+	return &MessageBroker{
+		containers: make(map[string]*Container),
+		retention:  retention,
+	}
+}
+
+// GetContainer returns the container of a job, or nil if there is none.
+func (b *MessageBroker) GetContainer(identify string) *Container {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	return b.containers[identify]
+}
+
+// AddContainer adds the container of a job, replacing the previous one.
+func (b *MessageBroker) AddContainer(container *Container) {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	b.containers[container.Identify] = container
+}
+
+// DelContainer removes the container of a job and closes its
+// subscriptions.
+func (b *MessageBroker) DelContainer(identify string) {
+	b.lck.Lock()
+	c, ok := b.containers[identify]
+	delete(b.containers, identify)
+	b.lck.Unlock()
+	if ok {
+		c.close()
+	}
+}
+
+// EndContainer marks the job as ended and removes its container once the
+// retention has passed.
+func (b *MessageBroker) EndContainer(container *Container) {
+	container.end()
+	time.AfterFunc(b.retention, func() {
+		b.lck.Lock()
+		defer b.lck.Unlock()
+		// The job may have been started again with a new container
+		if b.containers[container.Identify] == container {
+			delete(b.containers, container.Identify)
+		}
+	})
+}
+
+// Subscribe returns a subscription to the events of a job, or nil if there
+// is no container for it. If replay is true the past events are received
+// first.
+func (b *MessageBroker) Subscribe(identify string, replay bool) *Subscription {
+	c := b.GetContainer(identify)
+	if c == nil {
+		return nil
+	}
+	return c.Subscribe(replay)
+}
+
+// Container holds the events of a job.
+type Container struct {
+	Identify string
+
+	lck    sync.Mutex
+	events []*ai.GenerateInfo
+	subs   map[*Subscription]struct{}
+	ended  bool
+}
+
+// NewContainer creates the container of a job.
+func NewContainer(identify string) *Container {
+	return &Container{
+		Identify: identify,
+		subs:     make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish sends the event to the subscribers. Events published after the
+// job ended are ignored.
+func (c *Container) Publish(info *ai.GenerateInfo) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if c.ended {
+		return
+	}
+	c.events = append(c.events, info)
+	for s := range c.subs {
+		s.push(info)
+	}
+}
+
+// Ended reports whether the job ended.
+func (c *Container) Ended() bool {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.ended
+}
+
+// Subscribe returns a subscription to the events of the job. If replay is
+// true the past events are received first. Subscribing to an ended job
+// returns a subscription that is closed after the replay.
+func (c *Container) Subscribe(replay bool) *Subscription {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	s := newSubscription(c)
+	if replay {
+		s.pending = append(s.pending, c.events...)
+	}
+	if c.ended {
+		s.ended = true
+	} else {
+		c.subs[s] = struct{}{}
+	}
+	go s.run()
+	return s
+}
+
+func (c *Container) end() {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if c.ended {
+		return
+	}
+	c.ended = true
+	for s := range c.subs {
+		s.finish()
+	}
+	c.subs = nil
+}
+
+// close ends the job and drops the events that weren't delivered.
+func (c *Container) close() {
+	c.lck.Lock()
+	subs := c.subs
+	c.ended = true
+	c.subs = nil
+	c.events = nil
+	c.lck.Unlock()
+	for s := range subs {
+		s.Close()
+	}
+}
+
+func (c *Container) unsubscribe(s *Subscription) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	delete(c.subs, s)
+}
+
+// Subscription receives the events of a job in order.
+// Events are queued so a slow subscriber doesn't block the job or the other
+// subscribers.
+type Subscription struct {
+	c    *Container
+	out  chan *ai.GenerateInfo
+	wake chan struct{}
+	stop chan struct{}
+	once sync.Once
+
+	lck     sync.Mutex
+	pending []*ai.GenerateInfo
+	ended   bool
+}
+
+func newSubscription(c *Container) *Subscription {
+	return &Subscription{
+		c:    c,
+		out:  make(chan *ai.GenerateInfo),
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+}
+
+// C returns the channel of the events, it is closed after the last event of
+// the job or when the subscription is closed.
+func (s *Subscription) C() <-chan *ai.GenerateInfo {
+	return s.out
+}
+
+// Close stops the subscription, it must be called if the channel isn't read
+// until it is closed. Queued events are discarded and the channel is closed
+// when it returns.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	s.c.unsubscribe(s)
+	for range s.out {
+	}
+}
+
+func (s *Subscription) push(info *ai.GenerateInfo) {
+	s.lck.Lock()
+	s.pending = append(s.pending, info)
+	s.lck.Unlock()
+	s.notify()
+}
+
+func (s *Subscription) finish() {
+	s.lck.Lock()
+	s.ended = true
+	s.lck.Unlock()
+	s.notify()
+}
+
+func (s *Subscription) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the queued events until the job ends or the subscription is
+// closed.
+func (s *Subscription) run() {
+	defer close(s.out)
+	for {
+		s.lck.Lock()
+		if len(s.pending) == 0 {
+			ended := s.ended
+			s.lck.Unlock()
+			if ended {
+				return
+			}
+			select {
+			case <-s.wake:
+			case <-s.stop:
+				return
+			}
+			continue
+		}
+		info := s.pending[0]
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		s.lck.Unlock()
+		select {
+		case s.out <- info:
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package bulkai
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+)
+
+func collect(t *testing.T, sub *Subscription) []int {
+	t.Helper()
+	var got []int
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case info, ok := <-sub.C():
+			if !ok {
+				return got
+			}
+			got = append(got, info.Image.PromptIndex)
+		case <-timeout:
+			t.Fatal("timeout waiting for events")
+		}
+	}
+}
+
+func publish(c *Container, from, to int) {
+	for i := from; i < to; i++ {
+		c.Publish(&ai.GenerateInfo{Image: &ai.Image{PromptIndex: i}, Status: ai.Complete})
+	}
+}
+
+func TestBroker(t *testing.T) {
+	b := NewMessageBroker(10 * time.Millisecond)
+	c := NewContainer("test")
+	b.AddContainer(c)
+
+	// Subscribers don't block the job even if they aren't reading
+	first := b.Subscribe("test", true)
+	publish(c, 0, 2)
+	second := b.Subscribe("test", false)
+	replayed := b.Subscribe("test", true)
+	closed := b.Subscribe("test", true)
+	closed.Close()
+	publish(c, 2, 4)
+	b.EndContainer(c)
+	publish(c, 4, 5)
+
+	tests := []struct {
+		name string
+		sub  *Subscription
+		want []int
+	}{
+		{"first", first, []int{0, 1, 2, 3}},
+		{"second", second, []int{2, 3}},
+		{"replayed", replayed, []int{0, 1, 2, 3}},
+		{"late", b.Subscribe("test", true), []int{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		got := collect(t, tt.sub)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+				break
+			}
+		}
+	}
+	if _, ok := <-closed.C(); ok {
+		t.Error("expected closed subscription")
+	}
+
+	// Ended containers are removed after the retention
+	deadline := time.Now().Add(5 * time.Second)
+	for b.GetContainer("test") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("container wasn't removed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if sub := b.Subscribe("test", true); sub != nil {
+		t.Error("expected no subscription for a removed container")
+	}
+}
+
+func TestBrokerReplace(t *testing.T) {
+	b := NewMessageBroker(10 * time.Millisecond)
+	old := NewContainer("test")
+	b.AddContainer(old)
+	b.EndContainer(old)
+
+	// A new run of the job isn't removed by the retention of the old one
+	c := NewContainer("test")
+	b.AddContainer(c)
+	time.Sleep(50 * time.Millisecond)
+	if b.GetContainer("test") != c {
+		t.Fatal("expected the new container")
+	}
+
+	sub := b.Subscribe("test", true)
+	publish(c, 0, 1)
+	b.DelContainer("test")
+	collect(t, sub)
+	// Publishing after removal doesn't panic
+	publish(c, 1, 2)
+	b.DelContainer("test")
+}
@@ -1,11 +1,16 @@
 package bulkai
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -13,53 +18,81 @@ import (
 
 	"github.com/ZYKJShadow/bulkai/pkg/ai"
 	"github.com/ZYKJShadow/bulkai/pkg/ai/bluewillow"
+	"github.com/ZYKJShadow/bulkai/pkg/ai/fake"
 	"github.com/ZYKJShadow/bulkai/pkg/ai/midjourney"
+	"github.com/ZYKJShadow/bulkai/pkg/album"
 	"github.com/ZYKJShadow/bulkai/pkg/discord"
+	"github.com/ZYKJShadow/bulkai/pkg/filename"
 	"github.com/ZYKJShadow/bulkai/pkg/http"
 	"github.com/ZYKJShadow/bulkai/pkg/img"
+	"github.com/ZYKJShadow/bulkai/pkg/logging"
+	"github.com/ZYKJShadow/bulkai/pkg/metrics"
+	"github.com/ZYKJShadow/bulkai/pkg/prompt"
+	"github.com/ZYKJShadow/bulkai/pkg/retry"
+	"github.com/ZYKJShadow/bulkai/pkg/store"
+	"github.com/ZYKJShadow/bulkai/pkg/webhook"
 	"gopkg.in/yaml.v2"
 )
 
-type Album struct {
-	ID         string    `json:"id"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
-	Status     string    `json:"status"`
-	Percentage float32   `json:"percentage"`
-	Images     []*Image  `json:"images"`
-	Prompts    []string  `json:"prompts"`
-	Finished   []int     `json:"finished"`
-}
+type Album = album.Album
+
+type Image = album.Image
 
-type Image struct {
-	URL    string `json:"url"`
-	Prompt string `json:"prompt"`
-	File   string `json:"file"`
+// LoadAlbum reads an album from its json file.
+// It returns nil if the file doesn't exist.
+func LoadAlbum(path string) (*Album, error) {
+	return album.Load(path)
 }
 
 type Config struct {
-	Debug          bool          `yaml:"debug"`
-	Bot            string        `yaml:"bot"`
-	Proxy          string        `yaml:"proxy"`
-	Output         string        `yaml:"output"`
-	Album          string        `yaml:"album"`
-	Prefix         string        `yaml:"prefix"`
-	Suffix         string        `yaml:"suffix"`
-	Prompts        []string      `yaml:"prompts"`
-	Variation      bool          `yaml:"variation"`
-	Upscale        bool          `yaml:"upscale"`
-	Download       bool          `yaml:"download"`
-	Thumbnail      bool          `yaml:"thumbnail"`
-	Channel        string        `yaml:"channel"`
-	GuildID        string        `yaml:"groupID"`
-	Concurrency    int           `yaml:"concurrency"`
-	Wait           time.Duration `yaml:"wait"`
-	SessionFile    string        `yaml:"session"`
-	Session        Session       `yaml:"-"`
-	ReplicateToken string        `yaml:"replicate-token"`
-	MidjourneyCDN  bool          `yaml:"midjourney-cdn"`
+	Debug           bool              `yaml:"debug"`
+	LogLevel        string            `yaml:"log-level"`
+	LogFormat       string            `yaml:"log-format"`
+	Progress        bool              `yaml:"progress"`
+	Bot             string            `yaml:"bot"`
+	Proxy           string            `yaml:"proxy"`
+	Output          string            `yaml:"output"`
+	Album           string            `yaml:"album"`
+	Prefix          string            `yaml:"prefix"`
+	Suffix          string            `yaml:"suffix"`
+	Prompts         []*prompt.Entry   `yaml:"prompt"`
+	Variables       map[string]string `yaml:"variables"`
+	Sample          int               `yaml:"sample"`
+	Seed            int64             `yaml:"seed"`
+	MaxPrompts      int               `yaml:"max-prompts"`
+	MaxJobs         int               `yaml:"max-jobs"`
+	MaxDuration     time.Duration     `yaml:"max-duration"`
+	MaxJobsPerHour  int               `yaml:"max-jobs-per-hour"`
+	Variation       bool              `yaml:"variation"`
+	Upscale         bool              `yaml:"upscale"`
+	Download        bool              `yaml:"download"`
+	Thumbnail       bool              `yaml:"thumbnail"`
+	FileName        string            `yaml:"filename"`
+	Channel         string            `yaml:"channel"`
+	GuildID         string            `yaml:"guild"`
+	Concurrency     int               `yaml:"concurrency"`
+	DownloadWorkers int               `yaml:"download-workers"`
+	Wait            time.Duration     `yaml:"wait"`
+	SessionFile     string            `yaml:"session"`
+	Session         Session           `yaml:"-"`
+	ReplicateToken  string            `yaml:"replicate-token"`
+	MidjourneyCDN   bool              `yaml:"midjourney-cdn"`
+	Retry           *RetryPolicy      `yaml:"retry"`
+	DiscordRetry    *RetryPolicy      `yaml:"discord-retry"`
+	Fake            *fake.Config      `yaml:"fake"`
+	Addr            string            `yaml:"addr"`
+	Webhooks        []string          `yaml:"webhooks"`
+	WebhookSecret   string            `yaml:"webhook-secret"`
+	WebhookRetry    *RetryPolicy      `yaml:"webhook-retry"`
+	MetricsAddr     string            `yaml:"metrics-addr"`
+
+	// Logger is used by the client and the bots, a logger writing to stderr
+	// is created with NewLogger if nil
+	Logger *slog.Logger `yaml:"-"`
 }
 
+const defaultDownloadWorkers = 4
+
 type Session struct {
 	JA3             string `yaml:"ja3"`
 	UserAgent       string `yaml:"user-agent"`
@@ -70,40 +103,102 @@ type Session struct {
 	Cookie          string `yaml:"cookie"`
 }
 
-type Container struct {
-	Identify string
-	InfoChan chan *ai.GenerateInfo
-	Task     int
+// NewLogger returns the logger of the config that writes to w. The level is
+// debug if the debug mode is enabled and no level is set. The session token,
+// the cookie and the other credentials of the config are redacted.
+func NewLogger(w io.Writer, cfg *Config) (*slog.Logger, error) {
+	level := cfg.LogLevel
+	if level == "" && cfg.Debug {
+		level = "debug"
+	}
+	return logging.New(w, &logging.Config{
+		Level:  level,
+		Format: cfg.LogFormat,
+		Secrets: []string{
+			cfg.Session.Token,
+			cfg.Session.Cookie,
+			cfg.ReplicateToken,
+			cfg.WebhookSecret,
+		},
+	})
 }
 
-type MessageBroker struct {
-	Containers map[string]*Container
+// logger returns the logger of the config, a new one writing to stderr if
+// it isn't set.
+func (cfg *Config) logger() (*slog.Logger, error) {
+	if cfg.Logger != nil {
+		return cfg.Logger, nil
+	}
+	return NewLogger(os.Stderr, cfg)
 }
 
-type AiDrawClient struct {
-	AiCli      ai.Client
-	DiscordCli *discord.Client
-	cfg        *Config
-	sync.Mutex
-	MessageBroker
+// Budget returns the caps of the jobs sent to the bot, nil if there are none.
+func (cfg *Config) Budget() *ai.Budget {
+	b := &ai.Budget{
+		MaxJobs:        cfg.MaxJobs,
+		MaxDuration:    cfg.MaxDuration,
+		MaxJobsPerHour: cfg.MaxJobsPerHour,
+	}
+	if *b == (ai.Budget{}) {
+		return nil
+	}
+	return b
 }
 
-func (a *AiDrawClient) DelContainer(identify string) {
-	a.Lock()
-	defer a.Unlock()
-	delete(a.Containers, identify)
+// LoadPrompts expands the prompt entries using the prompt settings of the
+// config: variables, alternations, sampling, prefix and suffix. Entries that
+// are paths to prompt files are read only if files is true.
+// Entries that don't set their own options use the given defaults.
+// Duplicated prompts are logged and removed.
+func LoadPrompts(cfg *Config, entries []*prompt.Entry, files bool, defaults ai.Options) ([]*ai.Prompt, error) {
+	res, err := prompt.Load(entries, &prompt.Config{
+		Files:     files,
+		Variables: cfg.Variables,
+		Prefix:    cfg.Prefix,
+		Suffix:    cfg.Suffix,
+		Sample:    cfg.Sample,
+		Seed:      cfg.Seed,
+		Max:       cfg.MaxPrompts,
+		Options:   defaults,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range res.Duplicates {
+		logging.OrDefault(cfg.Logger).Warn("duplicated prompt removed", "prompt", p)
+	}
+	return res.Prompts, nil
 }
 
-func (a *AiDrawClient) GetContainer(identify string) *Container {
-	a.Lock()
-	defer a.Unlock()
-	return a.Containers[identify]
+// Downloader downloads the file of an url.
+type Downloader interface {
+	Download(ctx context.Context, u string, output string) error
 }
 
-func (a *AiDrawClient) AddContainer(container *Container) {
-	a.Lock()
-	defer a.Unlock()
-	a.Containers[container.Identify] = container
+type AiDrawClient struct {
+	AiCli      ai.Client
+	DiscordCli *discord.Client
+	downloader Downloader
+	cfg        *Config
+	retry      *retry.Policy
+	queue      *jobQueue
+	webhooks   *webhook.Notifier
+	filename   *filename.Template
+	log        *slog.Logger
+	registry   *metrics.Registry
+	metrics    *generationMetrics
+	// stopMetrics stops the metrics server, if any
+	stopMetrics func() error
+	*MessageBroker
+
+	// filesLck serializes the naming of downloaded files
+	filesLck sync.Mutex
+
+	// workers claiming the prompts of the queue, they are started by the
+	// first job
+	workLck    sync.Mutex
+	workCancel context.CancelFunc
+	workDone   chan struct{}
 }
 
 func CheckSessionInfo(cfg *Config) error {
@@ -133,29 +228,42 @@ func CheckSessionInfo(cfg *Config) error {
 
 func NewCli(ctx context.Context, cfg *Config) (drawClient *AiDrawClient, err error) {
 
+	if strings.ToLower(cfg.Bot) == "fake" {
+		return newFakeCli(ctx, cfg)
+	}
+
 	err = CheckSessionInfo(cfg)
 	if err != nil {
 		return
 	}
+	names, err := filename.Parse(cfg.FileName)
+	if err != nil {
+		return nil, err
+	}
+	logger, err := cfg.logger()
+	if err != nil {
+		return nil, err
+	}
+	logger = logger.With("bot", strings.ToLower(cfg.Bot))
 
-	var newCli func(*discord.Client, string, bool) (ai.Client, error)
+	var newCli func(*discord.Client, string, *slog.Logger) (ai.Client, error)
 
 	switch strings.ToLower(cfg.Bot) {
 	case "bluewillow":
-		newCli = func(c *discord.Client, channelID string, debug bool) (ai.Client, error) {
+		newCli = func(c *discord.Client, channelID string, logger *slog.Logger) (ai.Client, error) {
 			return bluewillow.New(c, &bluewillow.Config{
 				ChannelID: channelID,
-				Debug:     debug,
+				Logger:    logger,
 			})
 		}
 	case "midjourney":
-		newCli = func(c *discord.Client, channelID string, debug bool) (ai.Client, error) {
+		newCli = func(c *discord.Client, channelID string, logger *slog.Logger) (ai.Client, error) {
 			return midjourney.New(c, &midjourney.Config{
 				ChannelID:      channelID,
-				Debug:          debug,
 				ReplicateToken: cfg.ReplicateToken,
 				GuildID:        cfg.GuildID,
 				MidjourneyCDN:  cfg.MidjourneyCDN,
+				Logger:         logger,
 			})
 		}
 	default:
@@ -183,17 +291,50 @@ func NewCli(ctx context.Context, cfg *Config) (drawClient *AiDrawClient, err err
 	defer func() {
 		cookie, err := http.GetCookies(httpClient, "https://discord.com")
 		if err != nil {
-			log.Printf("couldn't get cookies: %v\n", err)
+			logger.Error("couldn't get cookies", "error", err)
 		}
 		cfg.Session.Cookie = strings.ReplaceAll(cookie, "\n", "")
 		data, err := yaml.Marshal(cfg.Session)
 		if err != nil {
-			log.Println(fmt.Errorf("couldn't marshal session: %w", err))
+			logger.Error("couldn't marshal session", "error", err)
 		}
 
 		if cfg.SessionFile != "" {
 			if err = os.WriteFile(cfg.SessionFile, data, 0644); err != nil {
-				log.Println(fmt.Errorf("couldn't write session: %w", err))
+				logger.Error("couldn't write session", "error", err)
+			}
+		}
+	}()
+
+	// Retry policies
+	aiRetry, err := cfg.Retry.apply(ai.DefaultRetryPolicy())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't configure retry: %w", err)
+	}
+	discordRetry, err := cfg.DiscordRetry.apply(discord.DefaultRetryPolicy())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't configure discord retry: %w", err)
+	}
+	downloadRetry, err := cfg.DiscordRetry.apply(discord.DefaultDownloadRetryPolicy())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't configure discord retry: %w", err)
+	}
+
+	webhooks, err := newNotifier(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	registry := metrics.NewRegistry()
+	genMetrics := newGenerationMetrics(registry)
+	queue, err := openQueue(cfg.Output, logger, genMetrics)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = queue.store.Close()
+			if webhooks != nil {
+				_ = webhooks.Close()
 			}
 		}
 	}()
@@ -205,8 +346,11 @@ func NewCli(ctx context.Context, cfg *Config) (drawClient *AiDrawClient, err err
 		Locale:          cfg.Session.Locale,
 		UserAgent:       cfg.Session.UserAgent,
 		HTTPClient:      httpClient,
-		Debug:           cfg.Debug,
 		Proxy:           cfg.Proxy,
+		Logger:          logger,
+		Metrics:         registry,
+		Retry:           discordRetry,
+		DownloadRetry:   downloadRetry,
 	})
 
 	if err != nil {
@@ -217,42 +361,200 @@ func NewCli(ctx context.Context, cfg *Config) (drawClient *AiDrawClient, err err
 	if err := client.Start(ctx); err != nil {
 		return nil, fmt.Errorf("couldn't start discord client: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			_ = client.Stop()
+		}
+	}()
 
-	cli, err := newCli(client, cfg.Channel, cfg.Debug)
+	cli, err := newCli(client, cfg.Channel, logger)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create %s client: %w", cfg.Bot, err)
 	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if c, ok := cli.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}()
 	if err := cli.Start(ctx); err != nil {
 		return nil, fmt.Errorf("couldn't start ai client: %w", err)
 	}
+	stopMetrics, err := startMetrics(cfg, registry, logger)
+	if err != nil {
+		return nil, err
+	}
 
 	drawClient = &AiDrawClient{
-		AiCli:      cli,
-		DiscordCli: client,
-		cfg:        cfg,
-		MessageBroker: MessageBroker{
-			Containers: make(map[string]*Container, 10),
-		},
+		AiCli:         cli,
+		DiscordCli:    client,
+		downloader:    client,
+		cfg:           cfg,
+		retry:         aiRetry,
+		queue:         queue,
+		webhooks:      webhooks,
+		filename:      names,
+		log:           logger,
+		registry:      registry,
+		metrics:       genMetrics,
+		stopMetrics:   stopMetrics,
+		MessageBroker: NewMessageBroker(DefaultRetention),
 	}
 
 	return
 }
 
-func (a *AiDrawClient) ReadImageChan(identify string) chan *ai.GenerateInfo {
-	a.Lock()
-	defer a.Unlock()
-	container, ok := a.Containers[identify]
-	if ok {
-		return container.InfoChan
+// newFakeCli creates a client using the fake bot, that doesn't need a discord
+// session.
+func newFakeCli(ctx context.Context, cfg *Config) (*AiDrawClient, error) {
+	if cfg.Output == "" {
+		return nil, errors.New("missing output directory")
 	}
-	return nil
+	names, err := filename.Parse(cfg.FileName)
+	if err != nil {
+		return nil, err
+	}
+	logger, err := cfg.logger()
+	if err != nil {
+		return nil, err
+	}
+	logger = logger.With("bot", "fake")
+	aiRetry, err := cfg.Retry.apply(ai.DefaultRetryPolicy())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't configure retry: %w", err)
+	}
+	fakeCfg := cfg.Fake
+	if fakeCfg == nil {
+		fakeCfg = &fake.Config{}
+	}
+	cli, err := fake.New(fakeCfg)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create fake client: %w", err)
+	}
+	if err := cli.Start(ctx); err != nil {
+		_ = cli.Close()
+		return nil, fmt.Errorf("couldn't start ai client: %w", err)
+	}
+	registry := metrics.NewRegistry()
+	genMetrics := newGenerationMetrics(registry)
+	queue, err := openQueue(cfg.Output, logger, genMetrics)
+	if err != nil {
+		_ = cli.Close()
+		return nil, err
+	}
+	webhooks, err := newNotifier(cfg, logger)
+	if err != nil {
+		_ = queue.store.Close()
+		_ = cli.Close()
+		return nil, err
+	}
+	stopMetrics, err := startMetrics(cfg, registry, logger)
+	if err != nil {
+		if webhooks != nil {
+			_ = webhooks.Close()
+		}
+		_ = queue.store.Close()
+		_ = cli.Close()
+		return nil, err
+	}
+	return &AiDrawClient{
+		AiCli:         cli,
+		downloader:    cli,
+		cfg:           cfg,
+		retry:         aiRetry,
+		queue:         queue,
+		webhooks:      webhooks,
+		filename:      names,
+		log:           logger,
+		registry:      registry,
+		metrics:       genMetrics,
+		stopMetrics:   stopMetrics,
+		MessageBroker: NewMessageBroker(DefaultRetention),
+	}, nil
+}
+
+// openQueue opens the job store of the output directory.
+func openQueue(output string, logger *slog.Logger, m *generationMetrics) (*jobQueue, error) {
+	if err := os.MkdirAll(output, 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create output directory: %w", err)
+	}
+	s, err := store.Open(filepath.Join(output, QueueFileName))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open job store: %w", err)
+	}
+	return newJobQueue(s, logger, m), nil
 }
 
+// Close stops the workers, the discord session and the ai client.
+// It waits until the pending webhooks are delivered. Every resource is
+// closed even if closing another one fails.
+func (a *AiDrawClient) Close() error {
+	var errs []error
+	if a.stopMetrics != nil {
+		errs = append(errs, a.stopMetrics())
+	}
+	a.workLck.Lock()
+	cancel, done := a.workCancel, a.workDone
+	a.workLck.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	if a.queue != nil {
+		errs = append(errs, a.queue.store.Close())
+	}
+	if a.webhooks != nil {
+		errs = append(errs, a.webhooks.Close())
+	}
+	if c, ok := a.AiCli.(io.Closer); ok {
+		errs = append(errs, c.Close())
+	}
+	if a.DiscordCli != nil {
+		errs = append(errs, a.DiscordCli.Stop())
+	}
+	return errors.Join(errs...)
+}
+
+// ReadImageChan returns a channel with the events of the job, starting with
+// the past ones. It is closed after the last event and must be read until
+// then. It returns nil if there is no job with the identify.
+func (a *AiDrawClient) ReadImageChan(identify string) <-chan *ai.GenerateInfo {
+	sub := a.Subscribe(identify, true)
+	if sub == nil {
+		return nil
+	}
+	return sub.C()
+}
+
+// Generate enqueues the prompts using the same options for all of them, see
+// GeneratePrompts.
 func (a *AiDrawClient) Generate(ctx context.Context, prompts []string, variation bool, upscale bool, identify string) error {
+	return a.GeneratePrompts(ctx, ai.NewPrompts(prompts, ai.DefaultOptions(variation, upscale)), identify)
+}
+
+// GeneratePrompts enqueues the prompts as a job identified by the album name
+// and returns without waiting, the job events are read from ReadImageChan.
+// Jobs are processed in the order they were enqueued by a shared pool of
+// workers. An existing album is resumed from its unfinished prompts using
+// the options it was created with.
+func (a *AiDrawClient) GeneratePrompts(ctx context.Context, prompts []*ai.Prompt, identify string) error {
+	if c := a.GetContainer(identify); c != nil && !c.Ended() {
+		return fmt.Errorf("album %s is already being generated", identify)
+	}
 
-	var album *Album
 	albumDir := fmt.Sprintf("%s/%s", a.cfg.Output, identify)
+	albumFile := fmt.Sprintf("%s/%s", albumDir, album.FileName)
 	imgDir := albumDir
+	thumbnailDir := fmt.Sprintf("%s/%s", imgDir, album.ThumbnailDir)
+
+	log := a.log.With("album", identify)
+
+	album, err := LoadAlbum(albumFile)
+	if err != nil {
+		return err
+	}
 
 	if album == nil {
 
@@ -262,7 +564,10 @@ func (a *AiDrawClient) Generate(ctx context.Context, prompts []string, variation
 			CreatedAt: time.Now().UTC(),
 			UpdatedAt: time.Now().UTC(),
 			Images:    []*Image{},
-			Prompts:   prompts,
+		}
+		for _, p := range prompts {
+			album.Prompts = append(album.Prompts, p.Text)
+			album.Options = append(album.Options, p.Options)
 		}
 
 		if err := os.MkdirAll(albumDir, 0755); err != nil {
@@ -273,93 +578,526 @@ func (a *AiDrawClient) Generate(ctx context.Context, prompts []string, variation
 			return fmt.Errorf("couldn't create album images directory: %w", err)
 		}
 
-		log.Println("album created:", albumDir)
+		// Prompts of a previous job with the same name are discarded
+		if err := a.queue.store.Delete(identify); err != nil {
+			return err
+		}
 
-	}
+		log.Info("album created", "dir", albumDir)
 
-	total := len(prompts) * 4
-	if variation {
-		total = total + total*4
+	} else {
+		// Prompts are taken from the stored album so that finished indexes
+		// still point to the same prompts. Albums created before prompts had
+		// their own options use the default ones of the config.
+		if len(album.Options) != len(album.Prompts) {
+			album.Options = nil
+			for range album.Prompts {
+				album.Options = append(album.Options, ai.DefaultOptions(a.cfg.Variation, a.cfg.Upscale))
+			}
+		}
+		prompts = nil
+		for i, p := range album.Prompts {
+			prompts = append(prompts, &ai.Prompt{Text: p, Options: album.Options[i]})
+		}
+		log.Info("album resumed", "dir", albumDir, "finished", len(album.Finished), "prompts", len(prompts))
 	}
 
-	container := a.GetContainer(identify)
-	if container == nil {
-		infoChan := make(chan *ai.GenerateInfo)
-		container = &Container{
-			Identify: identify,
-			InfoChan: infoChan,
-			Task:     1,
+	if a.cfg.Thumbnail {
+		if err := os.MkdirAll(thumbnailDir, 0755); err != nil {
+			return fmt.Errorf("couldn't create album thumbnails directory: %w", err)
 		}
-		a.AddContainer(container)
-	} else {
-		container.Task++
 	}
 
-	ai.Bulk(ctx, a.AiCli, prompts, album.Finished, variation, upscale, a.cfg.Concurrency, container.InfoChan, a.cfg.Wait)
+	jobs := ai.Estimate(prompts, album.Finished)
+	log.Info("estimated jobs", "imagine", jobs.Imagine, "upscale", jobs.Upscale, "variation", jobs.Variation, "total", jobs.Total())
+	if limit := a.cfg.MaxJobs; limit > 0 && jobs.Total() > limit {
+		log.Warn("the album will be paused before finishing, it needs more jobs than the max", "max_jobs", limit)
+	}
+
+	// Images already generated in previous runs count towards the total
+	progress := ai.NewProgress(prompts, album.Finished)
+	finished := make(map[int]bool)
+	for _, i := range album.Finished {
+		finished[i] = true
+	}
+
+	album.Status = "running"
+	if err := album.Save(albumFile); err != nil {
+		return err
+	}
+
+	if _, err := a.queue.store.Enqueue(identify, prompts, album.Finished); err != nil {
+		return err
+	}
+	out, err := a.startJob(ctx, identify)
+	if err != nil {
+		return fmt.Errorf("couldn't start album %s: %w", identify, err)
+	}
+	container := NewContainer(identify)
+	a.AddContainer(container)
+
+	go func() {
+		defer a.EndContainer(container)
+
+		now := time.Now().UTC()
+		for i := range prompts {
+			if finished[i] {
+				continue
+			}
+			container.Publish(&ai.GenerateInfo{
+				Status:      ai.Wait,
+				Type:        ai.EventPromptQueued,
+				PromptIndex: i,
+				Time:        now,
+			})
+		}
+
+		results := a.process(ai.WithLogger(ctx, log), out, imgDir)
 
-	log.Printf("album %s %s\n", albumDir, album.Status)
+		// A prompt is finished when its last image has been processed and
+		// every previous image of the prompt was processed successfully,
+		// results are in order so previous images were already processed
+		failed := make(map[int]bool)
+		var fatalErr error
+		for r := range results {
+			info := r.info
+			if info.Status == ai.Fatal {
+				fatalErr = info.Err
+			}
+			a.notifyInfo(identify, info, r.images)
+			if info.Image != nil {
+				idx := info.Image.PromptIndex
+				for _, image := range r.images {
+					if a.cfg.Download && image.File == "" {
+						failed[idx] = true
+					}
+					album.SetImage(image)
+				}
+				progress.Add(info)
+				if info.Image.IsLast && !failed[idx] {
+					album.Finished = append(album.Finished, idx)
+				}
+				album.Percentage = progress.Percentage()
+				if eta := progress.ETA(); !eta.IsZero() {
+					album.ETA = &eta
+				}
+				// Save the album before notifying so the progress isn't lost
+				if err := album.Save(albumFile); err != nil {
+					log.Error("couldn't save album", "error", err)
+				}
+				if err := album.WriteHTML(albumDir); err != nil {
+					log.Error("couldn't write album html", "error", err)
+				}
+			}
+			container.Publish(info)
+			if info.Image != nil && a.cfg.Download {
+				now := time.Now().UTC()
+				typ := ai.EventDownloadDone
+				if r.err != nil {
+					typ = ai.EventDownloadFailed
+				}
+				container.Publish(&ai.GenerateInfo{
+					Status:      ai.Stage,
+					Type:        typ,
+					Task:        info.Task,
+					PromptIndex: info.PromptIndex,
+					Attempt:     info.Attempt,
+					Time:        now,
+					Duration:    r.duration,
+					Elapsed:     info.Elapsed + now.Sub(info.Time),
+					Err:         r.err,
+				})
+			}
+		}
+
+		album.ETA = nil
+		switch {
+		case len(album.Finished) >= len(album.Prompts):
+			album.Status = "finished"
+			album.Percentage = 100
+		case fatalErr != nil:
+			// Human intervention is needed before resuming the album
+			album.Status = "paused"
+			log.Warn("album paused", "dir", albumDir, "error", fatalErr)
+		case ctx.Err() != nil:
+			album.Status = "cancelled"
+		default:
+			album.Status = "incomplete"
+		}
+		if err := album.Save(albumFile); err != nil {
+			log.Error("couldn't save album", "error", err)
+		}
+		if err := album.WriteHTML(albumDir); err != nil {
+			log.Error("couldn't write album html", "error", err)
+		}
+		a.notifyAlbum(album, fatalErr)
+		log.Info("album "+album.Status, "dir", albumDir)
+	}()
 	return nil
 }
 
-func (a *AiDrawClient) ToImages(ctx context.Context, client *discord.Client, image *ai.Image, imgDir string, download, upscale, preview bool) []*Image {
+// startJob adds the job to the queue and starts the workers if they aren't
+// running.
+func (a *AiDrawClient) startJob(ctx context.Context, identify string) (<-chan *ai.GenerateInfo, error) {
+	a.workLck.Lock()
+	defer a.workLck.Unlock()
+	out, err := a.queue.add(ctx, identify)
+	if err != nil {
+		return nil, err
+	}
+	if a.workDone != nil {
+		return out, nil
+	}
 
-	if !download {
-		return []*Image{{
-			Prompt: image.Prompt,
-			URL:    image.URL,
-		}}
+	ctx, cancel := context.WithCancel(ai.WithLogger(context.Background(), a.log))
+	done := make(chan struct{})
+	a.workCancel = cancel
+	a.workDone = done
+	go func() {
+		defer close(done)
+		err := ai.Work(ctx, a.AiCli, a.queue, a.cfg.Concurrency, a.cfg.Wait, a.retry, a.cfg.Budget(), a.queue.emit)
+		if err != nil {
+			a.log.Error("workers stopped", "error", err)
+		}
+
+		// Jobs enqueued from now on start new workers
+		a.workLck.Lock()
+		cancel()
+		a.workCancel = nil
+		a.workDone = nil
+		jobs := a.queue.drain()
+		a.workLck.Unlock()
+		for _, j := range jobs {
+			j.end(err)
+		}
+	}()
+	return out, nil
+}
+
+type processed struct {
+	info   *ai.GenerateInfo
+	images []*Image
+	// duration is how long the images took to be processed
+	duration time.Duration
+	// err is why some images couldn't be saved
+	err error
+}
+
+// process downloads, splits and creates thumbnails of the generated images
+// using a pool of download workers.
+// Results are sent in the order of the events, so a prompt isn't reported as
+// finished while previous images are being downloaded.
+func (a *AiDrawClient) process(ctx context.Context, in <-chan *ai.GenerateInfo, imgDir string) <-chan *processed {
+	workers := a.cfg.DownloadWorkers
+	if workers <= 0 {
+		workers = defaultDownloadWorkers
 	}
 
-	// Create image output name
-	localFile := image.FileName()
-	imgOutput := fmt.Sprintf("%s/%s", imgDir, localFile)
-	if err := client.Download(ctx, image.URL, imgOutput); err != nil {
-		log.Println(fmt.Errorf("❌ couldn't download `%s`: %w", image.URL, err))
+	type job struct {
+		info   *ai.GenerateInfo
+		result chan *processed
+	}
+	jobs := make(chan *job)
+	// results keeps the pending results in order
+	results := make(chan chan *processed, 2*workers)
+	go func() {
+		defer close(results)
+		defer close(jobs)
+		for info := range in {
+			result := make(chan *processed, 1)
+			results <- result
+			if info.Image == nil {
+				result <- &processed{info: info}
+				continue
+			}
+			jobs <- &job{info: info, result: result}
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range jobs {
+				start := time.Now()
+				images, err := a.ToImages(ctx, a.downloader, j.info.Image, imgDir, a.cfg.Download, !j.info.Image.Preview, a.cfg.Thumbnail)
+				j.result <- &processed{info: j.info, images: images, duration: time.Since(start), err: err}
+			}
+		}()
 	}
 
-	if upscale && preview {
-		base := filepath.Base(imgOutput)
-		base = base[:len(base)-len(filepath.Ext(base))]
-		previewOutput := fmt.Sprintf("%s/_thumbnails/%s.jpg", imgDir, base)
-		if err := img.Resize(8, imgOutput, previewOutput); err != nil {
-			log.Println(fmt.Errorf("❌ couldn't preview `%s`: %w", imgOutput, err))
+	out := make(chan *processed)
+	go func() {
+		defer close(out)
+		for result := range results {
+			out <- <-result
 		}
+	}()
+	return out
+}
+
+// ToImages returns the album images of the generated image, downloading its
+// files if download is set. Images that couldn't be saved are returned
+// without file along with the error.
+func (a *AiDrawClient) ToImages(ctx context.Context, client Downloader, image *ai.Image, imgDir string, download, upscale, preview bool) ([]*Image, error) {
+
+	if !download {
+		return []*Image{a.newImage(image, "")}, nil
+	}
+	log := ai.Logger(ctx, a.log).With("prompt", image.PromptIndex, "url", image.URL)
+
+	// Images are downloaded to temporary files that are renamed once their
+	// content is known
+	ext := filepath.Ext(strings.Split(image.URL, "?")[0])
+	grid, err := tempFile(imgDir, ext)
+	if err != nil {
+		log.Error("couldn't download image", "error", err)
+		return []*Image{a.newImage(image, "")}, fmt.Errorf("couldn't download image: %w", err)
+	}
+	defer func() { _ = os.Remove(grid) }()
+	if err := client.Download(ctx, image.URL, grid); err != nil {
+		log.Error("couldn't download image", "error", err)
+		return []*Image{a.newImage(image, "")}, fmt.Errorf("couldn't download image: %w", err)
+	}
+	if fi, err := os.Stat(grid); err == nil {
+		a.metrics.downloadBytes.Add(float64(fi.Size()))
 	}
 
 	if upscale {
-		return []*Image{{
-			Prompt: image.Prompt,
-			URL:    image.URL,
-			File:   localFile,
-		}}
+		downloaded, err := a.saveImage(log, a.newImage(image, ""), imgDir, grid)
+		if preview && downloaded.File != "" {
+			downloaded.Thumbnail = thumbnail(log, 8, imgDir, downloaded.File)
+			writeMetadata(log, imgDir, downloaded, downloaded.Thumbnail)
+		}
+		return []*Image{downloaded}, err
 	}
 
 	var images []*Image
+	var errs []error
+	var splits []string
+	for j := 0; j < ai.GridSize; j++ {
+		split, err := tempFile(imgDir, ext)
+		if err != nil {
+			log.Error("couldn't split image", "error", err)
+			break
+		}
+		defer func() { _ = os.Remove(split) }()
+		splits = append(splits, split)
+	}
+	if len(splits) == ai.GridSize {
+		err = img.Split4(grid, splits)
+		if err != nil {
+			log.Error("couldn't split image", "error", err)
+		}
+	}
+	if len(splits) < ai.GridSize || err != nil {
+		// Keep the downloaded grid as a single image
+		saved, err := a.saveImage(log, a.newImage(image, ""), imgDir, grid)
+		return []*Image{saved}, err
+	}
+
+	for j, file := range splits {
+		split := a.newImage(image, "")
+		split.ImageIndex += j
+		split.GridIndex = j
+		if j < len(image.ImageIDs) {
+			split.ImageID = image.ImageIDs[j]
+		}
+		split, err := a.saveImage(log, split, imgDir, file)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if preview && split.File != "" {
+			split.Thumbnail = thumbnail(log, 4, imgDir, split.File)
+			writeMetadata(log, imgDir, split, split.Thumbnail)
+		}
+		images = append(images, split)
+	}
+	return images, errors.Join(errs...)
+}
+
+// tempFile returns the path of a new temporary file in the directory.
+func tempFile(dir, ext string) (string, error) {
+	f, err := os.CreateTemp(dir, ".download-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// saveImage embeds the metadata of the image in the downloaded file and
+// moves it to its name in the album directory. The image is returned without
+// file, along with the error, if it can't be saved.
+func (a *AiDrawClient) saveImage(log *slog.Logger, image *Image, imgDir, tmp string) (*Image, error) {
+	// The metadata is written first so the name hash is of the saved bytes
+	writeMetadata(log, imgDir, image, filepath.Base(tmp))
+	name, err := a.fileName(image, imgDir, tmp)
+	if err == nil {
+		name, err = a.moveFile(tmp, imgDir, name)
+	}
+	if err != nil {
+		log.Error("couldn't save image", "error", err)
+		image.DownloadedAt = nil
+		return image, fmt.Errorf("couldn't save image: %w", err)
+	}
+	image.File = name
+	now := time.Now().UTC()
+	image.DownloadedAt = &now
+	return image, nil
+}
 
-	localFiles := image.FileNames()
-	var imgOutputs []string
-	for _, localFile := range localFiles {
-		imgOutputs = append(imgOutputs, fmt.Sprintf("%s/%s", imgDir, localFile))
-		images = append(images, &Image{
-			Prompt: image.Prompt,
-			URL:    image.URL,
-			File:   localFile,
-		})
-	}
-	if err := img.Split4(imgOutput, imgOutputs); err != nil {
-		log.Println(fmt.Errorf("❌ couldn't split `%s`: %w", imgOutput, err))
-		return images
-	}
-
-	if preview {
-		for _, imgOutput := range imgOutputs {
-			base := filepath.Base(imgOutput)
-			base = base[:len(base)-len(filepath.Ext(base))]
-			previewOutput := fmt.Sprintf("%s/%s.jpg", imgDir, base)
-			if err := img.Resize(4, imgOutput, previewOutput); err != nil {
-				log.Println(fmt.Errorf("❌ couldn't preview `%s`: %w", imgOutput, err))
+// fileName returns the name of the image from the file name template.
+func (a *AiDrawClient) fileName(image *Image, imgDir, file string) (string, error) {
+	v := &filename.Values{
+		Album:       filepath.Base(imgDir),
+		Prompt:      image.Prompt,
+		PromptIndex: image.PromptIndex,
+		ImageIndex:  image.ImageIndex,
+		GridIndex:   image.GridIndex,
+		Variation:   image.Variation,
+		Ext:         filepath.Ext(file),
+	}
+	if a.filename.NeedsHash() {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(data)
+		v.Hash = hex.EncodeToString(sum[:])
+	}
+	return a.filename.Execute(v)
+}
+
+// moveFile moves the file to its name in the album directory and returns the
+// name. A numeric suffix is added to the name when another file already uses
+// it, unless both have the same content.
+func (a *AiDrawClient) moveFile(file, imgDir, name string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	a.filesLck.Lock()
+	defer a.filesLck.Unlock()
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		dst := filepath.Join(imgDir, filepath.FromSlash(name))
+		existing, err := os.ReadFile(dst)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return "", err
 			}
+			if err := os.Rename(file, dst); err != nil {
+				return "", err
+			}
+			return name, nil
+		case err != nil:
+			return "", err
+		case bytes.Equal(existing, data):
+			return name, nil
 		}
+		name = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+}
+
+// writeMetadata embeds the generation info of the image in one of its files,
+// the album directory is named after the album.
+func writeMetadata(log *slog.Logger, imgDir string, image *Image, file string) {
+	if file == "" {
+		return
+	}
+	m := &img.Metadata{
+		Prompt:         image.Prompt,
+		ResponsePrompt: image.ResponsePrompt,
+		Bot:            image.Bot,
+		Album:          filepath.Base(imgDir),
+		URL:            image.URL,
+	}
+	if image.Params != nil {
+		m.Seed = image.Params.Seed
+	}
+	path := fmt.Sprintf("%s/%s", imgDir, file)
+	if err := img.WriteMetadata(path, m); err != nil && !errors.Is(err, img.ErrUnsupportedFormat) {
+		log.Error("couldn't write metadata", "file", path, "error", err)
+	}
+}
+
+// newImage returns the album image of a generated image, along with its
+// provenance.
+func (a *AiDrawClient) newImage(image *ai.Image, file string) *Image {
+	img := &Image{
+		Prompt:         image.Prompt,
+		PromptIndex:    image.PromptIndex,
+		ImageIndex:     image.ImageIndex,
+		GridIndex:      image.GridIndex,
+		Variation:      image.Variation,
+		Preview:        image.Preview,
+		URL:            image.URL,
+		File:           file,
+		Bot:            strings.ToLower(a.cfg.Bot),
+		ResponsePrompt: image.ResponsePrompt,
+		MessageID:      image.MessageID,
+		ImageID:        image.ImageID,
+		Parent:         image.Parent,
+		CreatedAt:      image.CreatedAt,
+	}
+	// Other bots don't share the parameters syntax of midjourney, their
+	// prompts are kept as written
+	if img.Bot == "midjourney" {
+		img.Params = imageParams(image)
+	}
+	if file != "" {
+		now := time.Now().UTC()
+		img.DownloadedAt = &now
+	}
+	return img
+}
+
+// imageParams returns the midjourney parameters of the response prompt of
+// the image, or nil if it has none or they can't be parsed.
+func imageParams(image *ai.Image) *album.Params {
+	prompt := image.ResponsePrompt
+	if prompt == "" {
+		prompt = image.Prompt
+	}
+	p, err := midjourney.ParseParams(prompt)
+	if err != nil {
+		return nil
+	}
+	params := &album.Params{
+		Version: p.Version,
+		Niji:    p.Niji,
+		Seed:    p.Seed,
+		Quality: p.Quality,
+		Stylize: p.Stylize,
+		Chaos:   p.Chaos,
+		Style:   p.Style,
+	}
+	if p.Aspect != nil {
+		params.Aspect = p.Aspect.String()
+	}
+	if *params == (album.Params{}) {
+		return nil
+	}
+	return params
+}
+
+// thumbnail creates a thumbnail of the image file and returns its path
+// relative to the album directory.
+func thumbnail(log *slog.Logger, div int, imgDir, file string) string {
+	name := album.ThumbnailName(file)
+	input := fmt.Sprintf("%s/%s", imgDir, file)
+	output := fmt.Sprintf("%s/%s", imgDir, name)
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		log.Error("couldn't create thumbnail", "file", input, "error", err)
+		return ""
+	}
+	if err := img.Resize(div, input, output); err != nil {
+		log.Error("couldn't create thumbnail", "file", input, "error", err)
+		return ""
 	}
-	return images
+	return name
 }
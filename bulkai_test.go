@@ -0,0 +1,941 @@
+package bulkai
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+	"github.com/ZYKJShadow/bulkai/pkg/ai/fake"
+	"github.com/ZYKJShadow/bulkai/pkg/ai/midjourney"
+	"github.com/ZYKJShadow/bulkai/pkg/album"
+	"github.com/ZYKJShadow/bulkai/pkg/img"
+	"github.com/ZYKJShadow/bulkai/pkg/logging"
+	"github.com/ZYKJShadow/bulkai/pkg/store"
+	"github.com/ZYKJShadow/bulkai/pkg/webhook"
+)
+
+func TestGenerateFake(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		Bot:       "fake",
+		Output:    dir,
+		Download:  true,
+		Thumbnail: true,
+		Fake:      &fake.Config{Size: 16},
+	}
+	ctx := context.Background()
+	cli, err := NewCli(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	if err := cli.Generate(ctx, []string{"a cat", "a dog"}, false, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	types := map[ai.EventType]int{}
+	for info := range cli.ReadImageChan("test") {
+		if info.Status == ai.Fail || info.Status == ai.Fatal {
+			t.Errorf("unexpected failure: %v", info.Err)
+		}
+		types[info.Type]++
+	}
+	// Each prompt is queued, started, imagined and its images downloaded
+	for _, typ := range []ai.EventType{ai.EventPromptQueued, ai.EventPromptStarted, ai.EventImagineSent, ai.EventPreviewReceived} {
+		if types[typ] != 2 {
+			t.Errorf("expected 2 %s events, got %d", typ, types[typ])
+		}
+	}
+	if types[ai.EventUpscaleFinished] != 0 || types[ai.EventDownloadDone] != 2 {
+		t.Errorf("unexpected events %v", types)
+	}
+
+	// Generating the album again reuses the identify without waiting for
+	// the previous container to be removed
+	if err := cli.Generate(ctx, nil, false, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for info := range cli.ReadImageChan("test") {
+		t.Errorf("unexpected event for a finished album: %+v", info)
+	}
+
+	a, err := LoadAlbum(filepath.Join(dir, "test", album.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status != "finished" || a.ETA != nil {
+		t.Errorf("expected status finished without eta, got %s %v", a.Status, a.ETA)
+	}
+	if len(a.Finished) != 2 {
+		t.Errorf("expected 2 finished prompts, got %v", a.Finished)
+	}
+	if len(a.Images) != 8 {
+		t.Fatalf("expected 8 images, got %d", len(a.Images))
+	}
+	for _, image := range a.Images {
+		for _, f := range []string{image.File, image.Thumbnail} {
+			// Files keep the generation metadata
+			m, err := img.ReadMetadata(filepath.Join(dir, "test", f))
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if m == nil || m.Prompt != image.Prompt || m.Album != "test" || m.Bot != "fake" || m.URL != image.URL {
+				t.Errorf("unexpected metadata of %s: %+v", f, m)
+			}
+		}
+	}
+}
+
+func TestGenerateOptions(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		Bot:    "fake",
+		Output: dir,
+		Fake:   &fake.Config{Size: 16},
+	}
+	ctx := context.Background()
+	cli, err := NewCli(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	prompts := []*ai.Prompt{
+		{Text: "a cat --ar 3:2 --seed 42", Options: ai.Options{Upscale: []int{1}}},
+		{Text: "a dog", Options: ai.Options{Variation: true}},
+	}
+	if err := cli.GeneratePrompts(ctx, prompts, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for info := range cli.ReadImageChan("test") {
+		if info.Status == ai.Fail || info.Status == ai.Fatal {
+			t.Errorf("unexpected failure: %v", info.Err)
+		}
+	}
+
+	a, err := LoadAlbum(filepath.Join(dir, "test", album.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status != "finished" || a.Percentage != 100 {
+		t.Errorf("expected album finished at 100%%, got %s at %.0f%%", a.Status, a.Percentage)
+	}
+	if !reflect.DeepEqual(a.Options, []ai.Options{prompts[0].Options, prompts[1].Options}) {
+		t.Errorf("unexpected album options: %+v", a.Options)
+	}
+	type key struct {
+		prompt, image, grid, variation int
+		preview                        bool
+	}
+	got := make(map[key]bool)
+	for _, img := range a.Images {
+		got[key{img.PromptIndex, img.ImageIndex, img.GridIndex, img.Variation, img.Preview}] = true
+	}
+	want := map[key]bool{
+		{0, 1, 1, 0, false}: true,
+		{1, 0, 0, 0, true}:  true,
+		{1, 4, 0, 1, true}:  true,
+		{1, 8, 1, 1, true}:  true,
+		{1, 12, 2, 1, true}: true,
+		{1, 16, 3, 1, true}: true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected images: %v", got)
+	}
+
+	// Images keep their provenance
+	grids := make(map[int]string)
+	for _, img := range a.Images {
+		if img.Bot != "fake" || img.MessageID == "" || img.CreatedAt.IsZero() || img.ResponsePrompt != img.Prompt {
+			t.Errorf("missing provenance: %+v", img)
+		}
+		// Only midjourney prompts are parsed
+		if img.Params != nil {
+			t.Errorf("unexpected params: %+v", img.Params)
+		}
+		switch {
+		case img.PromptIndex == 0:
+			if img.ImageID == "" {
+				t.Errorf("unexpected upscaled image: %+v", img)
+			}
+		case img.Variation == 0:
+			grids[-1] = img.MessageID
+		default:
+			if img.Parent == nil || img.Parent.Index != img.GridIndex || img.Parent.ImageID == "" {
+				t.Errorf("unexpected parent: %+v", img.Parent)
+				continue
+			}
+			grids[img.GridIndex] = img.Parent.MessageID
+		}
+	}
+	for i := 0; i < ai.GridSize; i++ {
+		if grids[i] != grids[-1] {
+			t.Errorf("variation %d: expected parent message %s, got %s", i, grids[-1], grids[i])
+		}
+	}
+}
+
+func TestGenerateQueue(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		Bot:         "fake",
+		Output:      dir,
+		Concurrency: 1,
+		Fake:        &fake.Config{Size: 16, Latency: 20 * time.Millisecond},
+	}
+	ctx := context.Background()
+	cli, err := NewCli(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// Jobs share the workers and are processed in order
+	jobs := []string{"first", "second"}
+	prompts := [][]string{{"a cat", "a dog"}, {"a bird"}}
+	for i, id := range jobs {
+		if err := cli.Generate(ctx, prompts[i], false, false, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cli.Generate(ctx, nil, false, false, "first"); err == nil {
+		t.Error("expected error generating a running album")
+	}
+
+	var lck sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for _, id := range jobs {
+		id := id
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for info := range cli.ReadImageChan(id) {
+				if info.Status == ai.Started || info.Status == ai.Wait || info.Status == ai.Stage {
+					continue
+				}
+				if info.Status != ai.Complete {
+					t.Errorf("%s: unexpected status %s: %v", id, info.Status, info.Err)
+				}
+				lck.Lock()
+				order = append(order, id)
+				lck.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := []string{"first", "first", "second"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("expected %v, got %v", want, order)
+	}
+}
+
+func TestGenerateResume(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		Bot:         "fake",
+		Output:      dir,
+		Concurrency: 1,
+		Fake:        &fake.Config{Size: 16, Latency: 20 * time.Millisecond},
+	}
+	prompts := []string{"a cat", "a dog", "a bird"}
+
+	// Stop the job after the first prompt
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cli, err := NewCli(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Generate(ctx, prompts, false, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for info := range cli.ReadImageChan("test") {
+		if info.Status == ai.Complete {
+			cancel()
+		}
+	}
+	cli.DelContainer("test")
+	if err := cli.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Open(filepath.Join(dir, QueueFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, items := s.Job("test")
+	if len(items) != 3 {
+		t.Fatalf("expected 3 items, got %d", len(items))
+	}
+	if items[0].State != store.Done || items[1].State != store.Pending || items[2].State != store.Pending {
+		t.Errorf("unexpected states: %s %s %s", items[0].State, items[1].State, items[2].State)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new client resumes the remaining prompts
+	cli, err = NewCli(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Generate(context.Background(), nil, false, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for info := range cli.ReadImageChan("test") {
+		if info.Image != nil {
+			got = append(got, info.Image.PromptIndex)
+		}
+	}
+	if !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("expected prompts [1 2], got %v", got)
+	}
+	a, err := LoadAlbum(filepath.Join(dir, "test", album.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status != "finished" {
+		t.Errorf("expected status finished, got %s", a.Status)
+	}
+}
+
+type failingDownloader struct{}
+
+func (failingDownloader) Download(context.Context, string, string) error {
+	return errors.New("download failed")
+}
+
+func TestGenerateDownloadFailed(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		Bot:      "fake",
+		Output:   dir,
+		Download: true,
+		Fake:     &fake.Config{Size: 16},
+	}
+	ctx := context.Background()
+	cli, err := NewCli(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// The files of the album can't be downloaded
+	downloader := cli.downloader
+	cli.downloader = failingDownloader{}
+	if err := cli.Generate(ctx, []string{"a cat"}, false, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	types := map[ai.EventType]int{}
+	for info := range cli.ReadImageChan("test") {
+		types[info.Type]++
+		if info.Type == ai.EventDownloadFailed && info.Err == nil {
+			t.Error("expected the error of the download")
+		}
+	}
+	if types[ai.EventDownloadFailed] != 1 || types[ai.EventDownloadDone] != 0 {
+		t.Errorf("unexpected events %v", types)
+	}
+	a, err := LoadAlbum(filepath.Join(dir, "test", album.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status == "finished" || len(a.Finished) != 0 || len(a.Images) != 1 || a.Images[0].File != "" {
+		t.Fatalf("unexpected album %s %v %d", a.Status, a.Finished, len(a.Images))
+	}
+
+	// Resuming the album replaces the failed image
+	cli.downloader = downloader
+	if err := cli.Generate(ctx, nil, false, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for info := range cli.ReadImageChan("test") {
+		if info.Type == ai.EventDownloadFailed {
+			t.Errorf("unexpected failure: %v", info.Err)
+		}
+	}
+	a, err = LoadAlbum(filepath.Join(dir, "test", album.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status != "finished" {
+		t.Errorf("expected status finished, got %s", a.Status)
+	}
+	if len(a.Images) != 4 {
+		t.Fatalf("expected 4 images, got %d", len(a.Images))
+	}
+	for i, image := range a.Images {
+		if image.File == "" || image.ImageIndex != i {
+			t.Errorf("unexpected image %d: %+v", i, image)
+		}
+	}
+}
+
+func TestGenerateFatalAlbums(t *testing.T) {
+	for _, tt := range []struct {
+		kind string
+		want string
+	}{
+		// A fatal error of a prompt only pauses its album
+		{fake.Fatal, "finished"},
+		// A fatal error of the account stops every album
+		{fake.Account, "paused"},
+	} {
+		t.Run(tt.kind, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := &Config{
+				Bot:         "fake",
+				Output:      dir,
+				Concurrency: 1,
+				Fake: &fake.Config{
+					Size:     16,
+					Latency:  20 * time.Millisecond,
+					Failures: []*fake.Failure{{Match: "dog", Action: "imagine", Kind: tt.kind}},
+				},
+			}
+			ctx := context.Background()
+			cli, err := NewCli(ctx, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cli.Close()
+
+			// The second album is waiting when the first one fails
+			if err := cli.Generate(ctx, []string{"a dog", "a cat"}, false, false, "first"); err != nil {
+				t.Fatal(err)
+			}
+			if err := cli.Generate(ctx, []string{"a bird", "a fish"}, false, false, "second"); err != nil {
+				t.Fatal(err)
+			}
+			var fatalErr error
+			for info := range cli.ReadImageChan("first") {
+				if info.Status == ai.Fatal {
+					fatalErr = info.Err
+				}
+			}
+			for range cli.ReadImageChan("second") {
+			}
+			if fatalErr == nil {
+				t.Error("expected a fatal error in the first album")
+			}
+			for name, want := range map[string]string{"first": "paused", "second": tt.want} {
+				a, err := LoadAlbum(filepath.Join(dir, name, album.FileName))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if a.Status != want {
+					t.Errorf("%s: expected status %s, got %s", name, want, a.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateWebhooks(t *testing.T) {
+	var lck sync.Mutex
+	var events []*WebhookEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !webhook.Verify("secret", body, r.Header.Get(webhook.SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e WebhookEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lck.Lock()
+		defer lck.Unlock()
+		events = append(events, &e)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cfg := &Config{
+		Bot:         "fake",
+		Output:      dir,
+		Download:    true,
+		Concurrency: 1,
+		// A single download worker keeps the events in order
+		DownloadWorkers: 1,
+		Webhooks:        []string{srv.URL},
+		WebhookSecret:   "secret",
+		Fake: &fake.Config{
+			Size: 16,
+			Failures: []*fake.Failure{
+				{Match: "dog", Action: fake.Imagine, Kind: fake.Permanent},
+			},
+		},
+	}
+	ctx := context.Background()
+	cli, err := NewCli(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Generate(ctx, []string{"a cat", "a dog"}, false, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for range cli.ReadImageChan("test") {
+	}
+	// Close waits for the deliveries
+	if err := cli.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		WebhookPromptStarted, WebhookImageCompleted,
+		WebhookPromptStarted, WebhookPromptFailed,
+		WebhookAlbumStopped,
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %d", len(want), len(events))
+	}
+	for i, e := range events {
+		if e.Type != want[i] {
+			t.Errorf("event %d: expected %s, got %s", i, want[i], e.Type)
+		}
+		if e.Album != "test" {
+			t.Errorf("event %d: expected album test, got %s", i, e.Album)
+		}
+	}
+	if img := events[1]; len(img.Images) != 4 || img.Images[0].File == "" {
+		t.Errorf("expected 4 downloaded images, got %+v", img.Images)
+	}
+	if failed := events[3]; failed.Prompt != "a dog" || failed.PromptIndex == nil || *failed.PromptIndex != 1 || failed.Error == "" {
+		t.Errorf("unexpected failed event: %+v", failed)
+	}
+	if album := events[4]; album.Status != "incomplete" {
+		t.Errorf("expected incomplete album, got %s", album.Status)
+	}
+}
+
+func TestGenerateFileName(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		Bot:       "fake",
+		Output:    dir,
+		Download:  true,
+		Thumbnail: true,
+		FileName:  "{prompt:03}/{image:02}_{slug:4}_{hash8}.{ext}",
+		Fake:      &fake.Config{Size: 16},
+	}
+	ctx := context.Background()
+	cli, err := NewCli(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	if err := cli.Generate(ctx, []string{"a cat", "a dog"}, false, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for info := range cli.ReadImageChan("test") {
+		if info.Status == ai.Fail || info.Status == ai.Fatal {
+			t.Errorf("unexpected failure: %v", info.Err)
+		}
+	}
+
+	a, err := LoadAlbum(filepath.Join(dir, "test", album.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Images) != 8 {
+		t.Fatalf("expected 8 images, got %d", len(a.Images))
+	}
+	nameRegex := regexp.MustCompile(`^00[01]/0[0-3]_a_(ca|do)_[0-9a-f]{8}\.png$`)
+	for _, image := range a.Images {
+		if !nameRegex.MatchString(image.File) {
+			t.Errorf("unexpected file name %s", image.File)
+		}
+		if want := album.ThumbnailName(image.File); image.Thumbnail != want {
+			t.Errorf("expected thumbnail %s, got %s", want, image.Thumbnail)
+		}
+		for _, f := range []string{image.File, image.Thumbnail} {
+			if _, err := os.Stat(filepath.Join(dir, "test", f)); err != nil {
+				t.Error(err)
+			}
+		}
+		// The hash is of the saved file
+		data, err := os.ReadFile(filepath.Join(dir, "test", image.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		if hash := hex.EncodeToString(sum[:4]); !strings.HasSuffix(image.File, "_"+hash+".png") {
+			t.Errorf("expected hash %s in %s", hash, image.File)
+		}
+	}
+
+	// Temporary files are removed
+	tmps, err := filepath.Glob(filepath.Join(dir, "test", ".download-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmps) > 0 {
+		t.Errorf("unexpected temporary files %v", tmps)
+	}
+}
+
+func TestImageParams(t *testing.T) {
+	image := &ai.Image{
+		Prompt:         "a cat --ar 3:2 --seed 42",
+		ResponsePrompt: "a cat --ar 3:2 --seed 42 --v 5",
+	}
+	mj := (&AiDrawClient{cfg: &Config{Bot: "Midjourney"}}).newImage(image, "")
+	if p := mj.Params; p == nil || p.Aspect != "3:2" || p.Seed == nil || *p.Seed != 42 || p.Version != "5" {
+		t.Errorf("unexpected midjourney params: %+v", p)
+	}
+
+	// Other bots keep the prompt as written
+	bw := (&AiDrawClient{cfg: &Config{Bot: "bluewillow"}}).newImage(image, "")
+	if bw.Params != nil {
+		t.Errorf("unexpected bluewillow params: %+v", bw.Params)
+	}
+	if bw.Bot != "bluewillow" || bw.Prompt != image.Prompt || bw.ResponsePrompt != image.ResponsePrompt {
+		t.Errorf("unexpected bluewillow image: %+v", bw)
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	dir := t.TempDir()
+	cli := &AiDrawClient{}
+	move := func(data, name string) string {
+		t.Helper()
+		file := filepath.Join(dir, "tmp")
+		if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := cli.moveFile(file, dir, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	// Existing files with other content aren't overwritten
+	for i, tt := range []struct {
+		data string
+		want string
+	}{
+		{"a", "sub/a.png"},
+		{"a", "sub/a.png"},
+		{"b", "sub/a_1.png"},
+		{"c", "sub/a_2.png"},
+		{"b", "sub/a_1.png"},
+	} {
+		if got := move(tt.data, "sub/a.png"); got != tt.want {
+			t.Errorf("%d: expected %s, got %s", i, tt.want, got)
+		}
+	}
+	for name, want := range map[string]string{"a.png": "a", "a_1.png": "b", "a_2.png": "c"} {
+		data, err := os.ReadFile(filepath.Join(dir, "sub", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: expected %s, got %s", name, want, data)
+		}
+	}
+}
+
+func TestGenerateLogs(t *testing.T) {
+	var buf bytes.Buffer
+	cfg := &Config{
+		Bot:       "fake",
+		Output:    t.TempDir(),
+		Debug:     true,
+		LogFormat: "json",
+		Fake:      &fake.Config{Size: 16},
+		Session:   Session{Token: "secret-session-token"},
+	}
+	logger, err := NewLogger(&buf, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Logger = logger
+	ctx := context.Background()
+	cli, err := NewCli(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Generate(ctx, []string{"a cat"}, false, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for range cli.ReadImageChan("test") {
+	}
+	cli.log.Debug("request failed", "url", "https://foo.bar/?auth=secret-session-token")
+	if err := cli.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var created, redacted bool
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		if entry["bot"] != "fake" {
+			t.Errorf("expected bot attribute in %q", line)
+		}
+		switch entry["msg"] {
+		case "album created":
+			created = entry["album"] == "test"
+		case "request failed":
+			redacted = entry["url"] == "https://foo.bar/?auth="+logging.Redacted
+		}
+	}
+	if !created || !redacted {
+		t.Errorf("unexpected logs:\n%s", buf.String())
+	}
+}
+
+func TestGenerateMetrics(t *testing.T) {
+	// Find a free port for the metrics server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	cfg := &Config{
+		Bot:         "fake",
+		Output:      t.TempDir(),
+		Download:    true,
+		MetricsAddr: addr,
+		Fake: &fake.Config{
+			Size:     16,
+			Failures: []*fake.Failure{{Match: "dog", Action: "imagine", Kind: fake.Permanent}},
+		},
+	}
+	ctx := context.Background()
+	cli, err := NewCli(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Generate(ctx, []string{"a cat", "a dog"}, false, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for range cli.ReadImageChan("test") {
+	}
+
+	resp, err := http.Get("http://" + addr + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	for _, want := range []string{
+		`bulkai_prompts_total{result="done"} 1`,
+		`bulkai_prompts_total{result="failed"} 1`,
+		`bulkai_images_total{kind="preview"} 1`,
+		`bulkai_errors_total{class="other"} 1`,
+		`bulkai_job_duration_seconds_count{job="imagine"} 1`,
+		"bulkai_inflight_prompts 0",
+		"bulkai_download_bytes_total ",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestGenerateMetricsUpscale(t *testing.T) {
+	cfg := &Config{
+		Bot:    "fake",
+		Output: t.TempDir(),
+		Fake: &fake.Config{
+			Size:     16,
+			Failures: []*fake.Failure{{Match: "cat", Action: "upscale", Kind: fake.Permanent}},
+		},
+	}
+	ctx := context.Background()
+	cli, err := NewCli(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Generate(ctx, []string{"a cat"}, false, true, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for range cli.ReadImageChan("test") {
+	}
+
+	rec := httptest.NewRecorder()
+	cli.Metrics().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+	got := rec.Body.String()
+	// Every failed upscale is counted and the prompt without images failed
+	for _, want := range []string{
+		`bulkai_prompts_total{result="failed"} 1`,
+		fmt.Sprintf(`bulkai_errors_total{class="other"} %d`, ai.GridSize),
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, `bulkai_prompts_total{result="done"}`) {
+		t.Errorf("unexpected done prompts in:\n%s", got)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("imagine: %w", midjourney.ErrBannedPrompt), "banned-prompt"},
+		{ai.NewError(midjourney.ErrQueueFull, true), "queue-full"},
+		{midjourney.ErrJobQueued, "job-queued"},
+		{ai.NewFatal(errors.New("captcha")), "fatal"},
+		{errors.New("boom"), "other"},
+	} {
+		if got := errorClass(tt.err); got != tt.want {
+			t.Errorf("%v: expected %s, got %s", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestGenerateBudget(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		Bot:         "fake",
+		Output:      dir,
+		Concurrency: 1,
+		MaxJobs:     2,
+		Fake:        &fake.Config{Size: 16},
+	}
+	prompts := []string{"a cat", "a dog", "a bird"}
+
+	// Previews only need an imagine job, so two prompts fit in the budget
+	cli, err := NewCli(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Generate(context.Background(), prompts, false, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	var fatalErr error
+	for info := range cli.ReadImageChan("test") {
+		if info.Status == ai.Fatal {
+			fatalErr = info.Err
+		}
+	}
+	cli.DelContainer("test")
+	if err := cli.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(fatalErr, ai.ErrBudgetExceeded) {
+		t.Errorf("expected budget exceeded, got %v", fatalErr)
+	}
+	a, err := LoadAlbum(filepath.Join(dir, "test", album.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status != "paused" || !reflect.DeepEqual(a.Finished, []int{0, 1}) {
+		t.Errorf("unexpected album %s %v", a.Status, a.Finished)
+	}
+
+	// The album is resumed with a new budget
+	cli, err = NewCli(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Generate(context.Background(), nil, false, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for range cli.ReadImageChan("test") {
+	}
+	a, err = LoadAlbum(filepath.Join(dir, "test", album.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status != "finished" {
+		t.Errorf("expected status finished, got %s", a.Status)
+	}
+}
+
+func TestGenerateBudgetAlbums(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		Bot:         "fake",
+		Output:      dir,
+		Concurrency: 1,
+		MaxJobs:     2,
+		Fake:        &fake.Config{Size: 16},
+	}
+	cli, err := NewCli(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// Each album has its own budget, so the second one isn't stopped by the
+	// jobs of the first one
+	for _, name := range []string{"first", "second"} {
+		if err := cli.Generate(context.Background(), []string{"a cat", "a dog"}, false, false, name); err != nil {
+			t.Fatal(err)
+		}
+		for info := range cli.ReadImageChan(name) {
+			if info.Status == ai.Fatal {
+				t.Errorf("%s: unexpected fatal error %v", name, info.Err)
+			}
+		}
+		a, err := LoadAlbum(filepath.Join(dir, name, album.FileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Status != "finished" {
+			t.Errorf("%s: expected status finished, got %s", name, a.Status)
+		}
+	}
+
+	// An album that exceeds its budget is paused alone
+	if err := cli.Generate(context.Background(), []string{"a cat", "a dog", "a bird"}, false, false, "third"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Generate(context.Background(), []string{"a fish"}, false, false, "fourth"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"third", "fourth"} {
+		for range cli.ReadImageChan(name) {
+		}
+	}
+	for name, want := range map[string]string{"third": "paused", "fourth": "finished"} {
+		a, err := LoadAlbum(filepath.Join(dir, name, album.FileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Status != want {
+			t.Errorf("%s: expected status %s, got %s", name, want, a.Status)
+		}
+	}
+}
@@ -1 +1,586 @@
 package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai"
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+	"github.com/ZYKJShadow/bulkai/pkg/album"
+	"github.com/ZYKJShadow/bulkai/pkg/img"
+	"github.com/ZYKJShadow/bulkai/pkg/prompt"
+	"github.com/ZYKJShadow/bulkai/pkg/session"
+	"github.com/ZYKJShadow/bulkai/pkg/tui"
+	"gopkg.in/yaml.v2"
+)
+
+// Build flags
+var Version = ""
+var GitRev = ""
+
+const envPrefix = "BULKAI_"
+
+func main() {
+	// Create signal based context
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if err := run(ctx, os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		slog.Error(err.Error())
+		// Use the conventional exit code for SIGINT if the user stopped us
+		if ctx.Err() != nil {
+			os.Exit(130)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		usage()
+		return flag.ErrHelp
+	}
+	switch args[0] {
+	case "generate":
+		return generate(ctx, args[1:])
+	case "serve":
+		return serve(ctx, args[1:])
+	case "create-session":
+		return createSession(ctx, args[1:])
+	case "album":
+		return albumPage(args[1:])
+	case "inspect":
+		return inspect(args[1:])
+	case "version":
+		return version()
+	case "help", "-h", "-help", "--help":
+		usage()
+		return nil
+	default:
+		usage()
+		return fmt.Errorf("unknown subcommand: %s", args[0])
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: bulkai <subcommand> [flags]
+
+Subcommands:
+  generate        generate images in bulk
+  serve           run an http api to submit generation jobs
+  create-session  create a session file using a browser
+  album           print album status and regenerate its html page
+  inspect         print the generation metadata embedded in image files
+  version         print version`)
+}
+
+func version() error {
+	v := Version
+	rev := GitRev
+	if v == "" {
+		v = "dev"
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+			v = info.Main.Version
+		}
+	}
+	if rev == "" {
+		rev = "unknown"
+	}
+	fmt.Printf("bulkai %s (%s)\n", v, rev)
+	return nil
+}
+
+func generate(ctx context.Context, args []string) error {
+	var dry bool
+	cfg, err := loadConfig("generate", args, func(fs *flag.FlagSet, cfg *bulkai.Config) {
+		fs.StringVar(&cfg.Album, "album", cfg.Album, "album name (optional, time based if empty)")
+		fs.Var(&entriesValue{values: &cfg.Prompts}, "prompt", "prompt or prompts file to generate (can be repeated)")
+		fs.Var(&mapValue{values: &cfg.Variables}, "var", "prompt variable in the form name=value (can be repeated)")
+		fs.IntVar(&cfg.Sample, "sample", cfg.Sample, "number of prompts randomly taken from the combinations (optional)")
+		fs.Int64Var(&cfg.Seed, "seed", cfg.Seed, "seed of the prompt sampling (optional)")
+		fs.IntVar(&cfg.MaxPrompts, "max-prompts", cfg.MaxPrompts, "maximum number of prompts (optional)")
+		fs.BoolVar(&cfg.Progress, "progress", cfg.Progress, "show the progress, as event lines if the output isn't a terminal")
+		fs.BoolVar(&dry, "dry-run", false, "print the number of jobs of the album without generating it")
+	})
+	if err != nil {
+		return err
+	}
+
+	if cfg.Album == "" {
+		cfg.Album = time.Now().UTC().Format("20060102_150405")
+	}
+	prompts, err := bulkai.LoadPrompts(cfg, cfg.Prompts, true, ai.DefaultOptions(cfg.Variation, cfg.Upscale))
+	if err != nil {
+		return err
+	}
+	if dry {
+		return dryRun(cfg, prompts)
+	}
+
+	// Logs are written above the progress display while it runs
+	var display *tui.Display
+	if cfg.Progress {
+		display, err = newDisplay(cfg, prompts)
+		if err != nil {
+			return err
+		}
+		logger, err := bulkai.NewLogger(display, cfg)
+		if err != nil {
+			return err
+		}
+		prev := cfg.Logger
+		cfg.Logger = logger
+		slog.SetDefault(logger)
+		defer func() {
+			_ = display.Close()
+			slog.SetDefault(prev)
+		}()
+	}
+
+	cli, err := bulkai.NewCli(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = cli.Close()
+	}()
+
+	if err := cli.GeneratePrompts(ctx, prompts, cfg.Album); err != nil {
+		return err
+	}
+
+	var failed int
+	var fatalErr error
+	for info := range cli.ReadImageChan(cfg.Album) {
+		if display != nil {
+			display.Event(info)
+		}
+		if info.Status == ai.Fatal {
+			fatalErr = info.Err
+			continue
+		}
+		if info.Err != nil {
+			failed++
+			if display == nil {
+				cfg.Logger.Error("prompt failed", "prompt", info.PromptIndex, "error", info.Err)
+			}
+			continue
+		}
+		if info.Image != nil && display == nil {
+			cfg.Logger.Info("image generated", "prompt", info.Image.PromptIndex, "image", info.Image.ImageIndex, "url", info.Image.URL)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if fatalErr != nil {
+		return fmt.Errorf("generation paused, resume it once the problem is solved: %w", fatalErr)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d generations failed", failed)
+	}
+	return nil
+}
+
+// newDisplay returns the progress display of the album to be generated.
+func newDisplay(cfg *bulkai.Config, prompts []*ai.Prompt) (*tui.Display, error) {
+	prompts, finished, err := albumPrompts(cfg, prompts)
+	if err != nil {
+		return nil, err
+	}
+	return tui.New(os.Stdout, prompts, finished, tui.IsTerminal(os.Stdout)), nil
+}
+
+// albumPrompts returns the prompts of the album to be generated along with
+// the finished ones. Existing albums are resumed with their own prompts.
+func albumPrompts(cfg *bulkai.Config, prompts []*ai.Prompt) ([]*ai.Prompt, []int, error) {
+	a, err := bulkai.LoadAlbum(filepath.Join(cfg.Output, cfg.Album, album.FileName))
+	if err != nil {
+		return nil, nil, err
+	}
+	if a == nil {
+		return prompts, nil, nil
+	}
+	prompts = nil
+	for i, p := range a.Prompts {
+		o := ai.DefaultOptions(cfg.Variation, cfg.Upscale)
+		if i < len(a.Options) {
+			o = a.Options[i]
+		}
+		prompts = append(prompts, &ai.Prompt{Text: p, Options: o})
+	}
+	return prompts, a.Finished, nil
+}
+
+// dryRun prints the jobs the album needs without generating it.
+func dryRun(cfg *bulkai.Config, prompts []*ai.Prompt) error {
+	prompts, finished, err := albumPrompts(cfg, prompts)
+	if err != nil {
+		return err
+	}
+	jobs := ai.Estimate(prompts, finished)
+	fmt.Printf("%s: %d prompts (%d finished)\n", cfg.Album, len(prompts), len(finished))
+	fmt.Printf("  imagine jobs:   %d\n", jobs.Imagine)
+	fmt.Printf("  upscale jobs:   %d\n", jobs.Upscale)
+	fmt.Printf("  variation jobs: %d\n", jobs.Variation)
+	fmt.Printf("  total jobs:     %d (retries not included)\n", jobs.Total())
+	if cfg.MaxJobs > 0 && jobs.Total() > cfg.MaxJobs {
+		fmt.Printf("  the album will be paused before finishing, it needs more than %d jobs (max-jobs)\n", cfg.MaxJobs)
+	}
+	if cfg.MaxJobsPerHour > 0 {
+		hours := (jobs.Total() + cfg.MaxJobsPerHour - 1) / cfg.MaxJobsPerHour
+		fmt.Printf("  at least %d hours at %d jobs per hour (max-jobs-per-hour)\n", hours, cfg.MaxJobsPerHour)
+	}
+	return nil
+}
+
+func serve(ctx context.Context, args []string) error {
+	cfg, err := loadConfig("serve", args, func(fs *flag.FlagSet, cfg *bulkai.Config) {
+		fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "listen address")
+	})
+	if err != nil {
+		return err
+	}
+
+	cli, err := bulkai.NewCli(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = cli.Close()
+	}()
+	return bulkai.Serve(ctx, cli, cfg.Addr)
+}
+
+// legacyConfig accepts the keys used by older config files.
+type legacyConfig struct {
+	bulkai.Config `yaml:",inline"`
+	// Prompts is the old name of prompt
+	Prompts []*prompt.Entry `yaml:"prompts"`
+	// GroupID is the old name of guild
+	GroupID string `yaml:"groupID"`
+}
+
+// parseConfig parses a yaml config file into cfg, unknown keys are rejected
+// but the old names of renamed keys are still accepted.
+func parseConfig(data []byte, cfg *bulkai.Config) error {
+	c := legacyConfig{Config: *cfg}
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return err
+	}
+	if len(c.Config.Prompts) == 0 {
+		c.Config.Prompts = c.Prompts
+	}
+	if c.Config.GuildID == "" {
+		c.Config.GuildID = c.GroupID
+	}
+	*cfg = c.Config
+	return nil
+}
+
+// loadConfig loads the config file and parses the flags shared by the
+// generation commands, extra flags can be added using the setup function.
+func loadConfig(name string, args []string, setup func(*flag.FlagSet, *bulkai.Config)) (*bulkai.Config, error) {
+	cfg := &bulkai.Config{
+		Output:      "output",
+		Download:    true,
+		Upscale:     true,
+		Thumbnail:   true,
+		SessionFile: "session.yaml",
+		Addr:        "localhost:8080",
+	}
+
+	// Load config file, its values are used as flag defaults
+	configFile := lookupFlag(args, "config")
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read config file: %w", err)
+		}
+		if err := parseConfig(data, cfg); err != nil {
+			return nil, fmt.Errorf("couldn't parse config file %s: %w", configFile, err)
+		}
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	_ = fs.String("config", configFile, "config file in yaml format (optional)")
+	fs.StringVar(&cfg.Bot, "bot", cfg.Bot, "bot name (midjourney, bluewillow or fake)")
+	fs.StringVar(&cfg.Proxy, "proxy", cfg.Proxy, "proxy address (optional)")
+	fs.StringVar(&cfg.Output, "output", cfg.Output, "output directory")
+	fs.StringVar(&cfg.Prefix, "prefix", cfg.Prefix, "prefix to add to all prompts")
+	fs.StringVar(&cfg.Suffix, "suffix", cfg.Suffix, "suffix to add to all prompts")
+	fs.BoolVar(&cfg.Variation, "variation", cfg.Variation, "generate variations")
+	fs.BoolVar(&cfg.Upscale, "upscale", cfg.Upscale, "upscale images")
+	fs.BoolVar(&cfg.Download, "download", cfg.Download, "download images")
+	fs.BoolVar(&cfg.Thumbnail, "thumbnail", cfg.Thumbnail, "generate thumbnails")
+	fs.StringVar(&cfg.FileName, "filename", cfg.FileName, "file name template, e.g. {prompt:05}/{image:02}_{slug}_{hash8}.{ext}")
+	fs.StringVar(&cfg.Channel, "channel", cfg.Channel, "channel id (optional, bot dm if empty)")
+	fs.StringVar(&cfg.GuildID, "guild", cfg.GuildID, "guild id of the channel (optional)")
+	fs.IntVar(&cfg.Concurrency, "concurrency", cfg.Concurrency, "number of parallel prompts (optional)")
+	fs.IntVar(&cfg.MaxJobs, "max-jobs", cfg.MaxJobs, "maximum number of bot jobs of a run (optional)")
+	fs.DurationVar(&cfg.MaxDuration, "max-duration", cfg.MaxDuration, "time after which no more prompts are started (optional)")
+	fs.IntVar(&cfg.MaxJobsPerHour, "max-jobs-per-hour", cfg.MaxJobsPerHour, "maximum number of bot jobs per hour (optional)")
+	fs.IntVar(&cfg.DownloadWorkers, "download-workers", cfg.DownloadWorkers, "number of parallel downloads (optional)")
+	fs.DurationVar(&cfg.Wait, "wait", cfg.Wait, "time to wait between prompts (optional)")
+	fs.StringVar(&cfg.SessionFile, "session", cfg.SessionFile, "session file")
+	fs.StringVar(&cfg.ReplicateToken, "replicate-token", cfg.ReplicateToken, "replicate token to solve captchas (optional)")
+	fs.BoolVar(&cfg.MidjourneyCDN, "midjourney-cdn", cfg.MidjourneyCDN, "download images from midjourney cdn")
+	fs.BoolVar(&cfg.Debug, "debug", cfg.Debug, "debug mode, sets the log level to debug")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "log level: debug, info, warn or error (optional)")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "log format: text or json (optional)")
+	fs.Var(&stringsValue{values: &cfg.Webhooks}, "webhook", "webhook url to notify job events (can be repeated)")
+	fs.StringVar(&cfg.WebhookSecret, "webhook-secret", cfg.WebhookSecret, "secret to sign webhook payloads (optional)")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", cfg.MetricsAddr, "address to serve prometheus metrics on /metrics (optional)")
+	if setup != nil {
+		setup(fs, cfg)
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return nil, err
+	}
+
+	// Load session, the fake bot doesn't need it
+	if !strings.EqualFold(cfg.Bot, "fake") {
+		if cfg.SessionFile == "" {
+			return nil, errors.New("missing session file")
+		}
+		data, err := os.ReadFile(cfg.SessionFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read session file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg.Session); err != nil {
+			return nil, fmt.Errorf("couldn't parse session file %s: %w", cfg.SessionFile, err)
+		}
+	}
+
+	logger, err := bulkai.NewLogger(os.Stderr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Logger = logger
+	slog.SetDefault(logger)
+	return cfg, nil
+}
+
+func createSession(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("create-session", flag.ContinueOnError)
+	output := fs.String("output", "session.yaml", "output session file")
+	proxy := fs.String("proxy", "", "proxy address (optional)")
+	profile := fs.Bool("profile", false, "use the default chrome profile")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	return session.Run(ctx, *profile, *output, *proxy, slog.Default())
+}
+
+func albumPage(args []string) error {
+	fs := flag.NewFlagSet("album", flag.ContinueOnError)
+	output := fs.String("output", "output", "output directory")
+	name := fs.String("album", "", "album name")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("missing album name")
+	}
+	dir := filepath.Join(*output, *name)
+	a, err := album.Load(filepath.Join(dir, album.FileName))
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		return fmt.Errorf("album not found: %s", dir)
+	}
+	if err := a.WriteHTML(dir); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s %.0f%% (%d/%d prompts, %d images)\n", a.ID, a.Status, a.Percentage, len(a.Finished), len(a.Prompts), len(a.Images))
+	fmt.Println(filepath.Join(dir, album.HTMLFileName))
+	return nil
+}
+
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bulkai inspect <file>...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("missing file")
+	}
+	for i, file := range fs.Args() {
+		m, err := img.ReadMetadata(file)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(file)
+		if m == nil {
+			fmt.Println("  no metadata")
+			continue
+		}
+		for _, f := range []struct {
+			name  string
+			value string
+		}{
+			{"prompt", m.Prompt},
+			{"response prompt", m.ResponsePrompt},
+			{"bot", m.Bot},
+			{"album", m.Album},
+			{"url", m.URL},
+		} {
+			if f.value != "" {
+				fmt.Printf("  %s: %s\n", f.name, f.value)
+			}
+		}
+		if m.Seed != nil {
+			fmt.Printf("  seed: %d\n", *m.Seed)
+		}
+	}
+	return nil
+}
+
+// parseFlags parses the command line and fills the flags that weren't set
+// with environment variables (e.g. BULKAI_CONCURRENCY).
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	set := make(map[string]struct{})
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = struct{}{}
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := set[f.Name]; ok || err != nil {
+			return
+		}
+		key := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			return
+		}
+		if e := fs.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", v, key, e)
+		}
+	})
+	return err
+}
+
+// lookupFlag returns the value of a flag before the flag set is parsed.
+func lookupFlag(args []string, name string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		arg = strings.TrimLeft(arg, "-")
+		if arg == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"=")
+		}
+	}
+	return os.Getenv(envPrefix + strings.ToUpper(name))
+}
+
+// stringsValue is a repeatable flag. The first value set replaces the
+// defaults loaded from the config file.
+type stringsValue struct {
+	values *[]string
+	set    bool
+}
+
+func (s *stringsValue) String() string {
+	if s.values == nil {
+		return ""
+	}
+	return strings.Join(*s.values, ", ")
+}
+
+func (s *stringsValue) Set(v string) error {
+	if !s.set {
+		*s.values = nil
+		s.set = true
+	}
+	*s.values = append(*s.values, v)
+	return nil
+}
+
+// entriesValue is a repeatable prompt flag. Values replace the prompts loaded
+// from the config file.
+type entriesValue struct {
+	values *[]*prompt.Entry
+	set    bool
+}
+
+func (e *entriesValue) String() string {
+	if e.values == nil {
+		return ""
+	}
+	var prompts []string
+	for _, v := range *e.values {
+		prompts = append(prompts, v.Prompt)
+	}
+	return strings.Join(prompts, ", ")
+}
+
+func (e *entriesValue) Set(v string) error {
+	if !e.set {
+		*e.values = nil
+		e.set = true
+	}
+	*e.values = append(*e.values, &prompt.Entry{Prompt: v})
+	return nil
+}
+
+// mapValue is a repeatable name=value flag. Values are added to the ones
+// loaded from the config file.
+type mapValue struct {
+	values *map[string]string
+}
+
+func (m *mapValue) String() string {
+	if m.values == nil {
+		return ""
+	}
+	var pairs []string
+	for k, v := range *m.values {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+func (m *mapValue) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("invalid value %q, expected name=value", v)
+	}
+	if *m.values == nil {
+		*m.values = make(map[string]string)
+	}
+	(*m.values)[k] = val
+	return nil
+}
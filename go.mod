@@ -1,6 +1,6 @@
 module github.com/ZYKJShadow/bulkai
 
-go 1.20
+go 1.21
 
 require (
 	github.com/Danny-Dasilva/fhttp v0.0.0-20220524230104-f801520157d6
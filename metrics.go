@@ -0,0 +1,149 @@
+package bulkai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+	"github.com/ZYKJShadow/bulkai/pkg/metrics"
+)
+
+// MetricsPath is the path where the metrics are served.
+const MetricsPath = "/metrics"
+
+// generationMetrics are the metrics of the prompts processed by the client.
+type generationMetrics struct {
+	prompts       *metrics.Counter
+	images        *metrics.Counter
+	errors        *metrics.Counter
+	duration      *metrics.Histogram
+	downloadBytes *metrics.Counter
+	inflight      *metrics.Gauge
+}
+
+func newGenerationMetrics(r *metrics.Registry) *generationMetrics {
+	return &generationMetrics{
+		prompts: r.Counter("bulkai_prompts_total",
+			"Prompts processed by result (done or failed).", "result"),
+		images: r.Counter("bulkai_images_total",
+			"Images generated by kind (preview, variation or upscale).", "kind"),
+		errors: r.Counter("bulkai_errors_total",
+			"Errors of the prompt attempts, upscales and variations by class, retried ones included.", "class"),
+		duration: r.Histogram("bulkai_job_duration_seconds",
+			"Time the bot took to complete a job by kind (imagine, upscale or variation).", metrics.DurationBuckets, "job"),
+		downloadBytes: r.Counter("bulkai_download_bytes_total",
+			"Bytes of the downloaded images."),
+		inflight: r.Gauge("bulkai_inflight_prompts",
+			"Prompts being processed by the workers."),
+	}
+}
+
+// event observes the images, job durations and errors of a generation event.
+func (m *generationMetrics) event(info *ai.GenerateInfo) {
+	switch info.Type {
+	case ai.EventPromptFailed:
+		m.errors.Inc(errorClass(info.Err))
+	case ai.EventPreviewReceived:
+		m.duration.Observe(info.Duration.Seconds(), "imagine")
+	case ai.EventUpscaleFinished:
+		m.duration.Observe(info.Duration.Seconds(), "upscale")
+	case ai.EventVariationReceived:
+		m.duration.Observe(info.Duration.Seconds(), "variation")
+	}
+	if img := info.Image; img != nil {
+		switch {
+		case !img.Preview:
+			m.images.Inc("upscale")
+		case img.Variation > 0:
+			m.images.Inc("variation")
+		default:
+			m.images.Inc("preview")
+		}
+	}
+}
+
+// done observes the end of a prompt attempt, retried attempts aren't
+// counted as processed prompts. Errors of failed prompts were already
+// counted by their failure events.
+func (m *generationMetrics) done(err error, retried bool) {
+	m.inflight.Dec()
+	if err != nil && retried {
+		m.errors.Inc(errorClass(err))
+	}
+	switch {
+	case retried:
+	case err == nil:
+		m.prompts.Inc("done")
+	default:
+		m.prompts.Inc("failed")
+	}
+}
+
+// errorClass returns the class of the error used in retry overrides,
+// budget-exceeded or fatal for other fatal errors and other for the rest.
+func errorClass(err error) string {
+	classes := make([]string, 0, len(retryErrors))
+	for class := range retryErrors {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		if errors.Is(err, retryErrors[class]) {
+			return class
+		}
+	}
+	if errors.Is(err, ai.ErrBudgetExceeded) {
+		return "budget-exceeded"
+	}
+	var aiErr ai.Error
+	if errors.As(err, &aiErr) && aiErr.Fatal() {
+		return "fatal"
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	return "other"
+}
+
+// serveMetrics starts serving the metrics on the address. The returned
+// function stops the server.
+func serveMetrics(addr string, r *metrics.Registry) (func() error, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen metrics address: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, r)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = srv.Serve(l) }()
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	}, nil
+}
+
+// startMetrics serves the metrics if the config has a metrics address.
+func startMetrics(cfg *Config, r *metrics.Registry, logger *slog.Logger) (func() error, error) {
+	if cfg.MetricsAddr == "" {
+		return nil, nil
+	}
+	stop, err := serveMetrics(cfg.MetricsAddr, r)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("metrics server listening", "addr", cfg.MetricsAddr, "path", MetricsPath)
+	return stop, nil
+}
+
+// Metrics returns the registry of the client metrics, it can be used to
+// serve them in another server.
+func (a *AiDrawClient) Metrics() *metrics.Registry {
+	return a.registry
+}
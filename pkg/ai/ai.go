@@ -4,14 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"math/rand"
-	"net/url"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/filename"
+	"github.com/ZYKJShadow/bulkai/pkg/retry"
 )
 
 type Preview struct {
@@ -30,12 +30,56 @@ const (
 	Process
 	Complete
 	Fail
+	// Fatal is sent as the last event when the run was stopped by a fatal
+	// error that needs human intervention
+	Fatal
+	// Started is sent by queues that report when a prompt is taken
+	Started
+	// Stage is sent when a prompt reaches a stage that doesn't produce
+	// images, see EventType
+	Stage
 )
 
+func (s GenerateStatus) String() string {
+	switch s {
+	case NoTask:
+		return "no-task"
+	case Wait:
+		return "wait"
+	case Process:
+		return "process"
+	case Complete:
+		return "complete"
+	case Fail:
+		return "fail"
+	case Fatal:
+		return "fatal"
+	case Started:
+		return "started"
+	case Stage:
+		return "stage"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
 type GenerateInfo struct {
 	Image  *Image
 	Err    error
 	Status GenerateStatus
+	// Type is the stage of the prompt reported by the event
+	Type EventType
+	// Task is the prompt of the event, it is nil for fatal events
+	Task *Task
+	// PromptIndex is the index of the prompt, -1 for fatal events
+	PromptIndex int
+	// Attempt is the imagine attempt of the prompt, starting at 1
+	Attempt int
+	Time    time.Time
+	// Duration is how long the stage took, e.g. the upscale of the image
+	Duration time.Duration
+	// Elapsed is the time since the prompt was started
+	Elapsed time.Duration
 }
 
 type Client interface {
@@ -53,13 +97,41 @@ type Image struct {
 	Preview     bool
 	PromptIndex int
 	ImageIndex  int
-	IsLast      bool
+	// GridIndex is the index of the upscaled image in its grid, or the index
+	// of the varied image for variation previews
+	GridIndex int
+	// Variation is the variation round of the image, zero for the images
+	// of the original grid
+	Variation int
+	IsLast    bool
+
+	// ResponsePrompt is the prompt returned by the bot, along with the
+	// suffixes it appends
+	ResponsePrompt string
+	// MessageID is the message of the grid of the image
+	MessageID string
+	// ImageIDs are the ids of the grid images, set for previews
+	ImageIDs []string
+	// ImageID is the id of the upscaled image in its grid
+	ImageID string
+	// Parent is the image that was varied to get the image, nil for the
+	// images of the original grid
+	Parent    *Parent
+	CreatedAt time.Time
+}
+
+// Parent identifies an image of a grid.
+type Parent struct {
+	MessageID string `json:"message_id"`
+	ImageID   string `json:"image_id"`
+	Index     int    `json:"index"`
 }
 
 type Error struct {
 	error
 	temporary bool
 	fatal     bool
+	account   bool
 }
 
 func NewError(err error, temporary bool) Error {
@@ -76,6 +148,16 @@ func NewFatal(err error) Error {
 	}
 }
 
+// NewAccountFatal returns a fatal error of the bot account, like a banned
+// account or a failed authentication, that stops the jobs of all the albums.
+func NewAccountFatal(err error) Error {
+	return Error{
+		error:   err,
+		fatal:   true,
+		account: true,
+	}
+}
+
 func (e Error) Error() string {
 	return e.error.Error()
 }
@@ -92,12 +174,12 @@ func (e Error) Fatal() bool {
 	return e.fatal
 }
 
-type entry struct {
-	prompt string
-	index  int
+// Account reports whether the error is a fatal error of the bot account.
+func (e Error) Account() bool {
+	return e.account
 }
 
-func Bulk(ctx context.Context, cli Client, prompts []string, skip []int, variationEnabled, upscaleEnabled bool, concurrency int, out chan *GenerateInfo, wait time.Duration) {
+func Bulk(ctx context.Context, cli Client, prompts []*Prompt, skip []int, concurrency int, out chan *GenerateInfo, wait time.Duration, policy *retry.Policy, budget *Budget) {
 	skipLookup := make(map[int]struct{})
 	for _, s := range skip {
 		skipLookup[s] = struct{}{}
@@ -105,27 +187,102 @@ func Bulk(ctx context.Context, cli Client, prompts []string, skip []int, variati
 	if concurrency == 0 || concurrency > cli.Concurrency() {
 		concurrency = cli.Concurrency()
 	}
-	chunks := make([][]entry, concurrency)
+	var tasks []*Task
 	for i, p := range prompts {
 		if _, ok := skipLookup[i]; ok {
 			continue
 		}
-		chunks[i%concurrency] = append(chunks[i%concurrency], entry{
-			prompt: p,
-			index:  i,
-		})
+		t := &Task{
+			Prompt:  p.Text,
+			Index:   i,
+			Options: p.Options,
+		}
+		tasks = append(tasks, t.WithContext(ctx))
+	}
+	if concurrency > len(tasks) {
+		concurrency = len(tasks)
 	}
 
-	wg := sync.WaitGroup{}
-	for _, entries := range chunks {
-		entries := entries
-		if len(prompts) == 0 {
-			continue
+	go func() {
+		defer close(out)
+		if len(tasks) == 0 {
+			return
+		}
+		for _, t := range tasks {
+			info := &GenerateInfo{
+				Status: Wait,
+				Type:   EventPromptQueued,
+			}
+			info.stamp(t)
+			out <- info
+		}
+		emit := func(_ *Task, info *GenerateInfo) {
+			out <- info
+		}
+		q := newQueue(tasks)
+		err := Work(ctx, cli, q, concurrency, wait, policy, budget, emit)
+		if err == nil {
+			err = q.stopped()
+		}
+		if err != nil {
+			out <- &GenerateInfo{
+				Status:      Fatal,
+				Type:        EventFatal,
+				Err:         err,
+				PromptIndex: -1,
+				Time:        time.Now().UTC(),
+			}
 		}
+	}()
+}
+
+// Work processes the tasks of the queue until it is drained or the context
+// is done. The generated images and the errors of each task are sent to
+// emit before the task is marked as done.
+// A fatal error of the bot account stops all the workers and is returned,
+// other fatal errors only stop the job of the task that got them.
+// Each job has its own budget, when a cap of the budget of a job is reached
+// no more tasks of the job are started, the running ones are finished and
+// the job is stopped with an ErrBudgetExceeded fatal error. Budget can be
+// nil.
+func Work(ctx context.Context, cli Client, q Queue, concurrency int, wait time.Duration, policy *retry.Policy, budget *Budget, emit func(*Task, *GenerateInfo)) error {
+	if policy == nil {
+		policy = DefaultRetryPolicy()
+	}
+	if concurrency <= 0 || concurrency > cli.Concurrency() {
+		concurrency = cli.Concurrency()
+	}
+
+	logger := Logger(ctx, nil)
+
+	// Fatal errors of the account cancel the whole run
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var fatalErr error
+	var fatalOnce sync.Once
+	w := &worker{
+		cli:      cli,
+		queue:    q,
+		policy:   policy,
+		limiters: newLimiters(budget),
+		emit: func(t *Task, info *GenerateInfo) {
+			info.stamp(t)
+			emit(t, info)
+		},
+		fatal: func(err error) {
+			fatalOnce.Do(func() {
+				fatalErr = err
+				cancel()
+			})
+		},
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for k, e := range entries {
+			for k := 0; ; k++ {
 				currWait := wait
 				if k == 0 {
 					currWait = 1 * time.Second
@@ -139,128 +296,304 @@ func Bulk(ctx context.Context, cli Client, prompts []string, skip []int, variati
 					case <-time.After(time.Duration(float64(currWait) * (0.85 + 0.3*rand.Float64()))):
 					}
 				}
+				if ctx.Err() != nil {
+					return
+				}
 
-				// Launch preview
-				preview, err := imagine(cli, ctx, e.prompt)
-				if err != nil {
-					out <- &GenerateInfo{
-						Status: Fail,
-						Err:    err,
+				t, ok := q.Next(ctx)
+				if !ok {
+					return
+				}
+				if err := w.limiters.get(t).reserve(ctx, t); err != nil {
+					// The task isn't started, so it is processed again
+					// when the job is resumed
+					if ctx.Err() == nil {
+						w.fail(ctx, t, err)
 					}
-					break
+					q.Done(t, err)
+					continue
 				}
+				t.started = time.Now().UTC()
+				tctx, stop := taskContext(ctx, t)
+				tlog := taskLogger(logger, t)
+				tctx = WithLogger(tctx, tlog)
+				tctx = withReporter(tctx, func(typ EventType) {
+					w.stage(t, typ, 0)
+				})
 
-				if !upscaleEnabled {
-					out <- &GenerateInfo{
-						Image: &Image{
-							URL:         preview.URL,
-							Prompt:      e.prompt,
-							Preview:     true,
-							PromptIndex: e.index,
-							ImageIndex:  0,
-							IsLast:      true,
-						},
-						Status: Complete,
+				// Launch preview
+				w.stage(t, EventImagineSent, 0)
+				// The imagine job was just reserved, so it can't exceed
+				// the budget
+				_ = w.limiters.get(t).send(t)
+				start := time.Now()
+				preview, err := cli.Imagine(tctx, t.Prompt)
+				if err != nil {
+					// Temporary errors are added back to the queue so the
+					// worker can continue with other prompts meanwhile
+					if delay, ok := backoff(policy, err, t.Attempts+1); ok && tctx.Err() == nil {
+						tlog.Warn("prompt will be retried", "delay", delay, "error", err)
+						q.Retry(t, delay, err)
+					} else {
+						w.fail(tctx, t, err)
+						q.Done(t, err)
 					}
+					w.limiters.get(t).release(t)
+					stop()
+					continue
 				}
+				q.Imagined(t)
+				err = w.images(tctx, t, preview, time.Since(start))
+				w.limiters.get(t).release(t)
+				stop()
+				q.Done(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return fatalErr
+}
 
-				// Upscale or get variation for each image
-				for i := range preview.ImageIDs {
-					last := i == len(preview.ImageIDs)-1
-					if upscaleEnabled {
-						u, err := upscale(cli, ctx, preview, i)
-						if err != nil {
-							out <- &GenerateInfo{
-								Status: Fail,
-								Err:    err,
-							}
-							continue
-						}
-						isLast := last && !variationEnabled
-						status := Process
-						if isLast {
-							status = Complete
-						}
-
-						out <- &GenerateInfo{
-							Image: &Image{
-								URL:         u,
-								Prompt:      e.prompt,
-								PromptIndex: e.index,
-								ImageIndex:  i,
-								IsLast:      isLast,
-							},
-							Status: status,
-						}
-					}
+// taskContext returns a context that is done when either the task or the
+// run is stopped.
+func taskContext(ctx context.Context, t *Task) (context.Context, context.CancelFunc) {
+	tctx, cancel := context.WithCancel(t.Context())
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+	return tctx, func() {
+		close(stop)
+		cancel()
+	}
+}
 
-					if !variationEnabled {
-						continue
-					}
+type worker struct {
+	cli      Client
+	queue    Queue
+	policy   *retry.Policy
+	limiters *limiters
+	emit     func(*Task, *GenerateInfo)
+	fatal    func(error)
+}
 
-					// Get variation
-					variationPreview, err := variation(cli, ctx, preview, i)
-					if err != nil {
-						log.Println(fmt.Errorf("❌ couldn't get variation: %w", err))
-						continue
-					}
+// fail reports the error and returns true if the task must stop.
+// Fatal errors of the account stop the run, the rest of fatal errors stop
+// the job of the task.
+func (w *worker) fail(ctx context.Context, t *Task, err error) bool {
+	var aiErr Error
+	if errors.As(err, &aiErr) && aiErr.Fatal() {
+		if aiErr.Account() {
+			w.fatal(err)
+		} else {
+			w.queue.Stop(t, err)
+		}
+		return true
+	}
+	// Errors caused by the task being stopped aren't reported
+	if ctx.Err() != nil {
+		return true
+	}
+	w.emit(t, &GenerateInfo{
+		Status: Fail,
+		Type:   EventPromptFailed,
+		Err:    err,
+	})
+	return false
+}
 
-					if !upscaleEnabled {
-						status := Process
-						if last {
-							status = Complete
-						}
-
-						out <- &GenerateInfo{
-							Image: &Image{
-								URL:         variationPreview.URL,
-								Prompt:      e.prompt,
-								Preview:     true,
-								PromptIndex: e.index,
-								ImageIndex:  4 + i*4,
-								IsLast:      last,
-							},
-							Status: status,
-						}
-						continue
-					}
+// stage reports a stage of the task that doesn't produce images.
+func (w *worker) stage(t *Task, typ EventType, d time.Duration) {
+	w.emit(t, &GenerateInfo{
+		Status:   Stage,
+		Type:     typ,
+		Duration: d,
+	})
+}
 
-					// Upscale each variation image
-					for j := range variationPreview.ImageIDs {
-						var u string
-						u, err := upscale(cli, ctx, variationPreview, j)
-						if err != nil {
-							out <- &GenerateInfo{
-								Status: Fail,
-								Err:    err,
-							}
-							continue
-						}
-						last := last && j == len(variationPreview.ImageIDs)-1
-						status := Process
-						if last {
-							status = Complete
-						}
-						out <- &GenerateInfo{
-							Image: &Image{
-								URL:         u,
-								Prompt:      e.prompt,
-								PromptIndex: e.index,
-								ImageIndex:  4 + i*4 + j,
-								IsLast:      last,
-							},
-							Status: status,
-						}
-					}
+// images upscales or gets the variations of the preview images as set in
+// the options of the task, d is how long the preview took.
+// It returns the error that stopped the task, if any, or the last error of
+// the upscales if all of them failed.
+func (w *worker) images(ctx context.Context, t *Task, preview *Preview, d time.Duration) (err error) {
+	// Which image is the last one isn't known until the rest of them are
+	// done or failed, so each image is held until the next one is ready
+	var held *GenerateInfo
+	send := func(info *GenerateInfo) {
+		if held != nil {
+			w.emit(t, held)
+		}
+		held = info
+	}
+	defer func() {
+		if held == nil {
+			return
+		}
+		// Tasks that were stopped will be processed again
+		if err == nil {
+			held.Image.IsLast = true
+			held.Status = Complete
+		}
+		w.emit(t, held)
+	}()
+
+	upscales := t.Options.upscales(len(preview.ImageIDs))
+	rounds := t.Options.rounds()
+	if len(upscales) == 0 {
+		send(&GenerateInfo{
+			Image:    newImage(t, preview, preview.URL, -1),
+			Status:   Process,
+			Type:     EventPreviewReceived,
+			Duration: d,
+		})
+	} else {
+		w.stage(t, EventPreviewReceived, d)
+	}
+
+	// failed is the last error of the upscales
+	var failed error
+
+	// Upscale the selected images
+	for _, i := range upscales {
+		img, d, stop, err := w.upscale(ctx, t, preview, i)
+		if stop {
+			return err
+		}
+		if err != nil {
+			failed = err
+			continue
+		}
+		img.ImageIndex = i
+		send(upscaled(img, d))
+	}
+
+	// Get the variations of each image, every round varies the image of the
+	// grid of the previous round
+	for i := range preview.ImageIDs {
+		src := preview
+		for r := 0; r < rounds; r++ {
+			start := time.Now()
+			variationPreview, err := variation(w.cli, ctx, w.policy, w.sender(t), src, i)
+			if err != nil {
+				if w.fail(ctx, t, err) {
+					return err
 				}
+				// The next rounds need the variation that failed
+				Logger(ctx, nil).Error("couldn't get variation", "image", i, "round", r, "error", err)
+				break
 			}
-		}()
+			d := time.Since(start)
+
+			// Each variation grid takes the image indexes after the
+			// original grid
+			base := GridSize + (r*GridSize+i)*GridSize
+			parent := &Parent{MessageID: src.MessageID, ImageID: imageID(src, i), Index: i}
+			src = variationPreview
+			vUpscales := t.Options.upscales(len(variationPreview.ImageIDs))
+			if len(vUpscales) == 0 {
+				img := newImage(t, variationPreview, variationPreview.URL, -1)
+				img.ImageIndex = base
+				img.GridIndex = i
+				img.Variation = r + 1
+				img.Parent = parent
+				send(&GenerateInfo{
+					Image:    img,
+					Status:   Process,
+					Type:     EventVariationReceived,
+					Duration: d,
+				})
+				continue
+			}
+			w.stage(t, EventVariationReceived, d)
+
+			// Upscale the selected variation images
+			for _, j := range vUpscales {
+				img, d, stop, err := w.upscale(ctx, t, variationPreview, j)
+				if stop {
+					return err
+				}
+				if err != nil {
+					failed = err
+					continue
+				}
+				img.ImageIndex = base + j
+				img.Variation = r + 1
+				img.Parent = parent
+				send(upscaled(img, d))
+			}
+		}
+	}
+	// The task may have been stopped while getting variations
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	// A prompt without images isn't done
+	if held == nil {
+		return failed
+	}
+	return nil
+}
 
-	go func() {
-		wg.Wait()
-		close(out)
-	}()
+// upscale upscales an image of the preview grid and returns it along with
+// how long it took. The image is nil if the upscale failed, stop reports
+// whether the error stops the task.
+func (w *worker) upscale(ctx context.Context, t *Task, preview *Preview, index int) (*Image, time.Duration, bool, error) {
+	w.stage(t, EventUpscaleStarted, 0)
+	start := time.Now()
+	u, err := upscale(w.cli, ctx, w.policy, w.sender(t), preview, index)
+	if err != nil {
+		return nil, 0, w.fail(ctx, t, err), err
+	}
+	return newImage(t, preview, u, index), time.Since(start), false, nil
+}
+
+// sender returns the function that consumes a job of the task from the
+// budget before each attempt.
+func (w *worker) sender(t *Task) func() error {
+	return func() error { return w.limiters.get(t).send(t) }
+}
+
+// upscaled returns the event of an upscaled image.
+func upscaled(img *Image, d time.Duration) *GenerateInfo {
+	return &GenerateInfo{
+		Image:    img,
+		Status:   Process,
+		Type:     EventUpscaleFinished,
+		Duration: d,
+	}
+}
+
+// newImage returns an image of the grid of the preview, index is the
+// upscaled image or -1 for the whole grid.
+func newImage(t *Task, preview *Preview, url string, index int) *Image {
+	img := &Image{
+		URL:            url,
+		Prompt:         t.Prompt,
+		PromptIndex:    t.Index,
+		ResponsePrompt: preview.ResponsePrompt,
+		MessageID:      preview.MessageID,
+		CreatedAt:      time.Now().UTC(),
+	}
+	if index < 0 {
+		img.Preview = true
+		img.ImageIDs = preview.ImageIDs
+		return img
+	}
+	img.GridIndex = index
+	img.ImageID = imageID(preview, index)
+	return img
+}
+
+// imageID returns the id of an image of the preview grid, if known.
+func imageID(preview *Preview, index int) string {
+	if index < len(preview.ImageIDs) {
+		return preview.ImageIDs[index]
+	}
+	return ""
 }
 
 func (i *Image) FileName() string {
@@ -279,50 +612,17 @@ func (i *Image) FileNames() []string {
 	return names
 }
 
-var nonAlphanumericRegex = regexp.MustCompile(`[^\p{L}\p{N} _]+`)
-
+// fixString returns the prompt as a file name, see filename.Slug.
 func fixString(str string) string {
-	split := strings.Split(str, " ")
-	var filtered []string
-	for _, s := range split {
-		if u, err := url.Parse(s); err == nil && u.Scheme != "" {
-			continue
-		}
-		if len(s) == 0 {
-			continue
-		}
-		filtered = append(filtered, s)
-	}
-	str = strings.Join(filtered, "_")
-
-	str = nonAlphanumericRegex.ReplaceAllString(str, "")
-	str = strings.ReplaceAll(str, " ", "_")
-
-	// Limit to 50 characters to avoid issues with file names
-	if len(str) > 50 {
-		str = str[:50]
-	}
-	return str
+	return filename.Slug(str, filename.SlugLength)
 }
 
-func imagine(cli Client, ctx context.Context, prompt string) (*Preview, error) {
-	var preview *Preview
-	if err := retry(ctx, func(ctx context.Context) error {
-		p, err := cli.Imagine(ctx, prompt)
-		if err != nil {
+func upscale(cli Client, ctx context.Context, policy *retry.Policy, send func() error, preview *Preview, index int) (string, error) {
+	var upscaleURL string
+	if err := withRetry(ctx, policy, func(ctx context.Context) error {
+		if err := send(); err != nil {
 			return err
 		}
-		preview = p
-		return nil
-	}); err != nil {
-		return nil, err
-	}
-	return preview, nil
-}
-
-func upscale(cli Client, ctx context.Context, preview *Preview, index int) (string, error) {
-	var upscaleURL string
-	if err := retry(ctx, func(ctx context.Context) error {
 		u, err := cli.Upscale(ctx, preview, index)
 		if err != nil {
 			return err
@@ -335,9 +635,12 @@ func upscale(cli Client, ctx context.Context, preview *Preview, index int) (stri
 	return upscaleURL, nil
 }
 
-func variation(cli Client, ctx context.Context, preview *Preview, index int) (*Preview, error) {
+func variation(cli Client, ctx context.Context, policy *retry.Policy, send func() error, preview *Preview, index int) (*Preview, error) {
 	var variationPreview *Preview
-	if err := retry(ctx, func(ctx context.Context) error {
+	if err := withRetry(ctx, policy, func(ctx context.Context) error {
+		if err := send(); err != nil {
+			return err
+		}
 		v, err := cli.Variation(ctx, preview, index)
 		if err != nil {
 			return err
@@ -350,39 +653,59 @@ func variation(cli Client, ctx context.Context, preview *Preview, index int) (*P
 	return variationPreview, nil
 }
 
-const maxAttempts = 5
+// DefaultRetryPolicy returns the policy used to retry temporary errors:
+// up to 5 attempts waiting 10 minutes between them, timeouts are retried
+// without waiting.
+func DefaultRetryPolicy() *retry.Policy {
+	return &retry.Policy{
+		MaxAttempts: 5,
+		Base:        10 * time.Minute,
+		Cap:         10 * time.Minute,
+		Overrides: []retry.Override{
+			{Err: context.DeadlineExceeded, Policy: retry.Policy{MaxAttempts: 5}},
+		},
+	}
+}
+
+// backoff returns how long to wait before retrying after the given number of
+// failed attempts, or false if the error must not be retried.
+func backoff(policy *retry.Policy, err error, attempts int) (time.Duration, bool) {
+	var aiErr Error
+	isAIErr := errors.As(err, &aiErr)
+	// If the error is fatal, return it so the run can be stopped
+	if isAIErr && aiErr.Fatal() {
+		return 0, false
+	}
+	p, override := policy.Match(err)
+	// If the error is not temporary, return it unless there is a specific
+	// policy for it
+	if isAIErr && !aiErr.Temporary() && !override {
+		return 0, false
+	}
+	return p.Delay(attempts)
+}
 
-func retry(ctx context.Context, fn func(context.Context) error) error {
+func withRetry(ctx context.Context, policy *retry.Policy, fn func(context.Context) error) error {
 	attempts := 0
 	for {
 		err := fn(ctx)
 		if err == nil {
 			return nil
 		}
-		var aiErr Error
-		// If the error is fatal, stop everything
-		if errors.As(err, &aiErr) && aiErr.Fatal() {
-			// TODO: handle fatal errors
-			panic(err)
-		}
-		// If the error is not temporary, return it
-		if errors.As(err, &aiErr) && !aiErr.Temporary() {
-			return err
-		}
 		attempts++
-		if attempts >= maxAttempts {
+		wait, ok := backoff(policy, err, attempts)
+		if !ok {
 			return err
 		}
-		// If the error is not a context deadline exceeded, wait before retrying
-		if !errors.Is(err, context.DeadlineExceeded) {
-			log.Println("waiting and retrying...", err)
+		if wait > 0 {
+			Logger(ctx, nil).Warn("waiting before retrying", "wait", wait, "error", err)
 			select {
-			case <-time.After(10 * time.Minute):
+			case <-time.After(wait):
 			case <-ctx.Done():
 				return ctx.Err()
 			}
 		} else {
-			log.Println("retrying...", err)
+			Logger(ctx, nil).Info("retrying", "error", err)
 		}
 	}
 }
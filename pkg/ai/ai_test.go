@@ -1,6 +1,16 @@
 package ai
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/retry"
+)
 
 func TestFileName(t *testing.T) {
 	tests := []struct {
@@ -34,3 +44,375 @@ func TestFileName(t *testing.T) {
 		}
 	}
 }
+
+type testClient struct {
+	fatal string
+	// retry is a prompt that fails with a temporary error the first time
+	retry string
+	// fail is a prompt that fails with a permanent error
+	fail string
+	// queued is a prompt reported as queued by the bot
+	queued string
+	// failUpscale is a prompt whose last grid image fails to upscale
+	failUpscale string
+	// retryUpscale is a prompt whose first upscale fails with a temporary
+	// error
+	retryUpscale string
+	lck          sync.Mutex
+}
+
+func (c *testClient) Start(ctx context.Context) error { return nil }
+
+func (c *testClient) Imagine(ctx context.Context, prompt string) (*Preview, error) {
+	if prompt == c.fatal {
+		return nil, NewFatal(errors.New("fatal"))
+	}
+	if prompt == c.fail {
+		return nil, NewError(errors.New("failed"), false)
+	}
+	if prompt == c.queued {
+		Report(ctx, EventJobQueued)
+	}
+	c.lck.Lock()
+	retry := prompt == c.retry
+	c.retry = ""
+	c.lck.Unlock()
+	if retry {
+		return nil, context.DeadlineExceeded
+	}
+	return &Preview{
+		URL:       "https://foo.bar/" + prompt + ".png",
+		Prompt:    prompt,
+		MessageID: prompt,
+		ImageIDs:  []string{"1", "2", "3", "4"},
+	}, nil
+}
+
+func (c *testClient) Upscale(ctx context.Context, preview *Preview, index int) ([]string, error) {
+	if preview.Prompt == c.failUpscale && index == GridSize-1 {
+		return nil, NewError(errors.New("failed"), false)
+	}
+	c.lck.Lock()
+	retry := preview.Prompt == c.retryUpscale
+	c.retryUpscale = ""
+	c.lck.Unlock()
+	if retry {
+		return nil, NewError(errors.New("temporary"), true)
+	}
+	return []string{preview.URL}, nil
+}
+
+func (c *testClient) Variation(ctx context.Context, preview *Preview, index int) (*Preview, error) {
+	v := *preview
+	v.MessageID = fmt.Sprintf("%s/%d", preview.MessageID, index)
+	return &v, nil
+}
+
+func (c *testClient) Concurrency() int { return 1 }
+
+func TestBulkFatal(t *testing.T) {
+	out := make(chan *GenerateInfo)
+	Bulk(context.Background(), &testClient{fatal: "b"}, NewPrompts([]string{"a", "b", "c"}, Options{}), nil, 1, out, 0, nil, nil)
+
+	var got []*GenerateInfo
+	for info := range out {
+		if info.Status == Wait || info.Status == Stage {
+			continue
+		}
+		got = append(got, info)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d events, want 2", len(got))
+	}
+	if got[0].Status != Complete || got[0].Image.Prompt != "a" {
+		t.Errorf("got %+v, want complete image for prompt a", got[0])
+	}
+	if got[1].Status != Fatal || got[1].Err == nil {
+		t.Errorf("got %+v, want fatal status", got[1])
+	}
+}
+
+func TestBulkRetry(t *testing.T) {
+	out := make(chan *GenerateInfo)
+	Bulk(context.Background(), &testClient{retry: "a"}, NewPrompts([]string{"a", "b", "c"}, Options{}), []int{2}, 1, out, 0, nil, nil)
+
+	var got []string
+	for info := range out {
+		if info.Status == Wait || info.Status == Stage {
+			continue
+		}
+		if info.Status != Complete {
+			t.Fatalf("got status %v, want complete", info.Status)
+		}
+		got = append(got, info.Image.Prompt)
+	}
+	// The failed prompt goes back to the queue without blocking the rest
+	want := []string{"b", "a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBulkOptions(t *testing.T) {
+	prompts := []*Prompt{
+		{Text: "a", Options: Options{Upscale: []int{3, 1}}},
+		{Text: "b", Options: Options{Variation: true, Rounds: 2}},
+		{Text: "c", Options: Options{Upscale: []int{0}, Variation: true}},
+	}
+	out := make(chan *GenerateInfo)
+	Bulk(context.Background(), &testClient{}, prompts, nil, 1, out, 0, nil, nil)
+
+	got := map[string][]int{}
+	last := map[string]int{}
+	units := map[string]int{}
+	for info := range out {
+		if info.Status == Wait || info.Status == Stage {
+			continue
+		}
+		if info.Image == nil {
+			t.Fatalf("unexpected event %+v", info)
+		}
+		p := info.Image.Prompt
+		got[p] = append(got[p], info.Image.ImageIndex)
+		units[p]++
+		if info.Image.Preview {
+			units[p] += GridSize - 1
+		}
+		if info.Image.IsLast {
+			last[p]++
+			if info.Status != Complete {
+				t.Errorf("got status %v for the last image of %s", info.Status, p)
+			}
+		}
+	}
+	want := map[string][]int{
+		"a": {1, 3},
+		"b": {0, 4, 20, 8, 24, 12, 28, 16, 32},
+		"c": {0, 4, 8, 12, 16},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for p := range want {
+		if last[p] != 1 {
+			t.Errorf("got %d last images for %s, want 1", last[p], p)
+		}
+	}
+	for _, p := range prompts {
+		if p.Images() != units[p.Text] {
+			t.Errorf("got %d expected images for %s, want %d", p.Images(), p.Text, units[p.Text])
+		}
+	}
+}
+
+func TestBulkLast(t *testing.T) {
+	prompts := []*Prompt{
+		{Text: "a", Options: Options{Upscale: []int{0, 3}}},
+		{Text: "b", Options: Options{Variation: true, Rounds: 2}},
+	}
+	out := make(chan *GenerateInfo)
+	Bulk(context.Background(), &testClient{failUpscale: "a"}, prompts, nil, 1, out, 0, nil, nil)
+
+	last := map[string]int{}
+	parents := map[int]string{}
+	for info := range out {
+		img := info.Image
+		if img == nil {
+			continue
+		}
+		if img.IsLast {
+			last[img.Prompt] = img.ImageIndex
+			if info.Status != Complete {
+				t.Errorf("got status %v for the last image of %s", info.Status, img.Prompt)
+			}
+		}
+		if img.Prompt == "b" && img.Parent != nil {
+			parents[img.ImageIndex] = img.Parent.MessageID
+		}
+	}
+	// The last upscale of a fails, so the previous image is the last one
+	if want := map[string]int{"a": 0, "b": 32}; !reflect.DeepEqual(last, want) {
+		t.Errorf("got last images %v, want %v", last, want)
+	}
+	// Second round variations are made from the first round ones
+	if got, want := parents[4], "b"; got != want {
+		t.Errorf("got parent %s, want %s", got, want)
+	}
+	if got, want := parents[20], "b/0"; got != want {
+		t.Errorf("got parent %s, want %s", got, want)
+	}
+}
+
+func TestBulkEvents(t *testing.T) {
+	out := make(chan *GenerateInfo)
+	Bulk(context.Background(), &testClient{queued: "a", fail: "b"}, NewPrompts([]string{"a", "b"}, Options{Upscale: []int{1}}), nil, 1, out, 0, nil, nil)
+
+	type event struct {
+		typ    EventType
+		prompt int
+	}
+	var got []event
+	for info := range out {
+		got = append(got, event{info.Type, info.PromptIndex})
+		if info.Attempt != 1 || info.Time.IsZero() {
+			t.Errorf("got attempt %d at %v, want first attempt with time", info.Attempt, info.Time)
+		}
+		switch info.Type {
+		case EventUpscaleFinished:
+			if info.Image == nil || info.Status != Complete {
+				t.Errorf("got %+v, want complete image", info)
+			}
+		case EventPromptFailed:
+			if info.Err == nil || info.Status != Fail {
+				t.Errorf("got %+v, want failure", info)
+			}
+		default:
+			if info.Image != nil {
+				t.Errorf("got image for %s event", info.Type)
+			}
+		}
+	}
+	want := []event{
+		{EventPromptQueued, 0},
+		{EventPromptQueued, 1},
+		{EventImagineSent, 0},
+		{EventJobQueued, 0},
+		{EventPreviewReceived, 0},
+		{EventUpscaleStarted, 0},
+		{EventUpscaleFinished, 0},
+		{EventImagineSent, 1},
+		{EventPromptFailed, 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	prompts := []*Prompt{
+		{Text: "a", Options: Options{}},
+		{Text: "b", Options: Options{Upscale: []int{0, 1}}},
+		{Text: "c", Options: Options{Upscale: []int{0, 1}}},
+	}
+	p := NewProgress(prompts, []int{0})
+	if p.Total() != 8 || p.Done() != 4 || p.Percentage() != 50 {
+		t.Fatalf("got %d/%d, want 4/8", p.Done(), p.Total())
+	}
+	if !p.ETA().IsZero() {
+		t.Errorf("got eta %v, want unknown", p.ETA())
+	}
+
+	// Stage events aren't counted
+	start := p.samples[0].at
+	p.Add(&GenerateInfo{Status: Stage, Type: EventUpscaleStarted, Time: start.Add(time.Minute)})
+	if p.Done() != 4 {
+		t.Errorf("got %d done, want 4", p.Done())
+	}
+
+	// One image every minute leaves three minutes for the other three
+	p.Add(&GenerateInfo{Image: &Image{}, Time: start.Add(time.Minute)})
+	if got, want := p.ETA(), start.Add(4*time.Minute); !got.Equal(want) {
+		t.Errorf("got eta %v, want %v", got, want)
+	}
+	if p.Percentage() != 62.5 {
+		t.Errorf("got %v%%, want 62.5%%", p.Percentage())
+	}
+	for i := 2; i <= 4; i++ {
+		p.Add(&GenerateInfo{Image: &Image{}, Time: start.Add(time.Duration(i) * time.Minute)})
+	}
+	if got, want := p.ETA(), start.Add(4*time.Minute); p.Percentage() != 100 || !got.Equal(want) {
+		t.Errorf("got %v%% with eta %v, want 100%% at %v", p.Percentage(), got, want)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	prompts := []*Prompt{
+		{Text: "a", Options: Options{}},
+		{Text: "b", Options: DefaultOptions(false, true)},
+		{Text: "c", Options: DefaultOptions(true, true)},
+		{Text: "d", Options: Options{Upscale: []int{0}, Variation: true, Rounds: 2}},
+	}
+	for i, want := range []Jobs{
+		{Imagine: 1},
+		{Imagine: 1, Upscale: 4},
+		{Imagine: 1, Upscale: 4 + 16, Variation: 4},
+		{Imagine: 1, Upscale: 1 + 8, Variation: 8},
+	} {
+		if got := prompts[i].Jobs(); got != want {
+			t.Errorf("%s: got %+v, want %+v", prompts[i].Text, got, want)
+		}
+	}
+	got := Estimate(prompts, []int{2})
+	if want := (Jobs{Imagine: 3, Upscale: 13, Variation: 8}); got != want || got.Total() != 24 {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestBulkBudget(t *testing.T) {
+	out := make(chan *GenerateInfo)
+	// Each prompt needs an imagine and an upscale job
+	prompts := NewPrompts([]string{"a", "b", "c"}, Options{Upscale: []int{0}})
+	Bulk(context.Background(), &testClient{}, prompts, nil, 1, out, 0, nil, &Budget{MaxJobs: 5})
+
+	var done []string
+	var err error
+	for info := range out {
+		switch {
+		case info.Status == Fatal:
+			err = info.Err
+		case info.Image != nil:
+			done = append(done, info.Image.Prompt)
+		}
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(done, want) {
+		t.Errorf("got %v, want %v", done, want)
+	}
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("got error %v, want budget exceeded", err)
+	}
+}
+
+func TestBulkBudgetRetries(t *testing.T) {
+	// The retried upscale needs a third job
+	for _, limit := range []int{2, 3} {
+		out := make(chan *GenerateInfo)
+		prompts := NewPrompts([]string{"a"}, Options{Upscale: []int{0}})
+		policy := &retry.Policy{MaxAttempts: 2}
+		Bulk(context.Background(), &testClient{retryUpscale: "a"}, prompts, nil, 1, out, 0, policy, &Budget{MaxJobs: limit})
+
+		var images int
+		var err error
+		for info := range out {
+			switch {
+			case info.Status == Fatal:
+				err = info.Err
+			case info.Image != nil:
+				images++
+			}
+		}
+		if limit == 2 && (images != 0 || !errors.Is(err, ErrBudgetExceeded)) {
+			t.Errorf("max %d: got %d images and error %v, want budget exceeded", limit, images, err)
+		}
+		if limit == 3 && (images != 1 || err != nil) {
+			t.Errorf("max %d: got %d images and error %v, want 1 image", limit, images, err)
+		}
+	}
+}
+
+func TestLimiterHourly(t *testing.T) {
+	l := newLimiter(&Budget{MaxJobsPerHour: 4})
+	now := time.Now()
+	l.history = []time.Time{now.Add(-90 * time.Minute), now.Add(-30 * time.Minute), now.Add(-10 * time.Minute)}
+	// The first job is older than an hour
+	if wait := l.hourlyWait(now, 0, 2); wait != 0 {
+		t.Errorf("got wait %s, want 0", wait)
+	}
+	if wait := l.hourlyWait(now, 1, 2); wait != 30*time.Minute {
+		t.Errorf("got wait %s, want 30m", wait)
+	}
+	// Prompts with more jobs than the cap are started alone
+	l.history = nil
+	if wait := l.hourlyWait(now, 0, 10); wait != 0 {
+		t.Errorf("got wait %s, want 0", wait)
+	}
+}
@@ -6,7 +6,8 @@ import (
 	"fmt"
 	"github.com/ZYKJShadow/bulkai/pkg/ai"
 	"github.com/ZYKJShadow/bulkai/pkg/discord"
-	"log"
+	"github.com/ZYKJShadow/bulkai/pkg/logging"
+	"log/slog"
 	"math/rand"
 	"regexp"
 	"strings"
@@ -27,7 +28,7 @@ const (
 
 type Client struct {
 	c         *discord.Client
-	debug     bool
+	log       *slog.Logger
 	node      *snowflake.Node
 	callback  map[search][]func(*discord.Message) bool
 	cache     map[string]struct{}
@@ -39,9 +40,11 @@ type Client struct {
 }
 
 type Config struct {
-	Debug     bool
 	ChannelID string
 	Timeout   time.Duration
+	// Logger is the logger of the client, the messages of the bot are logged
+	// at debug level, slog.Default() if nil
+	Logger *slog.Logger
 }
 
 func New(client *discord.Client, cfg *Config) (ai.Client, error) {
@@ -75,7 +78,7 @@ func New(client *discord.Client, cfg *Config) (ai.Client, error) {
 	}
 	c := &Client{
 		c:         client,
-		debug:     cfg.Debug,
+		log:       logging.OrDefault(cfg.Logger),
 		node:      node,
 		callback:  make(map[search][]func(*discord.Message) bool),
 		cache:     make(map[string]struct{}),
@@ -89,13 +92,13 @@ func New(client *discord.Client, cfg *Config) (ai.Client, error) {
 		case discord.MessageCreateEvent, discord.MessageUpdateEvent:
 			var msg discord.Message
 			if err := json.Unmarshal(e.RawData, &msg); err != nil {
-				log.Println("bluewillow: couldn't unmarshal message: %w", err)
+				c.log.Error("bluewillow: couldn't unmarshal message", "error", err)
 			}
 			// Ignore messages from other channels
 			if msg.ChannelID != c.channelID {
 				return
 			}
-			c.debugLog(e.Type, e.RawData)
+			c.debugLog(context.Background(), e.Type, e.RawData, "nonce", msg.Nonce)
 
 			var key search
 			var cacheID string
@@ -196,16 +199,17 @@ func (c *Client) Concurrency() int {
 	return 5
 }
 
-func (c *Client) debugLog(t string, v interface{}) {
-	if !c.debug {
+func (c *Client) debugLog(ctx context.Context, t string, v interface{}, args ...any) {
+	log := ai.Logger(ctx, c.log)
+	if !log.Enabled(ctx, slog.LevelDebug) {
 		return
 	}
 	if v == nil {
-		log.Println(t)
+		log.Debug("bluewillow: "+t, args...)
 		return
 	}
 	js, _ := json.Marshal(v)
-	log.Println(t, string(js))
+	log.Debug("bluewillow: "+t, append(args, "data", string(js))...)
 }
 
 func parseContent(content string) (string, string, bool) {
@@ -368,7 +372,7 @@ func (c *Client) Imagine(ctx context.Context, prompt string) (*ai.Preview, error
 		},
 		Nonce: nonce,
 	}
-	c.debugLog("IMAGINE", imagine)
+	c.debugLog(ctx, "IMAGINE", imagine, "nonce", nonce)
 
 	// Bluewillow doesn't send the prompt in a returning message
 	// so we have to remove the links from the prompt
@@ -433,7 +437,7 @@ func (c *Client) Upscale(ctx context.Context, preview *ai.Preview, index int) ([
 		Nonce:     nonce,
 		MessageID: preview.MessageID,
 	}
-	c.debugLog("UPSCALE", upscale)
+	c.debugLog(ctx, "UPSCALE", upscale, "nonce", nonce)
 
 	msg, err := c.receiveMessage(ctx, upscaleSearch(preview.ResponsePrompt), c.timeout, func() error {
 		// Launch interaction inside the receive message process because the
@@ -469,7 +473,7 @@ func (c *Client) Variation(ctx context.Context, preview *ai.Preview, index int)
 		Nonce:     nonce,
 		MessageID: preview.MessageID,
 	}
-	c.debugLog("VARIATION", variation)
+	c.debugLog(ctx, "VARIATION", variation, "nonce", nonce)
 
 	msg, err := c.receiveMessage(ctx, variationSearch(preview.ResponsePrompt), c.timeout, func() error {
 		// Launch interaction inside the receive message process because the
@@ -0,0 +1,216 @@
+package bluewillow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+	"github.com/ZYKJShadow/bulkai/pkg/discord"
+	"github.com/ZYKJShadow/bulkai/pkg/discord/discordtest"
+	"github.com/bwmarrin/discordgo"
+)
+
+// testBot scripts the responses of the bluewillow bot using a local discord
+// server.
+type testBot struct {
+	t *testing.T
+	s *discordtest.Server
+	c *Client
+}
+
+// send sends a message create event to the client channel.
+func (b *testBot) send(msg *discord.Message) {
+	msg.ChannelID = b.c.channelID
+	if err := b.s.Create(msg); err != nil {
+		b.t.Error(err)
+	}
+}
+
+func (b *testBot) preview(content, id string) *discord.Message {
+	row := &discord.Component{Type: 1}
+	for i := 1; i <= 4; i++ {
+		row.Components = append(row.Components, &discord.Component{
+			Type: 2, Style: 2, Label: fmt.Sprintf("U%d", i), CustomID: fmt.Sprintf("%s%s_%d", upscaleID, id, i),
+		})
+	}
+	return &discord.Message{
+		Content:     content,
+		Attachments: []*discordgo.MessageAttachment{b.s.Attachment(id + ".png")},
+		Components:  []*discord.Component{row},
+	}
+}
+
+func newTestClient(t *testing.T, cfg *Config, handler func(b *testBot, i *discordtest.Interaction) error) *Client {
+	t.Helper()
+	ctx := context.Background()
+	b := &testBot{t: t}
+	b.s = discordtest.NewServer(&discordtest.Config{
+		Bots: []string{botID},
+		Handler: func(s *discordtest.Server, i *discordtest.Interaction) error {
+			return handler(b, i)
+		},
+	})
+	t.Cleanup(b.s.Close)
+
+	d, err := discord.New(b.s.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = d.Stop() })
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	cli, err := New(d, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.c = cli.(*Client)
+	if err := b.c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return b.c
+}
+
+func TestImagine(t *testing.T) {
+	tests := []struct {
+		name    string
+		prompt  string
+		timeout time.Duration
+		bot     func(b *testBot, i *discordtest.Interaction) error
+		want    string
+		wantErr error
+	}{
+		{
+			name:   "preview",
+			prompt: "a cat",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				b.send(b.preview(fmt.Sprintf("**%s** - <@%s>", i.Options["prompt"], discordtest.UserID), "cat"))
+				return nil
+			},
+			want: "a cat",
+		},
+		{
+			name:   "webp progress",
+			prompt: "a dog",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				content := fmt.Sprintf("**%s** - <@%s>", i.Options["prompt"], discordtest.UserID)
+				progress := b.preview(content, "dog_progress")
+				progress.Attachments[0].ContentType = "image/webp"
+				b.send(progress)
+				b.send(b.preview(content, "dog"))
+				return nil
+			},
+			want: "a dog",
+		},
+		{
+			name:   "links",
+			prompt: "https://example.com/bird.png a bird",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				b.send(b.preview(fmt.Sprintf("**<https://example.com/bird.png> a bird** - <@%s>", discordtest.UserID), "bird"))
+				return nil
+			},
+			want: "<LINK> a bird",
+		},
+		{
+			name:    "timeout",
+			prompt:  "a goat",
+			timeout: 100 * time.Millisecond,
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				// Previews without components aren't finished
+				msg := b.preview(fmt.Sprintf("**%s** - <@%s>", i.Options["prompt"], discordtest.UserID), "goat")
+				msg.Components = nil
+				b.send(msg)
+				return nil
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c := newTestClient(t, &Config{Timeout: tt.timeout}, func(b *testBot, i *discordtest.Interaction) error {
+				if i.Name != "imagine" || i.ChannelID != b.c.channelID {
+					return fmt.Errorf("unexpected interaction %+v", i)
+				}
+				return tt.bot(b, i)
+			})
+			preview, err := c.Imagine(context.Background(), tt.prompt)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if preview.ResponsePrompt != tt.want {
+				t.Errorf("expected response prompt %q, got %q", tt.want, preview.ResponsePrompt)
+			}
+			if len(preview.ImageIDs) != 4 || preview.URL == "" {
+				t.Errorf("unexpected preview %+v", preview)
+			}
+		})
+	}
+}
+
+func TestUpscale(t *testing.T) {
+	c := newTestClient(t, &Config{}, func(b *testBot, i *discordtest.Interaction) error {
+		if i.CustomID != upscaleID+"cat_2" || i.MessageID != "42" {
+			return fmt.Errorf("unexpected interaction %+v", i)
+		}
+		// The preview message is sent again and must be ignored
+		b.send(b.preview(fmt.Sprintf("**a cat** - <@%s>", discordtest.UserID), "cat"))
+		b.send(&discord.Message{
+			Content:     fmt.Sprintf("**a cat** - Upscaling by <@%s>", discordtest.UserID),
+			Attachments: []*discordgo.MessageAttachment{b.s.Attachment("cat_upscaled.png")},
+		})
+		return nil
+	})
+	preview := &ai.Preview{
+		Prompt:         "a cat",
+		ResponsePrompt: "a cat",
+		MessageID:      "42",
+		ImageIDs:       []string{"cat_1", "cat_2", "cat_3", "cat_4"},
+	}
+	urls, err := c.Upscale(context.Background(), preview, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 || !strings.HasSuffix(urls[0], "/attachments/cat_upscaled.png") {
+		t.Errorf("unexpected urls %v", urls)
+	}
+}
+
+func TestVariation(t *testing.T) {
+	c := newTestClient(t, &Config{}, func(b *testBot, i *discordtest.Interaction) error {
+		if i.CustomID != variationID+"cat_3" {
+			return fmt.Errorf("unexpected interaction %+v", i)
+		}
+		b.send(b.preview(fmt.Sprintf("**a cat** - Variations by <@%s>", discordtest.UserID), "kitten"))
+		return nil
+	})
+	preview := &ai.Preview{
+		Prompt:         "a cat",
+		ResponsePrompt: "a cat",
+		MessageID:      "42",
+		ImageIDs:       []string{"cat_1", "cat_2", "cat_3", "cat_4"},
+	}
+	got, err := c.Variation(context.Background(), preview, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "kitten_1,kitten_2,kitten_3,kitten_4"
+	if strings.Join(got.ImageIDs, ",") != want {
+		t.Errorf("expected image ids %s, got %v", want, got.ImageIDs)
+	}
+}
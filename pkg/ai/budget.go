@@ -0,0 +1,262 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrBudgetExceeded is the cause of the fatal error that stops a job when a
+// cap of its budget is reached.
+var ErrBudgetExceeded = errors.New("ai: budget exceeded")
+
+// Jobs are the number of jobs sent to the bot by kind.
+type Jobs struct {
+	Imagine   int `json:"imagine"`
+	Upscale   int `json:"upscale"`
+	Variation int `json:"variation"`
+}
+
+// Total returns the number of jobs of all kinds.
+func (j Jobs) Total() int {
+	return j.Imagine + j.Upscale + j.Variation
+}
+
+// Jobs returns the jobs sent to the bot to generate a prompt when nothing
+// fails. Retries aren't included.
+func (o Options) Jobs() Jobs {
+	upscales := len(o.upscales(GridSize))
+	variations := GridSize * o.rounds()
+	return Jobs{
+		Imagine:   1,
+		Upscale:   upscales + variations*upscales,
+		Variation: variations,
+	}
+}
+
+// Estimate returns the jobs needed to generate the prompts whose indexes
+// aren't skipped.
+func Estimate(prompts []*Prompt, skip []int) Jobs {
+	lookup := make(map[int]bool)
+	for _, i := range skip {
+		lookup[i] = true
+	}
+	var total Jobs
+	for i, p := range prompts {
+		if lookup[i] {
+			continue
+		}
+		j := p.Jobs()
+		total.Imagine += j.Imagine
+		total.Upscale += j.Upscale
+		total.Variation += j.Variation
+	}
+	return total
+}
+
+// Budget caps the jobs sent to the bot by each job, zero values don't set a
+// cap. Every job sent counts, retries included. The job stops before
+// starting a prompt whose jobs would exceed the max jobs, and a retry that
+// would exceed them stops it too. Started prompts are finished after the
+// max duration, so it may be exceeded by the time they take.
+type Budget struct {
+	// MaxJobs is the maximum number of jobs of the job
+	MaxJobs int
+	// MaxDuration is the time, since the first prompt of the job was
+	// started, after which no more prompts are started
+	MaxDuration time.Duration
+	// MaxJobsPerHour delays the prompts while their jobs would exceed the
+	// jobs sent in the last hour
+	MaxJobsPerHour int
+}
+
+// limiters keeps the limiter of each job, so every job has its own budget
+// started when its first prompt is reserved.
+type limiters struct {
+	budget *Budget
+
+	lck  sync.Mutex
+	jobs map[string]*limiter
+}
+
+// newLimiters returns the limiters of the budget, nil if there are no caps.
+func newLimiters(b *Budget) *limiters {
+	if b == nil || *b == (Budget{}) {
+		return nil
+	}
+	return &limiters{
+		budget: b,
+		jobs:   make(map[string]*limiter),
+	}
+}
+
+// get returns the limiter of the job of the task. A job run again with a new
+// context gets a new budget.
+func (ls *limiters) get(t *Task) *limiter {
+	if ls == nil {
+		return nil
+	}
+	ls.lck.Lock()
+	defer ls.lck.Unlock()
+	ctx := t.Context()
+	l, ok := ls.jobs[t.Job]
+	if !ok || l.ctx != ctx {
+		l = newLimiter(ls.budget)
+		l.ctx = ctx
+		ls.jobs[t.Job] = l
+	}
+	// Limiters of the jobs that ended aren't kept
+	for job, jl := range ls.jobs {
+		if jl.ctx.Err() != nil {
+			delete(ls.jobs, job)
+		}
+	}
+	return l
+}
+
+// limiter enforces the budget of a job. The jobs of a prompt are reserved
+// when it starts and consumed as they are sent, jobs sent beyond them (e.g.
+// retries) are checked against the max jobs when they are sent.
+type limiter struct {
+	budget Budget
+	start  time.Time
+	// ctx is the context of the tasks of the job
+	ctx context.Context
+
+	lck  sync.Mutex
+	sent int
+	// history are the times of the jobs sent in the last hour
+	history []time.Time
+	// reserved are the jobs of the running prompts that haven't been sent
+	reserved map[*Task]int
+	changed  chan struct{}
+	err      error
+}
+
+// newLimiter returns the limiter of the budget, nil if there are no caps.
+func newLimiter(b *Budget) *limiter {
+	if b == nil || *b == (Budget{}) {
+		return nil
+	}
+	return &limiter{
+		budget:   *b,
+		start:    time.Now(),
+		ctx:      context.Background(),
+		reserved: make(map[*Task]int),
+		changed:  make(chan struct{}),
+	}
+}
+
+// reserve reserves the jobs of the task before it starts. It waits while
+// the hourly cap is reached and returns an error if the job must stop.
+func (l *limiter) reserve(ctx context.Context, t *Task) error {
+	if l == nil {
+		return nil
+	}
+	jobs := t.Options.Jobs().Total()
+	for {
+		l.lck.Lock()
+		if l.err != nil {
+			l.lck.Unlock()
+			return l.err
+		}
+		now := time.Now()
+		pending := l.pending()
+		switch {
+		case l.budget.MaxDuration > 0 && now.Sub(l.start) >= l.budget.MaxDuration:
+			l.err = NewFatal(fmt.Errorf("%w: max duration of %s reached", ErrBudgetExceeded, l.budget.MaxDuration))
+		case l.budget.MaxJobs > 0 && l.sent+pending+jobs > l.budget.MaxJobs:
+			l.err = NewFatal(fmt.Errorf("%w: %d jobs of a max of %d used, prompt %d needs %d more",
+				ErrBudgetExceeded, l.sent+pending, l.budget.MaxJobs, t.Index, jobs))
+		}
+		if l.err != nil {
+			l.lck.Unlock()
+			return l.err
+		}
+		wait := l.hourlyWait(now, pending, jobs)
+		if wait == 0 {
+			l.reserved[t] += jobs
+			l.lck.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.lck.Unlock()
+
+		Logger(ctx, nil).Info("waiting for the hourly job budget", "prompt", t.Index, "wait", wait.Round(time.Second))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// hourlyWait returns how long to wait until the jobs fit in the hourly cap,
+// it must be called with the lock held.
+func (l *limiter) hourlyWait(now time.Time, pending, jobs int) time.Duration {
+	if l.budget.MaxJobsPerHour <= 0 {
+		return 0
+	}
+	for len(l.history) > 0 && now.Sub(l.history[0]) >= time.Hour {
+		l.history = l.history[1:]
+	}
+	used := len(l.history) + pending
+	// Prompts with more jobs than the cap are started alone
+	if used == 0 || used+jobs <= l.budget.MaxJobsPerHour {
+		return 0
+	}
+	if len(l.history) == 0 {
+		// Only running prompts use the budget, wait until they send jobs
+		return time.Minute
+	}
+	return l.history[0].Add(time.Hour).Sub(now)
+}
+
+// pending returns the reserved jobs, it must be called with the lock held.
+func (l *limiter) pending() int {
+	var n int
+	for _, r := range l.reserved {
+		n += r
+	}
+	return n
+}
+
+// send consumes a job of the task. It returns an error if the job wasn't
+// reserved and would exceed the max jobs.
+func (l *limiter) send(t *Task) error {
+	if l == nil {
+		return nil
+	}
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	if l.reserved[t] > 0 {
+		l.reserved[t]--
+	} else if l.budget.MaxJobs > 0 && l.sent+l.pending() >= l.budget.MaxJobs {
+		if l.err == nil {
+			l.err = NewFatal(fmt.Errorf("%w: max of %d jobs used, prompt %d needs more to retry",
+				ErrBudgetExceeded, l.budget.MaxJobs, t.Index))
+		}
+		return l.err
+	}
+	l.sent++
+	l.history = append(l.history, time.Now())
+	return nil
+}
+
+// release frees the jobs of the task that weren't sent.
+func (l *limiter) release(t *Task) {
+	if l == nil {
+		return
+	}
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	delete(l.reserved, t)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
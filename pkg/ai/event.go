@@ -0,0 +1,69 @@
+package ai
+
+import (
+	"context"
+	"time"
+)
+
+// EventType is the stage of the generation of a prompt reported by an event.
+type EventType string
+
+const (
+	// EventPromptQueued is sent when the prompt is waiting for a worker
+	EventPromptQueued EventType = "prompt.queued"
+	// EventPromptStarted is sent when a worker takes the prompt
+	EventPromptStarted EventType = "prompt.started"
+	// EventImagineSent is sent before each imagine attempt
+	EventImagineSent EventType = "imagine.sent"
+	// EventJobQueued is reported by clients when the bot queues the job
+	// instead of starting it
+	EventJobQueued EventType = "job.queued"
+	// EventPreviewReceived is sent when the grid is ready, it has the grid
+	// image if it isn't upscaled
+	EventPreviewReceived EventType = "preview.received"
+	// EventUpscaleStarted is sent before upscaling an image of a grid
+	EventUpscaleStarted EventType = "upscale.started"
+	// EventUpscaleFinished has the upscaled image
+	EventUpscaleFinished EventType = "upscale.finished"
+	// EventVariationReceived is sent when a variation grid is ready, it has
+	// the grid image if it isn't upscaled
+	EventVariationReceived EventType = "variation.received"
+	// EventDownloadDone is sent when the files of an image are saved
+	EventDownloadDone EventType = "download.done"
+	// EventDownloadFailed has the error of the files of an image that
+	// couldn't be saved
+	EventDownloadFailed EventType = "download.failed"
+	// EventPromptFailed has the error of the prompt
+	EventPromptFailed EventType = "prompt.failed"
+	// EventFatal has the error that stopped all the prompts
+	EventFatal EventType = "fatal"
+)
+
+// stamp sets the prompt info of an event of the task.
+func (info *GenerateInfo) stamp(t *Task) {
+	info.Task = t
+	info.PromptIndex = t.Index
+	info.Attempt = t.Attempts + 1
+	if info.Time.IsZero() {
+		info.Time = time.Now().UTC()
+	}
+	if !t.started.IsZero() {
+		info.Elapsed = info.Time.Sub(t.started)
+	}
+}
+
+type reporterKey struct{}
+
+// withReporter returns a context whose Report calls are sent to fn.
+func withReporter(ctx context.Context, fn func(EventType)) context.Context {
+	return context.WithValue(ctx, reporterKey{}, fn)
+}
+
+// Report sends an event of the prompt being processed with the context.
+// Clients use it for the stages that happen inside their calls, like a job
+// queued by the bot.
+func Report(ctx context.Context, typ EventType) {
+	if fn, ok := ctx.Value(reporterKey{}).(func(EventType)); ok {
+		fn(typ)
+	}
+}
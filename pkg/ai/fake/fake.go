@@ -0,0 +1,288 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+)
+
+// Kinds of scripted errors
+const (
+	Temporary = "temporary"
+	Permanent = "permanent"
+	Fatal     = "fatal"
+	// Account is a fatal error of the bot account
+	Account = "account"
+)
+
+// Actions where scripted errors can be injected
+const (
+	Imagine   = "imagine"
+	Upscale   = "upscale"
+	Variation = "variation"
+)
+
+// Client is an in-memory ai.Client that generates deterministic images served
+// from a local http server. It is meant for offline development and tests.
+type Client struct {
+	server      *httptest.Server
+	latency     time.Duration
+	concurrency int
+	size        int
+	failures    []*Failure
+	lck         sync.Mutex
+	counts      map[*Failure]int
+}
+
+type Config struct {
+	// Latency is the time each action takes
+	Latency time.Duration `yaml:"latency"`
+	// Concurrency is the maximum concurrency, 4 if zero
+	Concurrency int `yaml:"concurrency"`
+	// Size is the size in pixels of each image of the preview grid, 64 if zero
+	Size int `yaml:"size"`
+	// Failures are the scripted errors returned by the client
+	Failures []*Failure `yaml:"failures"`
+}
+
+// Failure is a scripted error.
+type Failure struct {
+	// Match is a substring of the prompts that fail, empty matches all
+	Match string `yaml:"match"`
+	// Action is the action that fails (imagine, upscale or variation),
+	// empty matches all
+	Action string `yaml:"action"`
+	// Kind is the kind of error: temporary, permanent, fatal or account
+	Kind string `yaml:"kind"`
+	// Times is the number of times it fails, zero means always
+	Times int `yaml:"times"`
+}
+
+func New(cfg *Config) (*Client, error) {
+	for _, f := range cfg.Failures {
+		switch f.Kind {
+		case Temporary, Permanent, Fatal, Account:
+		default:
+			return nil, fmt.Errorf("fake: invalid failure kind %q", f.Kind)
+		}
+		switch f.Action {
+		case "", Imagine, Upscale, Variation:
+		default:
+			return nil, fmt.Errorf("fake: invalid failure action %q", f.Action)
+		}
+	}
+	concurrency := cfg.Concurrency
+	if concurrency == 0 {
+		concurrency = 4
+	}
+	size := cfg.Size
+	if size == 0 {
+		size = 64
+	}
+	return &Client{
+		latency:     cfg.Latency,
+		concurrency: concurrency,
+		size:        size,
+		failures:    cfg.Failures,
+		counts:      make(map[*Failure]int),
+	}, nil
+}
+
+func (c *Client) Start(ctx context.Context) error {
+	if c.server != nil {
+		return nil
+	}
+	c.server = httptest.NewServer(http.HandlerFunc(c.serveImage))
+	return nil
+}
+
+// Close stops the image server.
+func (c *Client) Close() error {
+	if c.server != nil {
+		c.server.Close()
+	}
+	return nil
+}
+
+func (c *Client) Concurrency() int {
+	return c.concurrency
+}
+
+func (c *Client) Imagine(ctx context.Context, prompt string) (*ai.Preview, error) {
+	if err := c.do(ctx, Imagine, prompt); err != nil {
+		return nil, err
+	}
+	return c.preview(prompt, hash(prompt)), nil
+}
+
+func (c *Client) Upscale(ctx context.Context, preview *ai.Preview, index int) ([]string, error) {
+	if index < 0 || index >= len(preview.ImageIDs) {
+		return nil, fmt.Errorf("fake: invalid index %d", index)
+	}
+	if err := c.do(ctx, Upscale, preview.Prompt); err != nil {
+		return nil, err
+	}
+	return []string{fmt.Sprintf("%s/upscale/%s.png", c.server.URL, preview.ImageIDs[index])}, nil
+}
+
+func (c *Client) Variation(ctx context.Context, preview *ai.Preview, index int) (*ai.Preview, error) {
+	if index < 0 || index >= len(preview.ImageIDs) {
+		return nil, fmt.Errorf("fake: invalid index %d", index)
+	}
+	if err := c.do(ctx, Variation, preview.Prompt); err != nil {
+		return nil, err
+	}
+	return c.preview(preview.Prompt, hash(preview.ImageIDs[index])), nil
+}
+
+// Download saves the image to the output file.
+func (c *Client) Download(ctx context.Context, u string, output string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("fake: couldn't create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fake: couldn't do request %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fake: request %s returned status code %d", u, resp.StatusCode)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("fake: couldn't create file %s: %w", output, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return fmt.Errorf("fake: couldn't write to file %s: %w", output, err)
+	}
+	return nil
+}
+
+func (c *Client) preview(prompt, id string) *ai.Preview {
+	var imageIDs []string
+	for i := 0; i < 4; i++ {
+		imageIDs = append(imageIDs, fmt.Sprintf("%s-%d", id, i))
+	}
+	return &ai.Preview{
+		URL:            fmt.Sprintf("%s/preview/%s.png", c.server.URL, id),
+		Prompt:         prompt,
+		ResponsePrompt: prompt,
+		MessageID:      id,
+		ImageIDs:       imageIDs,
+	}
+}
+
+// do waits the configured latency and returns the scripted error if any.
+func (c *Client) do(ctx context.Context, action, prompt string) error {
+	if c.server == nil {
+		return errors.New("fake: client not started")
+	}
+	if c.latency > 0 {
+		t := time.NewTimer(c.latency)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	for _, f := range c.failures {
+		if f.Action != "" && f.Action != action {
+			continue
+		}
+		if !strings.Contains(prompt, f.Match) {
+			continue
+		}
+		if f.Times > 0 && c.counts[f] >= f.Times {
+			continue
+		}
+		c.counts[f]++
+		err := fmt.Errorf("fake: scripted %s %s error for %q", f.Kind, action, prompt)
+		switch f.Kind {
+		case Fatal:
+			return ai.NewFatal(err)
+		case Account:
+			return ai.NewAccountFatal(err)
+		case Permanent:
+			return ai.NewError(err, false)
+		default:
+			return ai.NewError(err, true)
+		}
+	}
+	return nil
+}
+
+// serveImage serves /preview/<id>.png as a 2x2 grid and /upscale/<id>.png as
+// a single image. Colors are derived from the id so images are deterministic.
+func (c *Client) serveImage(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, ".png")
+	var img image.Image
+	switch {
+	case strings.HasPrefix(path, "/preview/"):
+		id := strings.TrimPrefix(path, "/preview/")
+		grid := image.NewRGBA(image.Rect(0, 0, c.size*2, c.size*2))
+		for i := 0; i < 4; i++ {
+			x, y := (i%2)*c.size, (i/2)*c.size
+			fill(grid, image.Rect(x, y, x+c.size, y+c.size), fmt.Sprintf("%s-%d", id, i))
+		}
+		img = grid
+	case strings.HasPrefix(path, "/upscale/"):
+		id := strings.TrimPrefix(path, "/upscale/")
+		single := image.NewRGBA(image.Rect(0, 0, c.size*4, c.size*4))
+		fill(single, single.Bounds(), id)
+		img = single
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	_, _ = w.Write(buf.Bytes())
+}
+
+// fill paints the rectangle with a color and a diagonal derived from the id.
+func fill(img *image.RGBA, rect image.Rectangle, id string) {
+	sum := sha256.Sum256([]byte(id))
+	bg := color.RGBA{R: sum[0], G: sum[1], B: sum[2], A: 255}
+	fg := color.RGBA{R: 255 - sum[0], G: 255 - sum[1], B: 255 - sum[2], A: 255}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			col := bg
+			if (x-rect.Min.X)*rect.Dy() == (y-rect.Min.Y)*rect.Dx() {
+				col = fg
+			}
+			img.SetRGBA(x, y, col)
+		}
+	}
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,128 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+	"github.com/ZYKJShadow/bulkai/pkg/retry"
+)
+
+func TestBulk(t *testing.T) {
+	cli, err := New(&Config{
+		Failures: []*Failure{
+			{Match: "flaky", Action: Imagine, Kind: Temporary, Times: 1},
+			{Match: "broken", Kind: Permanent},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := cli.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	policy := &retry.Policy{MaxAttempts: 2, Base: time.Millisecond}
+	out := make(chan *ai.GenerateInfo)
+	ai.Bulk(ctx, cli, ai.NewPrompts([]string{"ok", "flaky", "broken"}, ai.DefaultOptions(false, true)), nil, 2, out, 0, policy, nil)
+
+	images := map[string]int{}
+	var failed []error
+	for info := range out {
+		switch info.Status {
+		case ai.Fail:
+			failed = append(failed, info.Err)
+		case ai.Process, ai.Complete:
+			images[info.Image.Prompt]++
+		}
+	}
+	if images["ok"] != 4 || images["flaky"] != 4 || images["broken"] != 0 {
+		t.Errorf("unexpected images: %v", images)
+	}
+	if len(failed) != 1 || !strings.Contains(failed[0].Error(), `"broken"`) {
+		t.Errorf("unexpected failures: %v", failed)
+	}
+}
+
+func TestFatal(t *testing.T) {
+	cli, err := New(&Config{
+		Failures: []*Failure{{Kind: Fatal}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := cli.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	_, err = cli.Imagine(ctx, "a cat")
+	var aiErr ai.Error
+	if !errors.As(err, &aiErr) || !aiErr.Fatal() {
+		t.Fatalf("expected fatal error, got %v", err)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	cli, err := New(&Config{Size: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := cli.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	preview, err := cli.Imagine(ctx, "a cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := cli.Imagine(ctx, "a cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.URL != again.URL {
+		t.Errorf("expected deterministic urls, got %s and %s", preview.URL, again.URL)
+	}
+	upscaled, err := cli.Upscale(ctx, preview, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	tests := []struct {
+		url  string
+		size int
+	}{
+		{url: preview.URL, size: 32},
+		{url: upscaled[0], size: 64},
+	}
+	for i, tt := range tests {
+		file := filepath.Join(dir, filepath.Base(tt.url))
+		if err := cli.Download(ctx, tt.url, file); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.Bounds().Dx(); got != tt.size {
+			t.Errorf("%d: expected width %d, got %d", i, tt.size, got)
+		}
+	}
+}
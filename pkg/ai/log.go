@@ -0,0 +1,34 @@
+package ai
+
+import (
+	"context"
+	"log/slog"
+)
+
+type loggerKey struct{}
+
+// WithLogger returns a context that carries the logger. Workers take it from
+// their context and pass it to the clients with the attributes of the prompt.
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// Logger returns the logger of the context, or fallback if it doesn't have
+// one. The default logger is used if fallback is nil.
+func Logger(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok && l != nil {
+		return l
+	}
+	if fallback != nil {
+		return fallback
+	}
+	return slog.Default()
+}
+
+// taskLogger returns the logger with the attributes of the task.
+func taskLogger(l *slog.Logger, t *Task) *slog.Logger {
+	if t.Job != "" {
+		l = l.With("album", t.Job)
+	}
+	return l.With("prompt", t.Index)
+}
@@ -7,9 +7,9 @@ import (
 	"fmt"
 	"github.com/ZYKJShadow/bulkai/pkg/ai"
 	"github.com/ZYKJShadow/bulkai/pkg/discord"
+	"github.com/ZYKJShadow/bulkai/pkg/logging"
 	"github.com/igolaizola/askimg"
-	"log"
-	"os"
+	"log/slog"
 	"regexp"
 	"strconv"
 	"strings"
@@ -33,7 +33,7 @@ const (
 
 type Client struct {
 	c              *discord.Client
-	debug          bool
+	log            *slog.Logger
 	node           *snowflake.Node
 	callback       map[search][]func(*discord.Message) bool
 	cache          map[string]struct{}
@@ -43,21 +43,24 @@ type Client struct {
 	cmd            *discordgo.ApplicationCommand
 	validator      Validator
 	replicateToken string
-	dumps          []string
-	dumpLock       sync.Mutex
+	recorder       *discord.Recorder
 	timeout        time.Duration
 	queuedTimeout  time.Duration
 	midjourneyCDN  bool
+	abort          chan struct{}
+	abortErr       error
 }
 
 type Config struct {
-	Debug          bool
 	ChannelID      string
 	GuildID        string
 	ReplicateToken string
 	Timeout        time.Duration
 	QueuedTimeout  time.Duration
 	MidjourneyCDN  bool
+	// Logger is the logger of the client, the messages of the bot are logged
+	// at debug level, slog.Default() if nil
+	Logger *slog.Logger
 }
 
 func New(client *discord.Client, cfg *Config) (ai.Client, error) {
@@ -92,7 +95,7 @@ func New(client *discord.Client, cfg *Config) (ai.Client, error) {
 
 	c := &Client{
 		c:              client,
-		debug:          cfg.Debug,
+		log:            logging.OrDefault(cfg.Logger),
 		node:           node,
 		callback:       make(map[search][]func(*discord.Message) bool),
 		cache:          make(map[string]struct{}),
@@ -103,6 +106,8 @@ func New(client *discord.Client, cfg *Config) (ai.Client, error) {
 		timeout:        timeout,
 		queuedTimeout:  queuedTimeout,
 		midjourneyCDN:  cfg.MidjourneyCDN,
+		recorder:       discord.NewRecorder(100),
+		abort:          make(chan struct{}),
 	}
 
 	c.c.OnEvent(func(e *discordgo.Event) {
@@ -110,23 +115,23 @@ func New(client *discord.Client, cfg *Config) (ai.Client, error) {
 		case discord.MessageCreateEvent, discord.MessageUpdateEvent:
 			var msg discord.Message
 			if err := json.Unmarshal(e.RawData, &msg); err != nil {
-				log.Println("midjourney: couldn't unmarshal message: %w", err)
+				c.log.Error("midjourney: couldn't unmarshal message", "error", err)
 			}
 			// Ignore messages from other channels
 			if msg.ChannelID != c.channelID {
 				return
 			}
-			c.debugLog(e.Type, e.RawData)
+			c.debugLog(context.Background(), e.Type, e.RawData, "nonce", msg.Nonce)
 
 			// Check action
 			ok, err := c.checkAction(&msg)
 			if err != nil {
 				js, _ := json.Marshal(msg)
-				log.Println(string(js))
-				log.Println(err)
-				c.debugLog("ERR", err)
+				c.log.Error("midjourney: action required", "message", string(js), "error", err)
+				c.debugLog(context.Background(), "ERR", err)
 				c.saveDump()
-				panic("❌ midjourney: action required")
+				c.abortAll(ai.NewAccountFatal(fmt.Errorf("midjourney: %w: %v", ErrActionRequired, err)))
+				return
 			}
 			if ok {
 				return
@@ -243,46 +248,25 @@ func (c *Client) Concurrency() int {
 	return 12
 }
 
-func (c *Client) debugLog(t string, v interface{}) {
+func (c *Client) debugLog(ctx context.Context, t string, v interface{}, args ...any) {
+	log := ai.Logger(ctx, c.log)
 	if v == nil {
-		if c.debug {
-			log.Println(t)
-		}
+		log.Debug("midjourney: "+t, args...)
 		return
 	}
-	js, _ := json.Marshal(v)
 
 	// Save dump
-	c.dumpLock.Lock()
-	c.dumps = append(c.dumps, string(js))
-	if len(c.dumps) > 100 {
-		c.dumps = c.dumps[len(c.dumps)-100:]
-	}
-	c.dumpLock.Unlock()
+	c.recorder.Add(t, v)
 
-	if c.debug {
-		log.Println(t, string(js))
+	if log.Enabled(ctx, slog.LevelDebug) {
+		js, _ := json.Marshal(v)
+		log.Debug("midjourney: "+t, append(args, "data", string(js))...)
 	}
 }
 
 func (c *Client) saveDump() {
-	c.dumpLock.Lock()
-	defer c.dumpLock.Unlock()
-	var output string
-	for _, dump := range c.dumps {
-		output += dump + "\n"
-	}
-	// Create logs directory if it doesn't exist
-	if err := os.MkdirAll("logs", 0755); err != nil {
-		log.Println("midjourney: couldn't create logs directory:", err)
-		return
-	}
-	// Save dump using the current time
-	now := time.Now()
-	filename := fmt.Sprintf("logs/dump_%s.txt", now.Format("20060102_150405"))
-	if err := os.WriteFile(filename, []byte(output), 0644); err != nil {
-		log.Println("midjourney: couldn't save dump:", err)
-		return
+	if _, err := c.recorder.Save("logs"); err != nil {
+		c.log.Error("midjourney: couldn't save dump", "error", err)
 	}
 }
 
@@ -367,19 +351,19 @@ func parseError(msg *discord.Message) error {
 		return ai.NewError(err, true)
 	case "pending mod message":
 		err := fmt.Errorf("midjourney: %w: %s", ErrPendingMod, desc)
-		return ai.NewFatal(err)
+		return ai.NewAccountFatal(err)
 	case "action required to continue":
 		err := fmt.Errorf("midjourney: %w: %s", ErrActionRequired, desc)
-		return ai.NewFatal(err)
+		return ai.NewAccountFatal(err)
 	case "please complete the task":
 		err := fmt.Errorf("midjourney: %w: %s", ErrCompleteTask, desc)
-		return ai.NewFatal(err)
+		return ai.NewAccountFatal(err)
 	case "invalid request":
 		err := fmt.Errorf("midjourney: %w: %s", ErrInvalidRequest, desc)
-		return ai.NewFatal(err)
+		return ai.NewAccountFatal(err)
 	case "job action restricted":
 		err := fmt.Errorf("midjourney: %w: %s", ErrJobActionRestricted, desc)
-		return ai.NewFatal(err)
+		return ai.NewAccountFatal(err)
 	case "empty prompt":
 		err := fmt.Errorf("midjourney: %w: %s", ErrEmptyPrompt, desc)
 		return ai.NewFatal(err)
@@ -423,10 +407,20 @@ func (s interactionSearch) value() string {
 	return string(s)
 }
 
+// abortAll makes all the messages being waited return the given error.
+func (c *Client) abortAll(err error) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.abortErr = err
+	close(c.abort)
+	c.abort = make(chan struct{})
+}
+
 func (c *Client) receiveMessage(parent context.Context, key search, timeout time.Duration, fn func() error) (*discord.Message, error) {
 	msgChan := make(chan *discord.Message)
 	defer close(msgChan)
 	c.lck.Lock()
+	abort := c.abort
 	c.callback[key] = append(c.callback[key], func(m *discord.Message) bool {
 		// Check if channel is still open
 		select {
@@ -454,6 +448,10 @@ func (c *Client) receiveMessage(parent context.Context, key search, timeout time
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
+	case <-abort:
+		c.lck.Lock()
+		defer c.lck.Unlock()
+		return nil, c.abortErr
 	case msg := <-msgChan:
 		return msg, nil
 	}
@@ -546,7 +544,7 @@ func (c *Client) Imagine(ctx context.Context, prompt string) (*ai.Preview, error
 		},
 		Nonce: nonce,
 	}
-	c.debugLog("IMAGINE", imagine)
+	c.debugLog(ctx, "IMAGINE", imagine, "nonce", nonce)
 
 	timeout := c.timeout
 
@@ -572,6 +570,7 @@ func (c *Client) Imagine(ctx context.Context, prompt string) (*ai.Preview, error
 		case errors.Is(err, ErrJobQueued):
 			// The job is queued, so it will be processed.
 			// We will take the response prompt from the message embed footer.
+			ai.Report(ctx, ai.EventJobQueued)
 			responsePrompt, err = parseEmbedFooter(prompt, response)
 			if err != nil {
 				return nil, err
@@ -649,7 +648,7 @@ func (c *Client) Upscale(ctx context.Context, preview *ai.Preview, index int) ([
 		Nonce:     nonce,
 		MessageID: preview.MessageID,
 	}
-	c.debugLog("UPSCALE", upscale)
+	c.debugLog(ctx, "UPSCALE", upscale, "nonce", nonce)
 
 	msg, err := c.receiveMessage(ctx, upscaleSearch(preview.ResponsePrompt), c.timeout, func() error {
 		// Launch interaction inside the receive message process because the
@@ -700,7 +699,7 @@ func (c *Client) Variation(ctx context.Context, preview *ai.Preview, index int)
 		Nonce:     nonce,
 		MessageID: preview.MessageID,
 	}
-	c.debugLog("VARIATION", variation)
+	c.debugLog(ctx, "VARIATION", variation, "nonce", nonce)
 
 	msg, err := c.receiveMessage(ctx, variationSearch(preview.ResponsePrompt), c.timeout, func() error {
 		// Launch interaction inside the receive message process because the
@@ -788,7 +787,7 @@ func (c *Client) checkAction(msg *discord.Message) (bool, error) {
 	if err != nil {
 		return false, fmt.Errorf("midjourney: couldn't ask image: %w", err)
 	}
-	c.debugLog("ASK", struct {
+	c.debugLog(ctx, "ASK", struct {
 		Question string `json:"question"`
 		Response string `json:"response"`
 	}{Question: question, Response: response})
@@ -823,11 +822,12 @@ func (c *Client) checkAction(msg *discord.Message) (bool, error) {
 			CustomID:      components[match].CustomID,
 		},
 	}
-	c.debugLog("CLICK", click)
+	c.debugLog(ctx, "CLICK", click, "nonce", click.Nonce)
 	if _, err := c.c.Do(ctx, "POST", "interactions", click); err != nil {
 		return false, fmt.Errorf("midjourney: couldn't send click interaction: %w", err)
 	}
-	log.Printf("✅ midjourney: action completed (%s) %d %s %s\n", strings.Join(options, ","), match, response, image)
+	c.log.Info("midjourney: action completed", "options", strings.Join(options, ","), "match", match,
+		"response", response, "image", image, "nonce", click.Nonce)
 	return true, nil
 }
 
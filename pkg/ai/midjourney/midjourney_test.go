@@ -1,8 +1,19 @@
 package midjourney
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+	"github.com/ZYKJShadow/bulkai/pkg/discord"
+	"github.com/ZYKJShadow/bulkai/pkg/discord/discordtest"
+	"github.com/bwmarrin/discordgo"
 )
 
 func TestParseContent(t *testing.T) {
@@ -16,3 +27,461 @@ func TestParseContent(t *testing.T) {
 	fmt.Println(rest)
 	fmt.Println(b)
 }
+
+// testBot scripts the responses of the midjourney bot using a local discord
+// server.
+type testBot struct {
+	t *testing.T
+	s *discordtest.Server
+	c *Client
+}
+
+// send sends a message create event to the client channel.
+func (b *testBot) send(msg *discord.Message) {
+	msg.ChannelID = b.c.channelID
+	if err := b.s.Create(msg); err != nil {
+		b.t.Error(err)
+	}
+}
+
+// later sends the message once the client is waiting for the given key.
+func (b *testBot) later(key search, msg *discord.Message) {
+	go func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			b.c.lck.Lock()
+			n := len(b.c.callback[key])
+			b.c.lck.Unlock()
+			if n > 0 {
+				b.send(msg)
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		b.t.Errorf("client didn't wait for %T(%s)", key, key.value())
+	}()
+}
+
+func (b *testBot) preview(prompt, id string) *discord.Message {
+	return &discord.Message{
+		Content:     fmt.Sprintf("**%s** - <@%s> (fast)", prompt, discordtest.UserID),
+		Attachments: []*discordgo.MessageAttachment{b.s.Attachment(id + "_grid.png")},
+		Components:  gridComponents(id),
+	}
+}
+
+func gridComponents(id string) []*discord.Component {
+	upscale := &discord.Component{Type: 1}
+	variation := &discord.Component{Type: 1}
+	for i := 1; i <= 4; i++ {
+		upscale.Components = append(upscale.Components, &discord.Component{
+			Type: 2, Style: 2, Label: fmt.Sprintf("U%d", i), CustomID: fmt.Sprintf("%s%d::%s", upscaleID, i, id),
+		})
+		variation.Components = append(variation.Components, &discord.Component{
+			Type: 2, Style: 2, Label: fmt.Sprintf("V%d", i), CustomID: fmt.Sprintf("%s%d::%s", variationID, i, id),
+		})
+	}
+	return []*discord.Component{upscale, variation}
+}
+
+func newTestClient(t *testing.T, cfg *Config, handler func(b *testBot, i *discordtest.Interaction) error) *Client {
+	t.Helper()
+	ctx := context.Background()
+	b := &testBot{t: t}
+	b.s = discordtest.NewServer(&discordtest.Config{
+		Bots: []string{botID},
+		Handler: func(s *discordtest.Server, i *discordtest.Interaction) error {
+			return handler(b, i)
+		},
+	})
+	t.Cleanup(b.s.Close)
+
+	d, err := discord.New(b.s.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = d.Stop() })
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	cli, err := New(d, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.c = cli.(*Client)
+	if err := b.c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return b.c
+}
+
+func errorEmbed(title, desc string) []*discordgo.MessageEmbed {
+	return []*discordgo.MessageEmbed{{Title: title, Description: desc}}
+}
+
+func TestImagine(t *testing.T) {
+	tests := []struct {
+		name      string
+		prompt    string
+		timeout   time.Duration
+		bot       func(b *testBot, i *discordtest.Interaction) error
+		want      string
+		wantErr   error
+		temporary bool
+		fatal     bool
+	}{
+		{
+			name:   "nonce",
+			prompt: "a cat",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				prompt := i.Options["prompt"]
+				b.send(&discord.Message{
+					Nonce:   i.Nonce,
+					Content: fmt.Sprintf("**%s** - <@%s> (Waiting to start)", prompt, discordtest.UserID),
+				})
+				b.later(previewSearch(prompt), b.preview(prompt, "cat"))
+				return nil
+			},
+			want: "a cat",
+		},
+		{
+			name:   "parameters",
+			prompt: "a cat --aspect 3:2 --sref 123 --v 7",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				// The prompt is sent as written
+				prompt := i.Options["prompt"]
+				if prompt != "a cat --aspect 3:2 --sref 123 --v 7" {
+					return fmt.Errorf("unexpected prompt %q", prompt)
+				}
+				b.send(&discord.Message{
+					Nonce:   i.Nonce,
+					Content: fmt.Sprintf("**%s** - <@%s> (Waiting to start)", prompt, discordtest.UserID),
+				})
+				b.later(previewSearch(prompt), b.preview(prompt, "cat"))
+				return nil
+			},
+			want: "a cat --aspect 3:2 --sref 123 --v 7",
+		},
+		{
+			name:   "links",
+			prompt: "https://example.com/cat.png a cat",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				b.send(&discord.Message{
+					Nonce:   i.Nonce,
+					Content: fmt.Sprintf("**%s** - <@%s> (Waiting to start)", i.Options["prompt"], discordtest.UserID),
+				})
+				b.later(previewSearch("<LINK> a cat"), b.preview("<https://s.mj.run/abc> a cat", "cat"))
+				return nil
+			},
+			want: "<LINK> a cat",
+		},
+		{
+			name:   "other channel",
+			prompt: "a dog",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				prompt := i.Options["prompt"]
+				msg := &discord.Message{
+					Nonce:   i.Nonce,
+					Content: fmt.Sprintf("**%s** - <@%s> (Waiting to start)", prompt, discordtest.UserID),
+				}
+				other := *msg
+				other.ChannelID = "1"
+				if err := b.s.Create(&other); err != nil {
+					return err
+				}
+				b.send(msg)
+				b.later(previewSearch(prompt), b.preview(prompt, "dog"))
+				return nil
+			},
+			want: "a dog",
+		},
+		{
+			name:   "interaction",
+			prompt: "a bird",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				prompt := i.Options["prompt"]
+				interaction := &discord.Interaction{ID: b.s.NewID(), Name: "imagine", Type: 2}
+				b.send(&discord.Message{
+					Nonce:       i.Nonce,
+					Interaction: interaction,
+				})
+				b.later(interactionSearch(interaction.ID), &discord.Message{
+					Content:     fmt.Sprintf("**%s** - <@%s> (Waiting to start)", prompt, discordtest.UserID),
+					Interaction: interaction,
+				})
+				b.later(previewSearch(prompt), b.preview(prompt, "bird"))
+				return nil
+			},
+			want: "a bird",
+		},
+		{
+			name:   "job queued",
+			prompt: "a fish",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				prompt := i.Options["prompt"]
+				b.send(&discord.Message{
+					Nonce: i.Nonce,
+					Embeds: []*discordgo.MessageEmbed{{
+						Title:       "Job queued",
+						Description: "Your job will start shortly",
+						Footer:      &discordgo.MessageEmbedFooter{Text: "/imagine " + prompt + " --v 5"},
+					}},
+				})
+				b.later(previewSearch(prompt+" --v 5"), b.preview(prompt+" --v 5", "fish"))
+				return nil
+			},
+			want: "a fish --v 5",
+		},
+		{
+			name:   "banned prompt",
+			prompt: "a horse",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				b.send(&discord.Message{Nonce: i.Nonce, Embeds: errorEmbed("Banned prompt", "a horse")})
+				return nil
+			},
+			wantErr: ErrBannedPrompt,
+		},
+		{
+			name:   "queue full",
+			prompt: "a cow",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				b.send(&discord.Message{Nonce: i.Nonce, Embeds: errorEmbed("Queue full", "try later")})
+				return nil
+			},
+			wantErr:   ErrQueueFull,
+			temporary: true,
+		},
+		{
+			name:   "pending mod message",
+			prompt: "a pig",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				b.send(&discord.Message{Nonce: i.Nonce, Embeds: errorEmbed("Pending mod message", "read the rules")})
+				return nil
+			},
+			wantErr: ErrPendingMod,
+			fatal:   true,
+		},
+		{
+			name:    "timeout",
+			prompt:  "a goat",
+			timeout: 100 * time.Millisecond,
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				return nil
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c := newTestClient(t, &Config{Timeout: tt.timeout}, func(b *testBot, i *discordtest.Interaction) error {
+				if i.Name != "imagine" || i.ChannelID != b.c.channelID {
+					return fmt.Errorf("unexpected interaction %+v", i)
+				}
+				return tt.bot(b, i)
+			})
+			preview, err := c.Imagine(context.Background(), tt.prompt)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				var aiErr ai.Error
+				isAIErr := errors.As(err, &aiErr)
+				if got := isAIErr && aiErr.Temporary(); got != tt.temporary {
+					t.Errorf("expected temporary %v, got %v", tt.temporary, got)
+				}
+				if got := isAIErr && aiErr.Fatal(); got != tt.fatal {
+					t.Errorf("expected fatal %v, got %v", tt.fatal, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if preview.ResponsePrompt != tt.want {
+				t.Errorf("expected response prompt %q, got %q", tt.want, preview.ResponsePrompt)
+			}
+			if preview.Prompt != tt.prompt {
+				t.Errorf("expected prompt %q, got %q", tt.prompt, preview.Prompt)
+			}
+			if len(preview.ImageIDs) != 4 || !strings.HasPrefix(preview.ImageIDs[0], "1::") {
+				t.Errorf("unexpected image ids %v", preview.ImageIDs)
+			}
+			if preview.URL == "" || preview.MessageID == "" {
+				t.Errorf("missing url or message id: %+v", preview)
+			}
+		})
+	}
+}
+
+func TestUpscale(t *testing.T) {
+	tests := []struct {
+		name          string
+		midjourneyCDN bool
+		bot           func(b *testBot, i *discordtest.Interaction) error
+		wantURLs      []string
+		wantErr       error
+	}{
+		{
+			name: "upscaled by",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				b.send(&discord.Message{
+					Content:     fmt.Sprintf("**a cat** - Upscaled by <@%s> (fast)", discordtest.UserID),
+					Attachments: []*discordgo.MessageAttachment{b.s.Attachment("cat_upscaled.png")},
+					Components:  []*discord.Component{{Type: 1, Components: []*discord.Component{{Type: 2, CustomID: "MJ::BOOKMARK::cat"}}}},
+				})
+				return nil
+			},
+			wantURLs: []string{"/attachments/cat_upscaled.png", "https://cdn.midjourney.com/cat/0_1.png"},
+		},
+		{
+			name:          "image number",
+			midjourneyCDN: true,
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				b.send(&discord.Message{
+					Content:     fmt.Sprintf("**a cat** - Image #2 <@%s>", discordtest.UserID),
+					Attachments: []*discordgo.MessageAttachment{b.s.Attachment("cat_2.png")},
+					Components:  []*discord.Component{{Type: 1, Components: []*discord.Component{{Type: 2, CustomID: "MJ::BOOKMARK::cat"}}}},
+				})
+				return nil
+			},
+			wantURLs: []string{"https://cdn.midjourney.com/cat/0_1.png", "/attachments/cat_2.png"},
+		},
+		{
+			name: "message not found",
+			bot: func(b *testBot, i *discordtest.Interaction) error {
+				return discord.ErrMessageNotFound
+			},
+			wantErr: ErrMessageNotFound,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c := newTestClient(t, &Config{MidjourneyCDN: tt.midjourneyCDN}, func(b *testBot, i *discordtest.Interaction) error {
+				if i.CustomID != upscaleID+"2::cat" || i.MessageID != "42" {
+					return fmt.Errorf("unexpected interaction %+v", i)
+				}
+				return tt.bot(b, i)
+			})
+			preview := &ai.Preview{
+				Prompt:         "a cat",
+				ResponsePrompt: "a cat",
+				MessageID:      "42",
+				ImageIDs:       []string{"1::cat", "2::cat", "3::cat", "4::cat"},
+			}
+			urls, err := c.Upscale(context.Background(), preview, 1)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(urls) != len(tt.wantURLs) {
+				t.Fatalf("expected urls %v, got %v", tt.wantURLs, urls)
+			}
+			for i := range urls {
+				if !strings.HasSuffix(urls[i], tt.wantURLs[i]) {
+					t.Errorf("expected url %d to end with %s, got %s", i, tt.wantURLs[i], urls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestVariation(t *testing.T) {
+	tests := []struct {
+		name string
+		term string
+	}{
+		{name: "variations", term: variationTerm},
+		{name: "subtle", term: variationSubtleTerm},
+		{name: "strong", term: variationStrongTerm},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c := newTestClient(t, &Config{}, func(b *testBot, i *discordtest.Interaction) error {
+				if i.CustomID != variationID+"3::cat" {
+					return fmt.Errorf("unexpected interaction %+v", i)
+				}
+				msg := b.preview("a cat", "kitten")
+				msg.Content = fmt.Sprintf("**a cat** - %s <@%s> (fast)", tt.term, discordtest.UserID)
+				b.send(msg)
+				return nil
+			})
+			preview := &ai.Preview{
+				Prompt:         "a cat",
+				ResponsePrompt: "a cat",
+				MessageID:      "42",
+				ImageIDs:       []string{"1::cat", "2::cat", "3::cat", "4::cat"},
+			}
+			got, err := c.Variation(context.Background(), preview, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"1::kitten", "2::kitten", "3::kitten", "4::kitten"}
+			if strings.Join(got.ImageIDs, ",") != strings.Join(want, ",") {
+				t.Errorf("expected image ids %v, got %v", want, got.ImageIDs)
+			}
+			if got.ResponsePrompt != "a cat" || got.MessageID == "42" {
+				t.Errorf("unexpected preview %+v", got)
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	records, err := discord.LoadDump("testdata/dump_imagine.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Take the recorded nonce to replace it with the new one
+	var recorded discord.InteractionCommand
+	for _, r := range records {
+		if r.Type == "IMAGINE" {
+			if err := json.Unmarshal(r.Data, &recorded); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if recorded.Nonce == "" {
+		t.Fatal("imagine not found in dump")
+	}
+
+	ctx := context.Background()
+	c := newTestClient(t, &Config{}, func(b *testBot, i *discordtest.Interaction) error {
+		go func() {
+			err := b.c.c.Replay(ctx, records, &discord.ReplayConfig{
+				Speed: 200,
+				Rewrite: func(r *discord.Record) {
+					r.Data = bytes.ReplaceAll(r.Data, []byte(recorded.Nonce), []byte(i.Nonce))
+				},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		return nil
+	})
+	preview, err := c.Imagine(ctx, "a red fox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.ResponsePrompt != "a red fox --v 5" {
+		t.Errorf("unexpected response prompt %q", preview.ResponsePrompt)
+	}
+	if preview.MessageID != "1200000000000000003" || len(preview.ImageIDs) != 4 || preview.ImageIDs[3] != "4::a6b3e1c2-fox" {
+		t.Errorf("unexpected preview %+v", preview)
+	}
+}
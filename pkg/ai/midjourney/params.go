@@ -0,0 +1,508 @@
+package midjourney
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// LatestVersion is the model version whose rules are used when the prompt
+// doesn't set one.
+const LatestVersion = "7"
+
+// DefaultNijiVersion is the niji version used when --niji has no value.
+const DefaultNijiVersion = "6"
+
+var versions = map[string]struct{}{
+	"1": {}, "2": {}, "3": {}, "4": {}, "5": {}, "5.1": {}, "5.2": {}, "6": {}, "6.1": {}, "7": {},
+}
+
+var nijiVersions = map[string]struct{}{
+	"4": {}, "5": {}, "6": {},
+}
+
+// aliases maps the parameter names that are checked to their canonical
+// name. Other parameters are sent as they are.
+var aliases = map[string]string{
+	"ar":       "ar",
+	"aspect":   "ar",
+	"v":        "v",
+	"version":  "v",
+	"niji":     "niji",
+	"q":        "q",
+	"quality":  "q",
+	"seed":     "seed",
+	"sameseed": "sameseed",
+	"s":        "s",
+	"stylize":  "s",
+	"c":        "c",
+	"chaos":    "c",
+	"w":        "weird",
+	"weird":    "weird",
+	"stop":     "stop",
+	"r":        "r",
+	"repeat":   "r",
+	"iw":       "iw",
+	"no":       "no",
+	"style":    "style",
+	"tile":     "tile",
+	"video":    "video",
+	"fast":     "fast",
+	"relax":    "relax",
+	"turbo":    "turbo",
+}
+
+// flags are the parameters without a value.
+var flags = map[string]struct{}{
+	"tile": {}, "video": {}, "fast": {}, "relax": {}, "turbo": {},
+}
+
+// Aspect is an aspect ratio.
+type Aspect struct {
+	Width  int
+	Height int
+}
+
+func (a Aspect) String() string {
+	return fmt.Sprintf("%d:%d", a.Width, a.Height)
+}
+
+// Params is a prompt split in its image urls, its text and its parameters.
+type Params struct {
+	Images []string
+	Text   string
+
+	Aspect *Aspect
+	// Version is the model version, or the niji version if Niji is set.
+	// It is empty if the prompt doesn't set it.
+	Version     string
+	Niji        bool
+	Quality     *float64
+	Seed        *int64
+	SameSeed    *int64
+	Stylize     *int
+	Chaos       *int
+	Weird       *int
+	Stop        *int
+	Repeat      *int
+	ImageWeight *float64
+	No          []string
+	Style       string
+	Tile        bool
+	Video       bool
+	// Mode is the speed mode: fast, relax or turbo
+	Mode string
+	// Other are the parameters that aren't checked, e.g. --sref or --p
+	Other []Param
+}
+
+// Param is a parameter of a prompt with its name as written, without the
+// dashes.
+type Param struct {
+	Name  string
+	Value string
+}
+
+// ParseParams splits the prompt in its parts. Parameter aliases are
+// normalized (e.g. --aspect to --ar) and values are checked to have the
+// right type, use Validate to check them against the model version.
+// Unknown parameters are kept in Other without being checked.
+func ParseParams(prompt string) (*Params, error) {
+	fields := strings.Fields(prompt)
+	p := &Params{}
+
+	// Image prompts go first
+	i := 0
+	for ; i < len(fields); i++ {
+		if !isURL(fields[i]) {
+			break
+		}
+		p.Images = append(p.Images, fields[i])
+	}
+
+	// Text ends at the first parameter
+	start := i
+	for ; i < len(fields); i++ {
+		if isParam(fields[i]) {
+			break
+		}
+	}
+	p.Text = strings.Join(fields[start:i], " ")
+
+	seen := make(map[string]struct{})
+	for i < len(fields) {
+		raw := trimDashes(fields[i])
+		i++
+		var values []string
+		for ; i < len(fields) && !isParam(fields[i]); i++ {
+			values = append(values, fields[i])
+		}
+		value := strings.Join(values, " ")
+
+		name, ok := aliases[strings.ToLower(raw)]
+		if !ok {
+			p.Other = append(p.Other, Param{Name: raw, Value: value})
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("midjourney: %w: duplicated parameter --%s", ErrInvalidParameter, name)
+		}
+		seen[name] = struct{}{}
+		if _, ok := flags[name]; ok && value != "" {
+			return nil, fmt.Errorf("midjourney: %w: --%s doesn't take a value", ErrInvalidParameter, name)
+		}
+		if err := p.set(name, value); err != nil {
+			return nil, fmt.Errorf("midjourney: %w: --%s %s: %v", ErrInvalidParameter, name, value, err)
+		}
+	}
+
+	// Mutually exclusive parameters
+	for _, pair := range [][2]string{{"v", "niji"}, {"seed", "sameseed"}} {
+		_, a := seen[pair[0]]
+		_, b := seen[pair[1]]
+		if a && b {
+			return nil, fmt.Errorf("midjourney: %w: --%s and --%s can't be used together", ErrInvalidParameter, pair[0], pair[1])
+		}
+	}
+	var modes []string
+	for _, m := range []string{"fast", "relax", "turbo"} {
+		if _, ok := seen[m]; ok {
+			modes = append(modes, "--"+m)
+		}
+	}
+	if len(modes) > 1 {
+		return nil, fmt.Errorf("midjourney: %w: %s can't be used together", ErrInvalidParameter, strings.Join(modes, " and "))
+	}
+	return p, nil
+}
+
+// set parses the value of a parameter.
+func (p *Params) set(name, value string) error {
+	var err error
+	switch name {
+	case "ar":
+		w, h, ok := strings.Cut(value, ":")
+		if !ok {
+			return fmt.Errorf("expected width:height")
+		}
+		var a Aspect
+		if a.Width, err = strconv.Atoi(w); err != nil || a.Width <= 0 {
+			return fmt.Errorf("invalid width %q", w)
+		}
+		if a.Height, err = strconv.Atoi(h); err != nil || a.Height <= 0 {
+			return fmt.Errorf("invalid height %q", h)
+		}
+		p.Aspect = &a
+	case "v":
+		v := strings.TrimSuffix(value, ".0")
+		if _, ok := versions[v]; !ok {
+			return fmt.Errorf("unknown version")
+		}
+		p.Version = v
+	case "niji":
+		p.Niji = true
+		if value == "" {
+			return nil
+		}
+		if _, ok := nijiVersions[value]; !ok {
+			return fmt.Errorf("unknown niji version")
+		}
+		p.Version = value
+	case "q":
+		p.Quality, err = parseFloat(value)
+	case "seed":
+		p.Seed, err = parseSeed(value)
+	case "sameseed":
+		p.SameSeed, err = parseSeed(value)
+	case "s":
+		p.Stylize, err = parseInt(value)
+	case "c":
+		p.Chaos, err = parseInt(value)
+	case "weird":
+		p.Weird, err = parseInt(value)
+	case "stop":
+		p.Stop, err = parseInt(value)
+	case "r":
+		p.Repeat, err = parseInt(value)
+	case "iw":
+		p.ImageWeight, err = parseFloat(value)
+	case "no":
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				p.No = append(p.No, v)
+			}
+		}
+		if len(p.No) == 0 {
+			return fmt.Errorf("missing value")
+		}
+	case "style":
+		if value == "" {
+			return fmt.Errorf("missing value")
+		}
+		p.Style = strings.ToLower(value)
+	case "tile":
+		p.Tile = true
+	case "video":
+		p.Video = true
+	case "fast", "relax", "turbo":
+		p.Mode = name
+	}
+	return err
+}
+
+// Validate checks the parameters against the rules of the model version.
+func (p *Params) Validate() error {
+	if p.Text == "" && len(p.Images) < 2 {
+		return fmt.Errorf("midjourney: %w: a prompt needs text or at least two images", ErrInvalidParameter)
+	}
+	version := p.Version
+	switch {
+	case version != "":
+	case p.Niji:
+		version = DefaultNijiVersion
+	default:
+		version = LatestVersion
+	}
+	v, _ := strconv.ParseFloat(version, 64)
+	name := "version " + version
+	if p.Niji {
+		name = "niji " + version
+	}
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("midjourney: %w: %s", ErrInvalidParameter, fmt.Sprintf(format, args...))
+	}
+	inRange := func(param string, value *int, min, max int) error {
+		if value != nil && (*value < min || *value > max) {
+			return invalid("--%s must be between %d and %d with %s", param, min, max, name)
+		}
+		return nil
+	}
+
+	if a := p.Aspect; a != nil && v == 4 {
+		if r := float64(a.Width) / float64(a.Height); r > 2 || r < 0.5 {
+			return invalid("--ar must be between 1:2 and 2:1 with %s", name)
+		}
+	}
+	if q := p.Quality; q != nil {
+		allowed := []float64{0.25, 0.5, 1, 2}
+		switch {
+		case v < 4:
+			allowed = append(allowed, 5)
+		case v >= 7:
+			allowed = append(allowed, 4)
+		}
+		if !containsFloat(allowed, *q) {
+			return invalid("--q must be one of %s with %s", formatFloats(allowed), name)
+		}
+	}
+	if p.SameSeed != nil && v >= 4 {
+		return invalid("--sameseed isn't supported by %s", name)
+	}
+	stylizeMin, stylizeMax := 0, 1000
+	if v < 4 {
+		stylizeMin, stylizeMax = 625, 60000
+	}
+	if err := inRange("s", p.Stylize, stylizeMin, stylizeMax); err != nil {
+		return err
+	}
+	if err := inRange("c", p.Chaos, 0, 100); err != nil {
+		return err
+	}
+	if p.Weird != nil && (p.Niji || v < 5.2) {
+		return invalid("--weird isn't supported by %s", name)
+	}
+	if err := inRange("weird", p.Weird, 0, 3000); err != nil {
+		return err
+	}
+	if err := inRange("stop", p.Stop, 10, 100); err != nil {
+		return err
+	}
+	if err := inRange("r", p.Repeat, 1, 40); err != nil {
+		return err
+	}
+	if iw := p.ImageWeight; iw != nil {
+		if len(p.Images) == 0 {
+			return invalid("--iw needs an image prompt")
+		}
+		switch {
+		case v == 4:
+			return invalid("--iw isn't supported by %s", name)
+		case v < 4:
+			if *iw < -10000 || *iw > 10000 {
+				return invalid("--iw must be between -10000 and 10000 with %s", name)
+			}
+		default:
+			max := 2.0
+			if v >= 6 {
+				max = 3
+			}
+			if *iw < 0 || *iw > max {
+				return invalid("--iw must be between 0 and %s with %s", formatFloat(max), name)
+			}
+		}
+	}
+	if p.Style != "" {
+		var styles []string
+		switch {
+		case p.Niji && v == 5:
+			styles = []string{"cute", "expressive", "original", "scenic"}
+		case p.Niji && v >= 6:
+			styles = []string{"raw"}
+		case !p.Niji && v == 4:
+			styles = []string{"4a", "4b", "4c"}
+		case !p.Niji && v >= 5.1:
+			styles = []string{"raw"}
+		}
+		if len(styles) == 0 {
+			return invalid("--style isn't supported by %s", name)
+		}
+		if !containsString(styles, p.Style) {
+			return invalid("--style must be one of %s with %s", strings.Join(styles, ", "), name)
+		}
+	}
+	if p.Tile && v == 4 {
+		return invalid("--tile isn't supported by %s", name)
+	}
+	return nil
+}
+
+// String returns the prompt using the canonical parameter names, the
+// parameters that aren't checked go last.
+func (p *Params) String() string {
+	parts := append([]string{}, p.Images...)
+	if p.Text != "" {
+		parts = append(parts, p.Text)
+	}
+	add := func(name, value string) {
+		parts = append(parts, "--"+name)
+		if value != "" {
+			parts = append(parts, value)
+		}
+	}
+	if p.Aspect != nil {
+		add("ar", p.Aspect.String())
+	}
+	switch {
+	case p.Niji:
+		add("niji", p.Version)
+	case p.Version != "":
+		add("v", p.Version)
+	}
+	if p.Quality != nil {
+		add("q", formatFloat(*p.Quality))
+	}
+	if p.Seed != nil {
+		add("seed", strconv.FormatInt(*p.Seed, 10))
+	}
+	if p.SameSeed != nil {
+		add("sameseed", strconv.FormatInt(*p.SameSeed, 10))
+	}
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{
+		{"s", p.Stylize},
+		{"c", p.Chaos},
+		{"weird", p.Weird},
+		{"stop", p.Stop},
+		{"r", p.Repeat},
+	} {
+		if param.value != nil {
+			add(param.name, strconv.Itoa(*param.value))
+		}
+	}
+	if p.ImageWeight != nil {
+		add("iw", formatFloat(*p.ImageWeight))
+	}
+	if len(p.No) > 0 {
+		add("no", strings.Join(p.No, ", "))
+	}
+	if p.Style != "" {
+		add("style", p.Style)
+	}
+	if p.Tile {
+		add("tile", "")
+	}
+	if p.Video {
+		add("video", "")
+	}
+	if p.Mode != "" {
+		add(p.Mode, "")
+	}
+	for _, o := range p.Other {
+		add(o.Name, o.Value)
+	}
+	return strings.Join(parts, " ")
+}
+
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// isParam reports whether the field is a parameter name. Em dashes are
+// accepted as some editors replace double dashes with them.
+func isParam(s string) bool {
+	return strings.HasPrefix(s, "--") || strings.HasPrefix(s, "—")
+}
+
+func trimDashes(s string) string {
+	s = strings.TrimPrefix(s, "—")
+	return strings.TrimLeft(s, "-")
+}
+
+func parseInt(s string) (*int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("expected an integer")
+	}
+	return &v, nil
+}
+
+func parseFloat(s string) (*float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Errorf("expected a number")
+	}
+	return &v, nil
+}
+
+func parseSeed(s string) (*int64, error) {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 || v > math.MaxUint32 {
+		return nil, fmt.Errorf("expected an integer between 0 and %d", uint32(math.MaxUint32))
+	}
+	return &v, nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatFloats(fs []float64) string {
+	var s []string
+	for _, f := range fs {
+		s = append(s, formatFloat(f))
+	}
+	return strings.Join(s, ", ")
+}
+
+func containsFloat(fs []float64, f float64) bool {
+	for _, v := range fs {
+		if v == f {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package midjourney
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		prompt  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "text only",
+			prompt: "  a cute   cat ",
+			want:   "a cute cat",
+		},
+		{
+			name:   "aliases",
+			prompt: "a cat --aspect 3:2 --version 5.0 --quality .5 --stylize 100 --chaos 10",
+			want:   "a cat --ar 3:2 --v 5 --q 0.5 --s 100 --c 10",
+		},
+		{
+			name:   "images and no",
+			prompt: "https://example.com/a.png https://example.com/b.png a cat —no red, blue trees --iw 1.5 --tile --fast",
+			want:   "https://example.com/a.png https://example.com/b.png a cat --iw 1.5 --no red, blue trees --tile --fast",
+		},
+		{
+			name:   "niji",
+			prompt: "a cat --niji --style cute",
+			want:   "a cat --niji --style cute",
+		},
+		{
+			name:   "unknown parameters",
+			prompt: "a cat --sref https://example.com/a.png 123 --cref https://example.com/b.png --cw 50 --p --aspect 1:1 --",
+			want:   "a cat --ar 1:1 --sref https://example.com/a.png 123 --cref https://example.com/b.png --cw 50 --p --",
+		},
+		{
+			name:   "version 7",
+			prompt: "a cat --v 7 --draft",
+			want:   "a cat --v 7 --draft",
+		},
+		{name: "incomplete aspect", prompt: "a cat --ar 3:", wantErr: true},
+		{name: "duplicated", prompt: "a cat --ar 1:1 --aspect 2:3", wantErr: true},
+		{name: "flag with value", prompt: "a cat --tile yes", wantErr: true},
+		{name: "unknown version", prompt: "a cat --v 7.5", wantErr: true},
+		{name: "version and niji", prompt: "a cat --v 5 --niji 5", wantErr: true},
+		{name: "modes", prompt: "a cat --fast --relax", wantErr: true},
+		{name: "seed", prompt: "a cat --seed -1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseParams(tt.prompt)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidParameter) {
+					t.Fatalf("expected invalid parameter error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.String(); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateParams(t *testing.T) {
+	tests := []struct {
+		prompt  string
+		wantErr bool
+	}{
+		{prompt: "a cat --ar 21:9 --s 1000 --weird 3000 --style raw"},
+		{prompt: "a cat --ar 3:1 --v 4", wantErr: true},
+		{prompt: "a cat --ar 2:1 --v 4 --style 4b"},
+		{prompt: "a cat --s 1001", wantErr: true},
+		{prompt: "a cat --s 2000 --v 3 --q 5 --sameseed 42"},
+		{prompt: "a cat --sameseed 42", wantErr: true},
+		{prompt: "a cat --q 0.3", wantErr: true},
+		{prompt: "a cat --weird 10 --v 5.1", wantErr: true},
+		{prompt: "a cat --weird 10 --niji 6", wantErr: true},
+		{prompt: "a cat --stop 5", wantErr: true},
+		{prompt: "a cat --c 101", wantErr: true},
+		{prompt: "a cat --r 41", wantErr: true},
+		{prompt: "a cat --iw 1", wantErr: true},
+		{prompt: "https://example.com/a.png a cat --iw 2.5 --v 5.2", wantErr: true},
+		{prompt: "https://example.com/a.png a cat --iw 2.5"},
+		{prompt: "https://example.com/a.png --v 5", wantErr: true},
+		{prompt: "https://example.com/a.png https://example.com/b.png"},
+		{prompt: "a cat --style raw --v 5", wantErr: true},
+		{prompt: "a cat --style scenic --niji 5"},
+		{prompt: "a cat --tile --v 4", wantErr: true},
+		{prompt: "a cat --q 4 --v 7 --sref 123 --p"},
+		{prompt: "a cat --q 4 --v 6.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		p, err := ParseParams(tt.prompt)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.prompt, err)
+		}
+		err = p.Validate()
+		if tt.wantErr != (err != nil) {
+			t.Errorf("%s: expected error %v, got %v", tt.prompt, tt.wantErr, err)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("%s: expected invalid parameter error, got %v", tt.prompt, err)
+		}
+	}
+}
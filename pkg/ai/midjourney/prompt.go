@@ -58,5 +58,11 @@ func (v *validator) ValidatePrompt(prompt string) error {
 			return fmt.Errorf("%q 是违禁词，无法使用", word)
 		}
 	}
-	return nil
+
+	// Check the parameters
+	params, err := ParseParams(prompt)
+	if err != nil {
+		return err
+	}
+	return params.Validate()
 }
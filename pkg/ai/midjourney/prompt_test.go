@@ -19,6 +19,16 @@ func TestValidatePrompt(t *testing.T) {
 			prompt:  "this is a valid prompt",
 			wantErr: false,
 		},
+		{
+			name:    "invalid parameter",
+			prompt:  "a cat --ar 3:",
+			wantErr: true,
+		},
+		{
+			name:    "unknown parameter",
+			prompt:  "a cat --v 7 --sref 123 --cw 50",
+			wantErr: false,
+		},
 		{
 			name:    "banned word",
 			prompt:  "the word sex is banned",
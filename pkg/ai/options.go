@@ -0,0 +1,114 @@
+package ai
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// GridSize is the number of images of a preview grid.
+const GridSize = 4
+
+// Options are the generation options of a prompt.
+type Options struct {
+	// Upscale are the indexes of the grid images to upscale, the grid is
+	// kept as a preview if there are none
+	Upscale []int `json:"upscale,omitempty" yaml:"upscale"`
+	// Variation generates variations of each grid image
+	Variation bool `json:"variation,omitempty" yaml:"variation"`
+	// Rounds is the number of variations generated of each grid image,
+	// one if zero. Each round varies the image of the previous round
+	Rounds int `json:"rounds,omitempty" yaml:"rounds"`
+}
+
+// DefaultOptions returns the options that upscale all the grid images if
+// upscale is enabled and generate a single round of variations if
+// variation is enabled.
+func DefaultOptions(variation, upscale bool) Options {
+	o := Options{Variation: variation}
+	if upscale {
+		o.Upscale = []int{0, 1, 2, 3}
+	}
+	return o
+}
+
+// Validate checks the upscale indexes and the variation rounds.
+func (o Options) Validate() error {
+	seen := make(map[int]struct{})
+	for _, i := range o.Upscale {
+		if i < 0 || i >= GridSize {
+			return fmt.Errorf("ai: invalid upscale index %d, must be between 0 and %d", i, GridSize-1)
+		}
+		if _, ok := seen[i]; ok {
+			return fmt.Errorf("ai: duplicated upscale index %d", i)
+		}
+		seen[i] = struct{}{}
+	}
+	if o.Rounds < 0 {
+		return fmt.Errorf("ai: invalid variation rounds %d", o.Rounds)
+	}
+	return nil
+}
+
+// rounds returns the number of variation rounds.
+func (o Options) rounds() int {
+	if !o.Variation {
+		return 0
+	}
+	if o.Rounds <= 0 {
+		return 1
+	}
+	return o.Rounds
+}
+
+// upscales returns the sorted indexes to upscale of a grid of n images.
+func (o Options) upscales(n int) []int {
+	var indexes []int
+	for _, i := range o.Upscale {
+		if i >= 0 && i < n {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// Images returns the number of images generated by a prompt, previews
+// count as a full grid.
+func (o Options) Images() int {
+	grid := GridSize
+	if len(o.Upscale) > 0 {
+		grid = len(o.Upscale)
+	}
+	return grid + GridSize*o.rounds()*grid
+}
+
+// Prompt is a prompt to generate along with its options.
+type Prompt struct {
+	Text string `json:"text"`
+	Options
+}
+
+// NewPrompts returns the prompts using the same options.
+func NewPrompts(texts []string, o Options) []*Prompt {
+	prompts := make([]*Prompt, 0, len(texts))
+	for _, t := range texts {
+		prompts = append(prompts, &Prompt{Text: t, Options: o})
+	}
+	return prompts
+}
+
+// UnmarshalJSON accepts either a plain string or an object.
+func (p *Prompt) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*p = Prompt{}
+		return json.Unmarshal(data, &p.Text)
+	}
+	type alias Prompt
+	var a alias
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+	*p = Prompt(a)
+	return nil
+}
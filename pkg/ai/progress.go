@@ -0,0 +1,109 @@
+package ai
+
+import "time"
+
+// progressWindow is the number of images used to estimate the rate.
+const progressWindow = 16
+
+// Progress aggregates the image events of a run to compute its completion
+// and estimate when it ends. Images are counted in units, see
+// Options.Images.
+type Progress struct {
+	total int
+	done  int
+	// samples are the last completion times used for the rolling estimate
+	samples []progressSample
+}
+
+type progressSample struct {
+	at   time.Time
+	done int
+}
+
+// NewProgress returns the progress of the prompts, finished prompts are
+// already done.
+func NewProgress(prompts []*Prompt, finished []int) *Progress {
+	p := &Progress{}
+	lookup := make(map[int]bool)
+	for _, i := range finished {
+		lookup[i] = true
+	}
+	for i, prompt := range prompts {
+		p.total += prompt.Images()
+		if lookup[i] {
+			p.done += prompt.Images()
+		}
+	}
+	p.samples = append(p.samples, progressSample{at: time.Now().UTC(), done: p.done})
+	return p
+}
+
+// Add counts the image of the event, if any.
+func (p *Progress) Add(info *GenerateInfo) {
+	if info.Image == nil {
+		return
+	}
+	if info.Image.Preview {
+		p.done += GridSize
+	} else {
+		p.done++
+	}
+	at := info.Time
+	if at.IsZero() {
+		at = time.Now().UTC()
+	}
+	p.samples = append(p.samples, progressSample{at: at, done: p.done})
+	if len(p.samples) > progressWindow {
+		p.samples = p.samples[len(p.samples)-progressWindow:]
+	}
+}
+
+// Done returns the number of units done.
+func (p *Progress) Done() int {
+	return p.done
+}
+
+// Total returns the number of units of the run.
+func (p *Progress) Total() int {
+	return p.total
+}
+
+// Percentage returns the completion of the run from 0 to 100.
+func (p *Progress) Percentage() float32 {
+	if p.total == 0 {
+		return 0
+	}
+	pct := float32(p.done) * 100 / float32(p.total)
+	if pct > 100 {
+		pct = 100
+	}
+	return pct
+}
+
+// Rate returns the number of units done per second in the last images.
+func (p *Progress) Rate() float64 {
+	first := p.samples[0]
+	last := p.samples[len(p.samples)-1]
+	elapsed := last.at.Sub(first.at)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.done-first.done) / elapsed.Seconds()
+}
+
+// ETA returns when the run is estimated to end from the rate of the last
+// images, it is zero while there isn't enough data.
+func (p *Progress) ETA() time.Time {
+	first := p.samples[0]
+	last := p.samples[len(p.samples)-1]
+	if p.done >= p.total {
+		return last.at
+	}
+	units := last.done - first.done
+	elapsed := last.at.Sub(first.at)
+	if units <= 0 || elapsed <= 0 {
+		return time.Time{}
+	}
+	remaining := time.Duration(float64(elapsed) * float64(p.total-p.done) / float64(units))
+	return last.at.Add(remaining)
+}
@@ -0,0 +1,180 @@
+package ai
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Task is a prompt to be generated by the workers.
+type Task struct {
+	// Job identifies the group of prompts of the task
+	Job     string
+	Prompt  string
+	Index   int
+	Options Options
+	// Attempts is the number of failed imagine attempts
+	Attempts int
+
+	ctx context.Context
+	// started is when the worker took the task
+	started time.Time
+}
+
+// Context returns the context of the task, the task is stopped when it is
+// done.
+func (t *Task) Context() context.Context {
+	if t.ctx != nil {
+		return t.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a copy of the task using the context.
+func (t *Task) WithContext(ctx context.Context) *Task {
+	cp := *t
+	cp.ctx = ctx
+	return &cp
+}
+
+// Queue provides the tasks processed by the workers.
+type Queue interface {
+	// Next blocks until a task is ready. It returns false when there are no
+	// more tasks or the context is done.
+	Next(ctx context.Context) (*Task, bool)
+	// Imagined is called when the preview of the task is ready and its
+	// images are going to be upscaled.
+	Imagined(t *Task)
+	// Retry adds the task back to the queue to be processed after the delay.
+	Retry(t *Task, delay time.Duration, err error)
+	// Done marks the task as processed, err is the error that stopped it.
+	Done(t *Task, err error)
+	// Stop stops the job of the task, no more of its tasks are returned and
+	// err is the error reported for the job.
+	Stop(t *Task, err error)
+}
+
+// entry is a task waiting in the queue.
+type entry struct {
+	task *Task
+	// readyAt is the time after which the entry can be taken again
+	readyAt time.Time
+}
+
+// queue is an in-memory work queue shared by all the workers of a bulk run.
+// Any free worker takes the next pending entry, so an entry waiting to be
+// retried doesn't block the rest.
+type queue struct {
+	lck      sync.Mutex
+	pending  []*entry
+	inflight int
+	changed  chan struct{}
+	// err is the error that stopped the job
+	err error
+}
+
+func newQueue(tasks []*Task) *queue {
+	q := &queue{
+		changed: make(chan struct{}),
+	}
+	for _, t := range tasks {
+		q.pending = append(q.pending, &entry{task: t})
+	}
+	return q
+}
+
+// Next returns the first task that is ready to be processed.
+// It blocks while tasks are waiting to be retried or are being processed
+// by other workers, as they may be added back to the queue.
+// It returns false when the queue is drained or the context is done.
+func (q *queue) Next(ctx context.Context) (*Task, bool) {
+	for {
+		q.lck.Lock()
+		if len(q.pending) == 0 && q.inflight == 0 {
+			q.lck.Unlock()
+			return nil, false
+		}
+		now := time.Now()
+		var wait time.Duration
+		for i, e := range q.pending {
+			d := e.readyAt.Sub(now)
+			if d <= 0 {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				q.inflight++
+				q.lck.Unlock()
+				return e.task, true
+			}
+			if wait == 0 || d < wait {
+				wait = d
+			}
+		}
+		changed := q.changed
+		q.lck.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil, false
+		}
+	}
+}
+
+// Imagined does nothing, the in-memory queue doesn't track task states.
+func (q *queue) Imagined(*Task) {}
+
+// Done marks the task as processed.
+func (q *queue) Done(*Task, error) {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	q.inflight--
+	q.notify()
+}
+
+// Retry adds the task back to the queue to be processed after the delay.
+func (q *queue) Retry(t *Task, delay time.Duration, _ error) {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	t.Attempts++
+	if q.err == nil {
+		q.pending = append(q.pending, &entry{task: t, readyAt: time.Now().Add(delay)})
+	}
+	q.inflight--
+	q.notify()
+}
+
+// Stop drops the pending tasks, the in-memory queue has a single job.
+func (q *queue) Stop(_ *Task, err error) {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	if q.err == nil {
+		q.err = err
+	}
+	q.pending = nil
+	q.notify()
+}
+
+// stopped returns the error that stopped the job, if any.
+func (q *queue) stopped() error {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	return q.err
+}
+
+// notify wakes up the workers waiting for tasks, it must be called with the
+// lock held.
+func (q *queue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
@@ -0,0 +1,136 @@
+package album
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+)
+
+// FileName is the name of the file where the album state is stored.
+const FileName = "album.json"
+
+// ThumbnailDir is the directory, relative to the album, where thumbnails are
+// stored.
+const ThumbnailDir = "_thumbnails"
+
+type Album struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	Status     string    `json:"status"`
+	Percentage float32   `json:"percentage"`
+	// ETA is when the running album is estimated to finish
+	ETA     *time.Time `json:"eta,omitempty"`
+	Images  []*Image   `json:"images"`
+	Prompts []string   `json:"prompts"`
+	// Options are the generation options of each prompt
+	Options  []ai.Options `json:"options,omitempty"`
+	Finished []int        `json:"finished"`
+}
+
+type Image struct {
+	URL         string `json:"url"`
+	Prompt      string `json:"prompt"`
+	PromptIndex int    `json:"prompt_index"`
+	ImageIndex  int    `json:"image_index"`
+	// GridIndex is the index of the image in its grid
+	GridIndex int `json:"grid_index"`
+	// Variation is the variation round of the image, zero for the original
+	// grid
+	Variation int    `json:"variation,omitempty"`
+	Preview   bool   `json:"preview,omitempty"`
+	File      string `json:"file"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+
+	// Provenance of the image
+	Bot string `json:"bot,omitempty"`
+	// ResponsePrompt is the prompt returned by the bot, along with the
+	// suffixes it appends
+	ResponsePrompt string  `json:"response_prompt,omitempty"`
+	Params         *Params `json:"params,omitempty"`
+	// MessageID is the message of the grid of the image and ImageID the id
+	// of the image in the grid
+	MessageID string `json:"message_id,omitempty"`
+	ImageID   string `json:"image_id,omitempty"`
+	// Parent is the image that was varied to get the image
+	Parent       *ai.Parent `json:"parent,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	DownloadedAt *time.Time `json:"downloaded_at,omitempty"`
+}
+
+// Params are the parameters of the response prompt of an image.
+type Params struct {
+	Aspect  string   `json:"aspect,omitempty"`
+	Version string   `json:"version,omitempty"`
+	Niji    bool     `json:"niji,omitempty"`
+	Seed    *int64   `json:"seed,omitempty"`
+	Quality *float64 `json:"quality,omitempty"`
+	Stylize *int     `json:"stylize,omitempty"`
+	Chaos   *int     `json:"chaos,omitempty"`
+	Style   string   `json:"style,omitempty"`
+}
+
+// Load reads an album from its json file.
+// It returns nil if the file doesn't exist.
+func Load(path string) (*Album, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("album: couldn't read %s: %w", path, err)
+	}
+	var a Album
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, fmt.Errorf("album: couldn't unmarshal %s: %w", path, err)
+	}
+	return &a, nil
+}
+
+// Save writes the album to a temporary file and renames it, so the previous
+// state is kept if the process dies while writing.
+func (a *Album) Save(path string) error {
+	a.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return fmt.Errorf("album: couldn't marshal: %w", err)
+	}
+	return writeFile(path, data)
+}
+
+// SetImage adds the image to the album, replacing the image with the same
+// prompt and image index from a previous run.
+func (a *Album) SetImage(image *Image) {
+	for i, prev := range a.Images {
+		if prev.PromptIndex == image.PromptIndex && prev.ImageIndex == image.ImageIndex {
+			a.Images[i] = image
+			return
+		}
+	}
+	a.Images = append(a.Images, image)
+}
+
+// ThumbnailName returns the thumbnail path, relative to the album directory,
+// of the given image file. Files in subdirectories keep them in the thumbnail
+// directory.
+func ThumbnailName(file string) string {
+	name := filepath.ToSlash(file)
+	name = name[:len(name)-len(filepath.Ext(name))]
+	return fmt.Sprintf("%s/%s.jpg", ThumbnailDir, name)
+}
+
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("album: couldn't write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("album: couldn't rename %s: %w", tmp, err)
+	}
+	return nil
+}
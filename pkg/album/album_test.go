@@ -0,0 +1,73 @@
+package album
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+
+	got, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Fatalf("expected nil album, got %v", got)
+	}
+
+	want := &Album{
+		ID:       "test",
+		Status:   "running",
+		Prompts:  []string{"foo", "bar"},
+		Finished: []int{1},
+		Images: []*Image{
+			{URL: "https://foo.bar/a.png", Prompt: "bar", PromptIndex: 1, File: "a.png"},
+		},
+	}
+	if err := want.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != want.ID || len(got.Images) != 1 || got.Images[0].File != "a.png" || len(got.Finished) != 1 {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestRender(t *testing.T) {
+	a := &Album{
+		ID:       "test",
+		Prompts:  []string{"a <b> cat", "a dog", "a bird"},
+		Finished: []int{0, 2},
+		Images: []*Image{
+			{URL: "https://foo.bar/1.png", Prompt: "a <b> cat", PromptIndex: 0, File: "cat_1.png", Thumbnail: ThumbnailName("cat_1.png")},
+			{URL: "https://foo.bar/2.png", Prompt: "a dog", PromptIndex: 1},
+		},
+	}
+	var buf bytes.Buffer
+	if err := Render(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		`href="cat_1.png"`,
+		`src="_thumbnails/cat_1.jpg"`,
+		`href="https://foo.bar/2.png"`,
+		`a &lt;b&gt; cat`,
+		`id="search"`,
+		`pending`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("html doesn't contain %q", want)
+		}
+	}
+	// Finished prompts without images are hidden
+	if strings.Contains(got, "a bird") {
+		t.Error("html contains finished prompt without images")
+	}
+}
@@ -0,0 +1,148 @@
+package album
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// HTMLFileName is the name of the generated album page.
+const HTMLFileName = "index.html"
+
+type htmlGroup struct {
+	Index    int
+	Prompt   string
+	Search   string
+	Finished bool
+	Images   []htmlImage
+}
+
+type htmlImage struct {
+	Link      string
+	Thumbnail string
+}
+
+type htmlAlbum struct {
+	*Album
+	Groups []*htmlGroup
+	Total  int
+}
+
+var htmlTemplate = template.Must(template.New("album").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.ID}}</title>
+<style>
+body { margin: 0; padding: 1rem 2rem; font-family: sans-serif; background: #111; color: #eee; }
+header { display: flex; flex-wrap: wrap; align-items: baseline; gap: 1rem; }
+header h1 { margin: 0; }
+header .status { color: #999; }
+#search { flex: 1; min-width: 16rem; padding: .5rem; font-size: 1rem; border: 1px solid #444; border-radius: 4px; background: #222; color: #eee; }
+section { margin: 2rem 0; }
+section h2 { font-size: 1rem; font-weight: normal; margin: 0 0 .5rem; }
+section h2 .index { color: #999; margin-right: .5rem; }
+section h2 .pending { color: #c90; margin-left: .5rem; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(12rem, 1fr)); gap: .5rem; }
+.grid a { display: block; }
+.grid img { width: 100%; height: auto; display: block; border-radius: 4px; }
+.hidden { display: none; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.ID}}</h1>
+<span class="status">{{.Status}} · {{printf "%.0f" .Percentage}}%{{with .ETA}} · eta {{.Format "2006-01-02 15:04:05"}} UTC{{end}} · {{.Total}} images · updated {{.UpdatedAt.Format "2006-01-02 15:04:05"}} UTC</span>
+<input id="search" type="search" placeholder="Search prompts..." autofocus>
+</header>
+<main>
+{{- range .Groups}}
+<section data-prompt="{{.Search}}">
+<h2><span class="index">#{{.Index}}</span>{{.Prompt}}{{if not .Finished}}<span class="pending">pending</span>{{end}}</h2>
+<div class="grid">
+{{- range .Images}}
+<a href="{{.Link}}" target="_blank"><img src="{{.Thumbnail}}" loading="lazy" alt=""></a>
+{{- end}}
+</div>
+</section>
+{{- end}}
+</main>
+<script>
+document.getElementById("search").addEventListener("input", function (e) {
+  var words = e.target.value.toLowerCase().split(/\s+/).filter(Boolean);
+  document.querySelectorAll("section").forEach(function (s) {
+    var prompt = s.dataset.prompt;
+    var match = words.every(function (w) { return prompt.indexOf(w) !== -1; });
+    s.classList.toggle("hidden", !match);
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+// Render writes the album as a self-contained HTML page.
+// Images are grouped by prompt and linked to their full resolution files.
+func Render(w io.Writer, a *Album) error {
+	finished := make(map[int]struct{})
+	for _, i := range a.Finished {
+		finished[i] = struct{}{}
+	}
+	groups := make([]*htmlGroup, len(a.Prompts))
+	for i, p := range a.Prompts {
+		_, ok := finished[i]
+		groups[i] = &htmlGroup{
+			Index:    i,
+			Prompt:   p,
+			Search:   strings.ToLower(p),
+			Finished: ok,
+		}
+	}
+	var total int
+	for _, img := range a.Images {
+		if img.PromptIndex < 0 || img.PromptIndex >= len(groups) {
+			continue
+		}
+		link := img.URL
+		if img.File != "" {
+			link = filepath.ToSlash(img.File)
+		}
+		thumbnail := link
+		if img.Thumbnail != "" {
+			thumbnail = filepath.ToSlash(img.Thumbnail)
+		}
+		g := groups[img.PromptIndex]
+		g.Images = append(g.Images, htmlImage{
+			Link:      link,
+			Thumbnail: thumbnail,
+		})
+		total++
+	}
+
+	// Prompts without images are only shown while they are pending
+	var visible []*htmlGroup
+	for _, g := range groups {
+		if len(g.Images) == 0 && g.Finished {
+			continue
+		}
+		visible = append(visible, g)
+	}
+	return htmlTemplate.Execute(w, &htmlAlbum{
+		Album:  a,
+		Groups: visible,
+		Total:  total,
+	})
+}
+
+// WriteHTML renders the album page into the album directory.
+func (a *Album) WriteHTML(dir string) error {
+	var buf bytes.Buffer
+	if err := Render(&buf, a); err != nil {
+		return fmt.Errorf("album: couldn't render html: %w", err)
+	}
+	return writeFile(filepath.Join(dir, HTMLFileName), buf.Bytes())
+}
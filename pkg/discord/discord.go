@@ -11,15 +11,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math/big"
 	"net"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
 	http "github.com/Danny-Dasilva/fhttp"
+	"github.com/ZYKJShadow/bulkai/pkg/logging"
+	"github.com/ZYKJShadow/bulkai/pkg/metrics"
+	"github.com/ZYKJShadow/bulkai/pkg/retry"
 	"github.com/andybalholm/brotli"
 	"github.com/bwmarrin/discordgo"
 )
@@ -36,7 +40,13 @@ type Client struct {
 	session         *discordgo.Session
 	callbacks       []func(*discordgo.Event)
 	dm              map[string]string
-	debug           bool
+	log             *slog.Logger
+	rateLimitWait   *metrics.Histogram
+	retry           *retry.Policy
+	downloadRetry   *retry.Policy
+	apiURL          string
+	apiHost         string
+	noRateLimit     bool
 
 	callbackLck *sync.Mutex
 	doLck       *sync.Mutex
@@ -51,10 +61,38 @@ type Config struct {
 	Referer         string
 	HTTPClient      *http.Client
 	Dialer          func(ctx context.Context, network, addr string) (net.Conn, error)
-	Debug           bool
 	Proxy           string
+	// Logger is the logger of the client, requests are logged at debug
+	// level, slog.Default() if nil
+	Logger *slog.Logger
+	// Metrics is where the time waiting for the rate limiter is observed,
+	// metrics aren't collected if nil
+	Metrics *metrics.Registry
+	// Retry is the policy for API requests, DefaultRetryPolicy if nil
+	Retry *retry.Policy
+	// DownloadRetry is the policy for downloads, DefaultDownloadRetryPolicy
+	// if nil
+	DownloadRetry *retry.Policy
+	// APIURL is the base url of the REST API, DefaultAPIURL if empty
+	APIURL string
+	// GatewayURL is the url of the gateway websocket, DefaultGatewayURL if
+	// empty
+	GatewayURL string
+	// NoRateLimit disables the waits between requests, it is only meant to
+	// be used with local servers
+	NoRateLimit bool
 }
 
+// Default urls of the discord services
+const (
+	DefaultAPIURL     = "https://discord.com/api/v9"
+	DefaultGatewayURL = "wss://gateway.discord.gg"
+)
+
+// RateLimitBuckets are the histogram buckets, in seconds, of the time waiting
+// for the rate limiter. Requests are spaced between 2 and 3 seconds.
+var RateLimitBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
 type SuperProperties struct {
 	OS                  string      `json:"os"`
 	Browser             string      `json:"browser"`
@@ -113,11 +151,35 @@ func New(cfg *Config) (*Client, error) {
 		return nil, fmt.Errorf("discord: couldn't decode user id %s: %w", split[0], err)
 	}
 
-	session, err := newSession(cfg.Dialer, cfg.Token, cfg.UserAgent, cfg.Proxy)
+	apiURL := strings.TrimSuffix(cfg.APIURL, "/")
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("discord: couldn't parse api url %s: %w", apiURL, err)
+	}
+	gatewayURL := cfg.GatewayURL
+	if gatewayURL == "" {
+		gatewayURL = DefaultGatewayURL
+	}
+
+	session, err := newSession(cfg.Dialer, cfg.Token, cfg.UserAgent, cfg.Proxy, gatewayURL)
 	if err != nil {
 		return nil, fmt.Errorf("discord: couldn't create session: %w", err)
 	}
 
+	retryPolicy := cfg.Retry
+	if retryPolicy == nil {
+		retryPolicy = DefaultRetryPolicy()
+	}
+	downloadRetry := cfg.DownloadRetry
+	if downloadRetry == nil {
+		downloadRetry = DefaultDownloadRetryPolicy()
+	}
+
+	rateLimitWait := cfg.Metrics.Histogram("bulkai_discord_rate_limit_wait_seconds",
+		"Time waited for the discord rate limiter before each request.", RateLimitBuckets)
 	c := &Client{
 		token:           cfg.Token,
 		userID:          string(userID),
@@ -129,7 +191,13 @@ func New(cfg *Config) (*Client, error) {
 		callbacks:       []func(*discordgo.Event){},
 		session:         session,
 		dm:              make(map[string]string),
-		debug:           cfg.Debug,
+		log:             logging.OrDefault(cfg.Logger),
+		rateLimitWait:   rateLimitWait,
+		retry:           retryPolicy,
+		downloadRetry:   downloadRetry,
+		apiURL:          apiURL,
+		apiHost:         u.Host,
+		noRateLimit:     cfg.NoRateLimit,
 		callbackLck:     &sync.Mutex{},
 		doLck:           &sync.Mutex{},
 		downloadLck:     &sync.Mutex{},
@@ -157,11 +225,7 @@ func (c *Client) Start(ctx context.Context) error {
 		if !ok {
 			return
 		}
-		c.callbackLck.Lock()
-		defer c.callbackLck.Unlock()
-		for _, callback := range c.callbacks {
-			callback(evt)
-		}
+		c.Emit(evt)
 	})
 	if err := c.session.Open(); err != nil {
 		return fmt.Errorf("discord: couldn't open session: %w", err)
@@ -182,7 +246,7 @@ func (c *Client) Stop() error {
 
 func (c *Client) Do(ctx context.Context, method string, path string, body interface{}) ([]byte, error) {
 	var data []byte
-	err := retry(ctx, 3, func() error {
+	err := withRetry(ctx, c.log, c.retry, func() error {
 		b, err := c.do(method, path, body)
 		if err != nil {
 			return err
@@ -193,7 +257,8 @@ func (c *Client) Do(ctx context.Context, method string, path string, body interf
 	return data, err
 }
 
-var errBadGateway = errors.New("discord: bad gateway")
+// ErrBadGateway usually means discord is down
+var ErrBadGateway = errors.New("discord: bad gateway")
 
 type Error struct {
 	Code      int    `json:"code"`
@@ -227,22 +292,25 @@ func parseError(raw string) error {
 
 func (c *Client) do(method string, path string, body interface{}) ([]byte, error) {
 	// Rate limit
+	start := time.Now()
 	c.doLck.Lock()
+	c.rateLimitWait.Observe(time.Since(start).Seconds())
 	defer func() {
-		rnd, _ := rand.Int(rand.Reader, big.NewInt(1000))
-		ms := time.Duration(int(rnd.Int64())) * time.Millisecond
-		time.Sleep(2*time.Second + ms)
+		if !c.noRateLimit {
+			rnd, _ := rand.Int(rand.Reader, big.NewInt(1000))
+			ms := time.Duration(int(rnd.Int64())) * time.Millisecond
+			time.Sleep(2*time.Second + ms)
+		}
 		c.doLck.Unlock()
 	}()
 
 	// Create request
 	path = strings.TrimPrefix(path, "/")
-	u := fmt.Sprintf("https://discord.com/api/v9/%s", path)
+	u := fmt.Sprintf("%s/%s", c.apiURL, path)
 	var r io.Reader
 
-	logMsg := fmt.Sprintf("REQ %s\n", u)
-
 	var webkitID string
+	var reqBody []byte
 	if body != nil {
 		js, err := json.Marshal(body)
 		if err != nil {
@@ -252,7 +320,7 @@ func (c *Client) do(method string, path string, body interface{}) ([]byte, error
 			js, webkitID = webkitForm(js)
 		}
 		r = bytes.NewReader(js)
-		logMsg += fmt.Sprintf("%s\n", js)
+		reqBody = js
 	}
 	req, err := http.NewRequest(method, u, r)
 	if err != nil {
@@ -291,12 +359,12 @@ func (c *Client) do(method string, path string, body interface{}) ([]byte, error
 	if err != nil {
 		return nil, fmt.Errorf("discord: couldn't read response body: %w", err)
 	}
-	logMsg += fmt.Sprintf("%d %s", resp.StatusCode, string(data))
-	if c.debug {
-		log.Println(logMsg)
+	if c.log.Enabled(context.Background(), slog.LevelDebug) {
+		c.log.Debug("discord request", "method", method, "url", u, "body", string(reqBody),
+			"status", resp.StatusCode, "response", string(data))
 	}
 	if resp.StatusCode == http.StatusBadGateway {
-		return nil, errBadGateway
+		return nil, ErrBadGateway
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		if err := parseError(string(data)); err != nil {
@@ -308,7 +376,7 @@ func (c *Client) do(method string, path string, body interface{}) ([]byte, error
 }
 
 func (c *Client) Download(ctx context.Context, u string, output string) error {
-	return retry(ctx, 5, func() error {
+	return withRetry(ctx, c.log, c.downloadRetry, func() error {
 		return c.download(ctx, u, output)
 	})
 }
@@ -317,9 +385,11 @@ func (c *Client) download(ctx context.Context, u string, output string) error {
 	// Rate limit
 	c.downloadLck.Lock()
 	defer func() {
-		rnd, _ := rand.Int(rand.Reader, big.NewInt(1000))
-		ms := time.Duration(int(rnd.Int64())) * time.Millisecond
-		time.Sleep(1*time.Second + ms)
+		if !c.noRateLimit {
+			rnd, _ := rand.Int(rand.Reader, big.NewInt(1000))
+			ms := time.Duration(int(rnd.Int64())) * time.Millisecond
+			time.Sleep(1*time.Second + ms)
+		}
 		c.downloadLck.Unlock()
 	}()
 
@@ -353,7 +423,7 @@ func (c *Client) download(ctx context.Context, u string, output string) error {
 	}
 
 	if resp.StatusCode == http.StatusBadGateway {
-		return errBadGateway
+		return ErrBadGateway
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		respBody, err := io.ReadAll(respBody)
@@ -373,45 +443,70 @@ func (c *Client) download(ctx context.Context, u string, output string) error {
 	return nil
 }
 
-var backoff = []time.Duration{
-	10 * time.Minute,
-	30 * time.Minute,
-	60 * time.Minute,
+// DefaultRetryPolicy returns the policy used for API requests: up to 3
+// attempts, bad gateway errors wait 10, 30 and 60 minutes between attempts.
+func DefaultRetryPolicy() *retry.Policy {
+	return defaultRetryPolicy(3)
+}
+
+// DefaultDownloadRetryPolicy returns the policy used for downloads: same as
+// DefaultRetryPolicy but with up to 5 attempts.
+func DefaultDownloadRetryPolicy() *retry.Policy {
+	return defaultRetryPolicy(5)
+}
+
+func defaultRetryPolicy(maxAttempts int) *retry.Policy {
+	return &retry.Policy{
+		MaxAttempts: maxAttempts,
+		Overrides: []retry.Override{
+			{
+				Err: ErrBadGateway,
+				Policy: retry.Policy{
+					MaxAttempts: maxAttempts,
+					Base:        10 * time.Minute,
+					Factor:      3,
+					Cap:         60 * time.Minute,
+				},
+			},
+		},
+	}
 }
 
-func retry(ctx context.Context, maxAttempts int, fn func() error) error {
+func withRetry(ctx context.Context, log *slog.Logger, policy *retry.Policy, fn func() error) error {
 	attempts := 0
 	for {
 		err := fn()
 		if err == nil {
 			return nil
 		}
-		// Increase attempts and check if we should stop
 		attempts++
-		if attempts >= maxAttempts {
+		p, override := policy.Match(err)
+		// If the error is not temporary, we stop unless there is a specific
+		// policy for it
+		var discordErr Error
+		if errors.As(err, &discordErr) && !discordErr.Temporary() && !override {
 			return err
 		}
-		// If the error is not temporary, we stop
-		var discordErr Error
-		if errors.As(err, &discordErr) && !discordErr.Temporary() {
+		// Increase attempts and check if we should stop
+		wait, ok := p.Delay(attempts)
+		if !ok {
 			return err
 		}
-		// Bad gateway usually means discord is down, so we wait before retrying
-		if errors.Is(err, errBadGateway) {
-			idx := attempts - 1
-			if idx >= len(backoff) {
-				idx = len(backoff) - 1
+		if wait > 0 {
+			if errors.Is(err, ErrBadGateway) {
+				log.Warn("discord seems to be down, waiting before retrying", "wait", wait)
+			} else {
+				log.Warn("waiting before retrying", "wait", wait, "error", err)
 			}
-			wait := backoff[idx]
-			log.Printf("discord seems to be down, waiting %s before retrying\n", wait)
 			t := time.NewTimer(wait)
 			select {
 			case <-ctx.Done():
+				t.Stop()
 				return ctx.Err()
 			case <-t.C:
 			}
 		}
-		log.Println("retrying...", err)
+		log.Info("retrying", "attempt", attempts+1, "error", err)
 	}
 }
 
@@ -449,13 +544,13 @@ func (c *Client) addHeaders(req *http.Request) {
 			"sec-fetch-user":            {"?1"},
 			"upgrade-insecure-requests": {"1"},
 		}
-	case "discord.com":
+	case c.apiHost:
 		referer := "https://discord.com/channels/@me"
 		if c.Referer != "" {
 			referer = fmt.Sprintf("https://discord.com/%s", strings.TrimPrefix(c.Referer, "/"))
 		}
-		switch req.URL.Path {
-		case "/api/v9/interactions":
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/interactions"):
 			req.Header = http.Header{
 				"accept":             {"*/*"},
 				"accept-encoding":    {"gzip, deflate, br"},
@@ -0,0 +1,444 @@
+// Package discordtest provides a local stand-in of the discord gateway and
+// REST API, so discord based clients can be tested end to end.
+package discordtest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	fhttp "github.com/Danny-Dasilva/fhttp"
+	"github.com/ZYKJShadow/bulkai/pkg/discord"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+)
+
+// Credentials accepted by the server
+const (
+	UserID          = "1000000000000000001"
+	SessionID       = "discordtest-session"
+	SuperProperties = "eyJvcyI6IkxpbnV4IiwiYnJvd3NlciI6IkNocm9tZSJ9"
+)
+
+// Token is the token accepted by the server, it encodes UserID.
+var Token = base64.RawStdEncoding.EncodeToString([]byte(UserID)) + ".discordtest.token"
+
+// Interaction is an interaction received by the server.
+type Interaction struct {
+	Type      int
+	ChannelID string
+	GuildID   string
+	MessageID string
+	Nonce     string
+	// Name is the name of the command of application command interactions
+	Name string
+	// Options are the options of application command interactions
+	Options map[string]string
+	// CustomID is the custom id of component interactions
+	CustomID string
+}
+
+// Handler is called for every interaction received.
+// It must send the bot responses using the server.
+// If it returns an error, the interaction request fails: discord.Error values
+// are returned as discord API errors and anything else as an internal server
+// error.
+type Handler func(s *Server, i *Interaction) error
+
+// Config is the configuration of the server.
+type Config struct {
+	// Bots are the ids of the bots, each one has a DM channel and an imagine
+	// command
+	Bots []string
+	// Handler is called for every interaction received
+	Handler Handler
+}
+
+// Server is a local discord server.
+type Server struct {
+	server  *httptest.Server
+	bots    []string
+	handler Handler
+
+	lck   sync.Mutex
+	conns map[*websocket.Conn]*sync.Mutex
+	seq   int64
+	ids   int64
+}
+
+// NewServer starts a new server, it must be closed after use.
+func NewServer(cfg *Config) *Server {
+	s := &Server{
+		bots:    cfg.Bots,
+		handler: cfg.Handler,
+		conns:   make(map[*websocket.Conn]*sync.Mutex),
+		ids:     2000000000000000000,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gateway", s.serveGateway)
+	mux.HandleFunc("/gateway/", s.serveGateway)
+	mux.HandleFunc("/api/v9/", s.serveAPI)
+	mux.HandleFunc("/attachments/", s.serveAttachment)
+	s.server = httptest.NewServer(mux)
+	return s
+}
+
+// Close stops the server and closes all the gateway connections.
+func (s *Server) Close() {
+	s.lck.Lock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.lck.Unlock()
+	s.server.Close()
+}
+
+// Config returns a discord client configuration that connects to the server.
+func (s *Server) Config() *discord.Config {
+	return &discord.Config{
+		Token:           Token,
+		SuperProperties: SuperProperties,
+		HTTPClient:      &fhttp.Client{},
+		APIURL:          s.server.URL + "/api/v9",
+		GatewayURL:      "ws" + strings.TrimPrefix(s.server.URL, "http") + "/gateway",
+		NoRateLimit:     true,
+	}
+}
+
+// DM returns the id of the DM channel with the bot.
+func (s *Server) DM(botID string) string {
+	return "9" + botID
+}
+
+// NewID returns a new unique snowflake like id.
+func (s *Server) NewID() string {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.ids++
+	return strconv.FormatInt(s.ids, 10)
+}
+
+// Attachment returns an attachment served by the server.
+// Attachments are png images with a 2x2 grid of colors.
+func (s *Server) Attachment(name string) *discordgo.MessageAttachment {
+	return &discordgo.MessageAttachment{
+		ID:          s.NewID(),
+		Filename:    name,
+		URL:         fmt.Sprintf("%s/attachments/%s", s.server.URL, name),
+		ContentType: "image/png",
+		Width:       64,
+		Height:      64,
+	}
+}
+
+// Create sends a message create event to all the connected clients.
+// A new id is assigned to the message if it doesn't have one.
+func (s *Server) Create(msg *discord.Message) error {
+	if msg.ID == "" {
+		msg.ID = s.NewID()
+	}
+	return s.Dispatch(discord.MessageCreateEvent, msg)
+}
+
+// Update sends a message update event to all the connected clients.
+func (s *Server) Update(msg *discord.Message) error {
+	return s.Dispatch(discord.MessageUpdateEvent, msg)
+}
+
+// Dispatch sends an event to all the connected clients.
+func (s *Server) Dispatch(typ string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("discordtest: couldn't marshal event data: %w", err)
+	}
+	s.lck.Lock()
+	s.seq++
+	evt := &discordgo.Event{
+		Operation: 0,
+		Sequence:  s.seq,
+		Type:      typ,
+		RawData:   raw,
+	}
+	conns := make(map[*websocket.Conn]*sync.Mutex, len(s.conns))
+	for conn, lck := range s.conns {
+		conns[conn] = lck
+	}
+	s.lck.Unlock()
+
+	for conn, lck := range conns {
+		if err := write(conn, lck, evt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var upgrader = websocket.Upgrader{}
+
+// serveGateway implements the minimum of the gateway protocol: hello,
+// identify, ready and heartbeats.
+func (s *Server) serveGateway(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	lck := &sync.Mutex{}
+
+	// Hello
+	if err := write(conn, lck, &discordgo.Event{
+		Operation: 10,
+		RawData:   json.RawMessage(`{"heartbeat_interval":41250}`),
+	}); err != nil {
+		return
+	}
+
+	// Identify
+	var identify struct {
+		Op   int `json:"op"`
+		Data struct {
+			Token string `json:"token"`
+		} `json:"d"`
+	}
+	if err := conn.ReadJSON(&identify); err != nil {
+		return
+	}
+	if identify.Op != 2 || identify.Data.Token != Token {
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4004, "Authentication failed."))
+		return
+	}
+
+	// Ready
+	ready := &discordgo.Ready{
+		Version:   9,
+		SessionID: SessionID,
+		User:      &discordgo.User{ID: UserID, Username: "discordtest"},
+	}
+	for _, bot := range s.bots {
+		ready.PrivateChannels = append(ready.PrivateChannels, &discordgo.Channel{
+			ID:         s.DM(bot),
+			Type:       discordgo.ChannelTypeDM,
+			Recipients: []*discordgo.User{{ID: bot, Bot: true}},
+		})
+	}
+	raw, err := json.Marshal(ready)
+	if err != nil {
+		return
+	}
+	s.lck.Lock()
+	s.seq++
+	evt := &discordgo.Event{Operation: 0, Sequence: s.seq, Type: "READY", RawData: raw}
+	s.lck.Unlock()
+	if err := write(conn, lck, evt); err != nil {
+		return
+	}
+
+	s.lck.Lock()
+	s.conns[conn] = lck
+	s.lck.Unlock()
+	defer func() {
+		s.lck.Lock()
+		delete(s.conns, conn)
+		s.lck.Unlock()
+	}()
+
+	// Heartbeats
+	for {
+		var msg struct {
+			Op int `json:"op"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Op == 1 {
+			if err := write(conn, lck, &discordgo.Event{Operation: 11}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func write(conn *websocket.Conn, lck *sync.Mutex, evt *discordgo.Event) error {
+	// discordgo.Event doesn't marshal the raw data, so the payload is built
+	// manually
+	payload := struct {
+		Op   int             `json:"op"`
+		Seq  int64           `json:"s,omitempty"`
+		Type string          `json:"t,omitempty"`
+		Data json.RawMessage `json:"d,omitempty"`
+	}{
+		Op:   evt.Operation,
+		Seq:  evt.Sequence,
+		Type: evt.Type,
+		Data: evt.RawData,
+	}
+	lck.Lock()
+	defer lck.Unlock()
+	if err := conn.WriteJSON(payload); err != nil {
+		return fmt.Errorf("discordtest: couldn't write event: %w", err)
+	}
+	return nil
+}
+
+// serveAPI serves the REST endpoints used by the bot clients.
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("authorization") != Token {
+		writeError(w, http.StatusUnauthorized, &discord.Error{Code: 0, Message: "401: Unauthorized"})
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/v9/")
+	switch {
+	case r.Method == http.MethodPost && path == "interactions":
+		s.serveInteraction(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "users/") && strings.HasSuffix(path, "/profile"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "users/"), "/profile")
+		user := &discord.User{
+			User:        discordgo.User{ID: id, Bot: true},
+			Application: discord.UserApplication{ID: id},
+		}
+		writeJSON(w, user)
+	case r.Method == http.MethodGet && (strings.HasSuffix(path, "/application-command-index") || strings.HasSuffix(path, "/application-commands/search")):
+		search := &discord.ApplicationCommandSearch{}
+		for _, bot := range s.bots {
+			search.Applications = append(search.Applications, &discord.Application{ID: bot})
+			search.Commands = append(search.Commands, &discordgo.ApplicationCommand{
+				ID:            "3" + bot,
+				ApplicationID: bot,
+				Version:       "1",
+				Name:          "imagine",
+				Description:   "Create images with AI",
+			})
+		}
+		writeJSON(w, search)
+	default:
+		writeError(w, http.StatusNotFound, &discord.Error{Code: 0, Message: "404: Not Found"})
+	}
+}
+
+func (s *Server) serveInteraction(w http.ResponseWriter, r *http.Request) {
+	payload, err := payloadJSON(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, &discord.Error{Code: 50035, Message: err.Error()})
+		return
+	}
+	var req struct {
+		Type      int    `json:"type"`
+		ChannelID string `json:"channel_id"`
+		GuildID   string `json:"guild_id"`
+		MessageID string `json:"message_id"`
+		Nonce     string `json:"nonce"`
+		Data      struct {
+			Name    string `json:"name"`
+			Options []struct {
+				Name  string      `json:"name"`
+				Value interface{} `json:"value"`
+			} `json:"options"`
+			CustomID string `json:"custom_id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		writeError(w, http.StatusBadRequest, &discord.Error{Code: 50035, Message: "Invalid Form Body"})
+		return
+	}
+	i := &Interaction{
+		Type:      req.Type,
+		ChannelID: req.ChannelID,
+		GuildID:   req.GuildID,
+		MessageID: req.MessageID,
+		Nonce:     req.Nonce,
+		Name:      req.Data.Name,
+		Options:   map[string]string{},
+		CustomID:  req.Data.CustomID,
+	}
+	for _, o := range req.Data.Options {
+		i.Options[o.Name] = fmt.Sprint(o.Value)
+	}
+	if s.handler != nil {
+		if err := s.handler(s, i); err != nil {
+			var discordErr *discord.Error
+			if errors.As(err, &discordErr) {
+				writeError(w, http.StatusBadRequest, discordErr)
+				return
+			}
+			var discordErrValue discord.Error
+			if errors.As(err, &discordErrValue) {
+				writeError(w, http.StatusBadRequest, &discordErrValue)
+				return
+			}
+			log.Println("discordtest: handler error:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// payloadJSON extracts the payload_json field of the multipart body.
+func payloadJSON(r *http.Request) ([]byte, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("content-type"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type: %w", err)
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("missing payload_json")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+		if part.FormName() != "payload_json" {
+			continue
+		}
+		return io.ReadAll(part)
+	}
+}
+
+// serveAttachment serves a png with a 2x2 grid of colors derived from the
+// name.
+func (s *Server) serveAttachment(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/attachments/")
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := 0; i < 4; i++ {
+		c := color.RGBA{R: byte(len(name) * 16), G: byte(i * 64), B: byte(255 - i*64), A: 255}
+		x, y := (i%2)*32, (i/2)*32
+		for dy := 0; dy < 32; dy++ {
+			for dx := 0; dx < 32; dx++ {
+				img.SetRGBA(x+dx, y+dy, c)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "image/png")
+	_, _ = w.Write(buf.Bytes())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err *discord.Error) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(err)
+}
@@ -0,0 +1,199 @@
+package discord
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Record is an entry of an event dump.
+// Gateway events are stored with their type (e.g. MESSAGE_CREATE) and the
+// client actions with their own names (e.g. IMAGINE).
+type Record struct {
+	Time time.Time       `json:"time"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Recorder keeps the last records in memory so they can be dumped to a file
+// when something goes wrong.
+type Recorder struct {
+	lck     sync.Mutex
+	size    int
+	records []*Record
+}
+
+// NewRecorder creates a recorder that keeps the last size records.
+func NewRecorder(size int) *Recorder {
+	return &Recorder{size: size}
+}
+
+// Add adds a record, raw messages are stored as they are, errors as their
+// message and any other value is marshaled to JSON.
+func (r *Recorder) Add(typ string, v interface{}) {
+	var data json.RawMessage
+	switch v := v.(type) {
+	case json.RawMessage:
+		data = v
+	case error:
+		data, _ = json.Marshal(v.Error())
+	default:
+		js, err := json.Marshal(v)
+		if err != nil {
+			js, _ = json.Marshal(fmt.Sprint(v))
+		}
+		data = js
+	}
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	r.records = append(r.records, &Record{Time: time.Now().UTC(), Type: typ, Data: data})
+	if len(r.records) > r.size {
+		r.records = r.records[len(r.records)-r.size:]
+	}
+}
+
+// Save writes the records to a new dump file in the directory and returns
+// its path.
+func (r *Recorder) Save(dir string) (string, error) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("discord: couldn't create directory %s: %w", dir, err)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range r.records {
+		if err := enc.Encode(rec); err != nil {
+			return "", fmt.Errorf("discord: couldn't encode record: %w", err)
+		}
+	}
+	path := filepath.Join(dir, fmt.Sprintf("dump_%s.txt", time.Now().Format("20060102_150405")))
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return "", fmt.Errorf("discord: couldn't write dump %s: %w", path, err)
+	}
+	return path, nil
+}
+
+// LoadDump reads the records of a dump file.
+func LoadDump(path string) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("discord: couldn't open dump %s: %w", path, err)
+	}
+	defer f.Close()
+	return ReadDump(f)
+}
+
+// ReadDump reads the records of a dump, one JSON value per line.
+// Old dumps only have the raw data of each entry, so lines with message
+// content are read as MESSAGE_CREATE events without time and the rest are
+// read as records without type.
+func ReadDump(r io.Reader) ([]*Record, error) {
+	var records []*Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		data := make([]byte, len(line))
+		copy(data, line)
+
+		var rec Record
+		if err := json.Unmarshal(data, &rec); err == nil && rec.Type != "" && len(rec.Data) > 0 {
+			records = append(records, &rec)
+			continue
+		}
+		// Legacy line
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, fmt.Errorf("discord: couldn't parse dump line %d: %w", n, err)
+		}
+		rec = Record{Data: data}
+		if _, ok := fields["content"]; ok {
+			rec.Type = MessageCreateEvent
+		}
+		records = append(records, &rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("discord: couldn't read dump: %w", err)
+	}
+	return records, nil
+}
+
+// ReplayConfig configures how records are replayed.
+type ReplayConfig struct {
+	// Speed multiplies the original pace of the events, zero emits them
+	// without waiting
+	Speed float64
+	// Rewrite is called before each event is emitted, it can be used to
+	// replace ids such as nonces
+	Rewrite func(*Record)
+}
+
+// Replay emits the recorded gateway events through the OnEvent callbacks.
+// Client actions and other records are skipped.
+func (c *Client) Replay(ctx context.Context, records []*Record, cfg *ReplayConfig) error {
+	if cfg == nil {
+		cfg = &ReplayConfig{}
+	}
+	var last time.Time
+	for _, rec := range records {
+		if !isGatewayEvent(rec.Type) {
+			continue
+		}
+		if cfg.Speed > 0 && !last.IsZero() && rec.Time.After(last) {
+			wait := time.Duration(float64(rec.Time.Sub(last)) / cfg.Speed)
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+		}
+		if !rec.Time.IsZero() {
+			last = rec.Time
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		emitted := *rec
+		if cfg.Rewrite != nil {
+			cfg.Rewrite(&emitted)
+		}
+		c.Emit(&discordgo.Event{
+			Type:    emitted.Type,
+			RawData: emitted.Data,
+		})
+	}
+	return nil
+}
+
+// Emit sends an event to the OnEvent callbacks.
+func (c *Client) Emit(evt *discordgo.Event) {
+	c.callbackLck.Lock()
+	defer c.callbackLck.Unlock()
+	for _, callback := range c.callbacks {
+		callback(evt)
+	}
+}
+
+func isGatewayEvent(typ string) bool {
+	switch typ {
+	case InteractionCreateEvent, InteractionSuccessEvent, MessageCreateEvent, MessageUpdateEvent:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,109 @@
+package discord
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestReadDump(t *testing.T) {
+	dump := `{"time":"2023-05-02T10:00:00Z","type":"IMAGINE","data":{"type":2,"nonce":"1"}}
+{"time":"2023-05-02T10:00:02Z","type":"MESSAGE_CREATE","data":{"id":"2","content":"**a cat**","nonce":"1"}}
+
+{"id":"3","channel_id":"4","content":"**a dog**","type":0}
+{"type":3,"channel_id":"4","message_id":"3"}
+`
+	records, err := ReadDump(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"IMAGINE", MessageCreateEvent, MessageCreateEvent, ""}
+	if len(records) != len(want) {
+		t.Fatalf("expected %d records, got %d", len(want), len(records))
+	}
+	for i, r := range records {
+		if r.Type != want[i] {
+			t.Errorf("record %d: expected type %q, got %q", i, want[i], r.Type)
+		}
+	}
+	if !records[1].Time.Equal(time.Date(2023, 5, 2, 10, 0, 2, 0, time.UTC)) {
+		t.Errorf("unexpected time %s", records[1].Time)
+	}
+	if string(records[2].Data) != `{"id":"3","channel_id":"4","content":"**a dog**","type":0}` {
+		t.Errorf("unexpected legacy data %s", records[2].Data)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder(2)
+	r.Add("IMAGINE", map[string]string{"nonce": "1"})
+	r.Add(MessageCreateEvent, json.RawMessage(`{"id":"2"}`))
+	r.Add("ERR", errors.New("boom"))
+	path, err := r.Save(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := LoadDump(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if records[0].Type != MessageCreateEvent || string(records[0].Data) != `{"id":"2"}` {
+		t.Errorf("unexpected record %+v", records[0])
+	}
+	if records[1].Type != "ERR" || string(records[1].Data) != `"boom"` {
+		t.Errorf("unexpected record %+v", records[1])
+	}
+}
+
+func TestReplay(t *testing.T) {
+	c, err := New(&Config{
+		Token:           base64.RawStdEncoding.EncodeToString([]byte("1")) + ".token",
+		SuperProperties: "eyJvcyI6IkxpbnV4In0=",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	c.OnEvent(func(e *discordgo.Event) {
+		got = append(got, e.Type+" "+string(e.RawData))
+	})
+
+	start := time.Date(2023, 5, 2, 10, 0, 0, 0, time.UTC)
+	records := []*Record{
+		{Time: start, Type: "IMAGINE", Data: json.RawMessage(`{"nonce":"1"}`)},
+		{Time: start.Add(time.Second), Type: MessageCreateEvent, Data: json.RawMessage(`{"nonce":"1"}`)},
+		{Time: start.Add(3 * time.Second), Type: MessageUpdateEvent, Data: json.RawMessage(`{"id":"2"}`)},
+	}
+	now := time.Now()
+	err = c.Replay(context.Background(), records, &ReplayConfig{
+		Speed: 20,
+		Rewrite: func(r *Record) {
+			r.Data = json.RawMessage(strings.ReplaceAll(string(r.Data), `"1"`, `"5"`))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(now); elapsed < 100*time.Millisecond {
+		t.Errorf("expected replay to take at least 100ms, took %s", elapsed)
+	}
+	want := []string{
+		MessageCreateEvent + ` {"nonce":"5"}`,
+		MessageUpdateEvent + ` {"id":"2"}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected events\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+	if string(records[1].Data) != `{"nonce":"1"}` {
+		t.Errorf("records must not be modified, got %s", records[1].Data)
+	}
+}
@@ -3,6 +3,7 @@ package discord
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"io"
 	"net"
 	"net/http"
@@ -12,7 +13,7 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-func newSession(dialer func(ctx context.Context, network, addr string) (net.Conn, error), token, userAgent, proxy string) (*discordgo.Session, error) {
+func newSession(dialer func(ctx context.Context, network, addr string) (net.Conn, error), token, userAgent, proxy, gateway string) (*discordgo.Session, error) {
 	s, err := discordgo.New(token)
 	if err != nil {
 		return nil, err
@@ -32,7 +33,7 @@ func newSession(dialer func(ctx context.Context, network, addr string) (net.Conn
 	}
 
 	s.Client = &http.Client{
-		Transport: &roundTripper{},
+		Transport: &roundTripper{gateway: gateway},
 	}
 
 	s.UserAgent = userAgent
@@ -40,13 +41,14 @@ func newSession(dialer func(ctx context.Context, network, addr string) (net.Conn
 }
 
 type roundTripper struct {
+	gateway string
 }
 
 func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	var data []byte
 	switch req.URL.String() {
-	case "https://discord.com/api/v9/gateway":
-		data = []byte(`{"url": "wss://gateway.discord.gg"}`)
+	case discordgo.EndpointGateway:
+		data, _ = json.Marshal(map[string]string{"url": r.gateway})
 	default:
 		data = []byte{}
 	}
@@ -0,0 +1,225 @@
+// Package filename renders the names of the generated files from a template.
+//
+// Templates use `{name}` or `{name:spec}` variables:
+//
+//	{album}       album name, spec is the max number of characters
+//	{slug}        sanitized prompt, spec is the max number of characters (50)
+//	{prompt}      prompt index, alias {index}, spec like 05 pads with zeros
+//	{image}       image index
+//	{grid}        index of the image in its grid
+//	{variation}   variation round, zero for the original grid
+//	{hash}        sha256 of the file content, {hash8} or {hash:8} takes the
+//	              first characters
+//	{ext}         file extension without the dot
+//
+// Names can include slashes to store the files in subdirectories, e.g.
+// `{prompt:05}/{image:02}_{slug}.{ext}` stores the files of each prompt in
+// their own directory.
+package filename
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Default is the template of the names used when none is configured.
+const Default = "{slug}_{prompt:05}_{image:02}.{ext}"
+
+// SlugLength is the default max number of characters of the slug.
+const SlugLength = 50
+
+// Values are the values of the template variables.
+type Values struct {
+	Album       string
+	Prompt      string
+	PromptIndex int
+	ImageIndex  int
+	GridIndex   int
+	Variation   int
+	Hash        string
+	// Ext is the file extension, with or without the dot
+	Ext string
+}
+
+type part struct {
+	literal string
+	name    string
+	// width is the padding of numbers or the max length of strings
+	width int
+	zero  bool
+}
+
+// Template is a parsed file name template.
+type Template struct {
+	parts []part
+	hash  bool
+}
+
+var variableRegex = regexp.MustCompile(`\{([a-z]+)(\d*)(?::(\d+))?\}`)
+
+var slashesRegex = regexp.MustCompile(`/+`)
+
+// Parse parses a template, an empty one uses the default template.
+func Parse(s string) (*Template, error) {
+	if s == "" {
+		s = Default
+	}
+	t := &Template{}
+	last := 0
+	ext := false
+	for _, m := range variableRegex.FindAllStringSubmatchIndex(s, -1) {
+		if m[0] > last {
+			t.parts = append(t.parts, part{literal: s[last:m[0]]})
+		}
+		last = m[1]
+		name := s[m[2]:m[3]]
+		suffix := s[m[4]:m[5]]
+		var spec string
+		if m[6] >= 0 {
+			spec = s[m[6]:m[7]]
+		}
+		p := part{name: name}
+		switch name {
+		case "index":
+			p.name = "prompt"
+		case "album", "slug", "prompt", "image", "grid", "variation", "ext":
+		case "hash":
+			t.hash = true
+			// {hash8} is the same as {hash:8}
+			if suffix != "" {
+				if spec != "" {
+					return nil, fmt.Errorf("filename: invalid variable %s", s[m[0]:m[1]])
+				}
+				spec = suffix
+				suffix = ""
+			}
+		default:
+			return nil, fmt.Errorf("filename: unknown variable %s", s[m[0]:m[1]])
+		}
+		if suffix != "" {
+			return nil, fmt.Errorf("filename: unknown variable %s", s[m[0]:m[1]])
+		}
+		if name == "ext" {
+			ext = true
+		}
+		if spec != "" {
+			p.width, _ = strconv.Atoi(spec)
+			p.zero = strings.HasPrefix(spec, "0")
+		}
+		t.parts = append(t.parts, p)
+	}
+	if last < len(s) {
+		t.parts = append(t.parts, part{literal: s[last:]})
+	}
+	for _, p := range t.parts {
+		if strings.ContainsAny(p.literal, "{}") {
+			return nil, fmt.Errorf("filename: invalid template %q", s)
+		}
+	}
+	if !ext {
+		return nil, fmt.Errorf("filename: template %q must contain {ext}", s)
+	}
+	if strings.HasPrefix(s, "/") || strings.Contains(s, "..") {
+		return nil, fmt.Errorf("filename: template %q must be relative to the album", s)
+	}
+	return t, nil
+}
+
+// NeedsHash reports whether the template uses the content hash.
+func (t *Template) NeedsHash() bool {
+	return t.hash
+}
+
+// Execute returns the file name of the values, relative to the album
+// directory and using slashes.
+func (t *Template) Execute(v *Values) (string, error) {
+	var sb strings.Builder
+	for _, p := range t.parts {
+		if p.name == "" {
+			sb.WriteString(p.literal)
+			continue
+		}
+		switch p.name {
+		case "album":
+			sb.WriteString(truncate(Slug(v.Album, 0), p.width))
+		case "slug":
+			width := p.width
+			if width == 0 {
+				width = SlugLength
+			}
+			sb.WriteString(Slug(v.Prompt, width))
+		case "prompt":
+			sb.WriteString(number(v.PromptIndex, p))
+		case "image":
+			sb.WriteString(number(v.ImageIndex, p))
+		case "grid":
+			sb.WriteString(number(v.GridIndex, p))
+		case "variation":
+			sb.WriteString(number(v.Variation, p))
+		case "hash":
+			if v.Hash == "" {
+				return "", errors.New("filename: missing content hash")
+			}
+			sb.WriteString(truncate(v.Hash, p.width))
+		case "ext":
+			sb.WriteString(strings.TrimPrefix(v.Ext, "."))
+		}
+	}
+	name := sb.String()
+	// Empty variables can leave empty path elements
+	name = strings.Trim(slashesRegex.ReplaceAllString(name, "/"), "/")
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("filename: invalid file name %q", name)
+	}
+	return name, nil
+}
+
+func number(n int, p part) string {
+	if p.zero {
+		return fmt.Sprintf("%0*d", p.width, n)
+	}
+	return strconv.Itoa(n)
+}
+
+// truncate returns the first n characters of s, without cutting runes.
+// Zero means no limit.
+func truncate(s string, n int) string {
+	if n <= 0 {
+		return s
+	}
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+var nonAlphanumericRegex = regexp.MustCompile(`[^\p{L}\p{N} _]+`)
+
+// Slug returns the prompt as a file name: urls are removed, spaces are
+// replaced by underscores and only letters and numbers are kept.
+// It is truncated to max characters, zero means no limit.
+func Slug(prompt string, max int) string {
+	var filtered []string
+	for _, s := range strings.Split(prompt, " ") {
+		if u, err := url.Parse(s); err == nil && u.Scheme != "" {
+			continue
+		}
+		if len(s) == 0 {
+			continue
+		}
+		filtered = append(filtered, s)
+	}
+	str := strings.Join(filtered, "_")
+
+	str = nonAlphanumericRegex.ReplaceAllString(str, "")
+	str = strings.ReplaceAll(str, " ", "_")
+	return truncate(str, max)
+}
@@ -0,0 +1,86 @@
+package filename
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExecute(t *testing.T) {
+	v := &Values{
+		Album:       "my album",
+		Prompt:      "https://foo.bar/a.png a cat, on the moon --ar 3:2",
+		PromptIndex: 3,
+		ImageIndex:  5,
+		GridIndex:   1,
+		Variation:   2,
+		Hash:        "0123456789abcdef",
+		Ext:         ".png",
+	}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"", "a_cat_on_the_moon_ar_32_00003_05.png"},
+		{"{album}/{index:05}_{grid}_{slug}_{hash8}.{ext}", "my_album/00003_1_a_cat_on_the_moon_ar_32_01234567.png"},
+		{"{prompt:03}/{image:02}_{variation}_{hash:4}.{ext}", "003/05_2_0123.png"},
+		{"{slug:5}_{hash}.{ext}", "a_cat_0123456789abcdef.png"},
+	}
+	for _, tt := range tests {
+		tmpl, err := Parse(tt.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := tmpl.Execute(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.template, tt.want, got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{
+		"{slug}.png",
+		"{foo}.{ext}",
+		"{image2}.{ext}",
+		"{hash8:4}.{ext}",
+		"{slug.{ext}",
+		"/tmp/{slug}.{ext}",
+		"../{slug}.{ext}",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+	tmpl, err := Parse("{slug}.{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.NeedsHash() {
+		t.Error("expected template without hash")
+	}
+	if _, err := tmpl.Execute(&Values{Ext: "png"}); err != nil {
+		t.Error(err)
+	}
+	tmpl, err = Parse("{slug}/{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Execute(&Values{}); err == nil {
+		t.Error("expected error for an empty name")
+	}
+}
+
+func TestSlug(t *testing.T) {
+	// Truncation doesn't cut runes
+	prompt := strings.Repeat("猫", 60)
+	got := Slug(prompt, SlugLength)
+	if got != strings.Repeat("猫", SlugLength) {
+		t.Errorf("unexpected slug %q", got)
+	}
+	if got := Slug("a  <b>  cat http://x.y/z.png", 0); got != "a_b_cat" {
+		t.Errorf("unexpected slug %q", got)
+	}
+}
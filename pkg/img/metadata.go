@@ -0,0 +1,516 @@
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupportedFormat is returned when metadata can't be embedded in or
+// read from a file format.
+var ErrUnsupportedFormat = errors.New("img: unsupported format")
+
+// Software is the value of the software field of the embedded metadata.
+const Software = "bulkai"
+
+// Metadata is the generation info embedded in the image files.
+type Metadata struct {
+	Prompt         string `json:"prompt,omitempty"`
+	ResponsePrompt string `json:"response_prompt,omitempty"`
+	Bot            string `json:"bot,omitempty"`
+	Seed           *int64 `json:"seed,omitempty"`
+	Album          string `json:"album,omitempty"`
+	// URL is the source url of the image
+	URL string `json:"url,omitempty"`
+}
+
+// fields returns the metadata as key value pairs, empty values are skipped.
+func (m *Metadata) fields() [][2]string {
+	var fields [][2]string
+	add := func(k, v string) {
+		if v != "" {
+			fields = append(fields, [2]string{k, v})
+		}
+	}
+	add("Prompt", m.Prompt)
+	add("Response Prompt", m.ResponsePrompt)
+	add("Bot", m.Bot)
+	if m.Seed != nil {
+		add("Seed", strconv.FormatInt(*m.Seed, 10))
+	}
+	add("Album", m.Album)
+	add("Source", m.URL)
+	add("Software", Software)
+	return fields
+}
+
+// set sets a field by its key, unknown keys are ignored.
+func (m *Metadata) set(k, v string) {
+	switch k {
+	case "Prompt":
+		m.Prompt = v
+	case "Response Prompt":
+		m.ResponsePrompt = v
+	case "Bot":
+		m.Bot = v
+	case "Seed":
+		if seed, err := strconv.ParseInt(v, 10, 64); err == nil {
+			m.Seed = &seed
+		}
+	case "Album":
+		m.Album = v
+	case "Source":
+		m.URL = v
+	}
+}
+
+// WriteMetadata embeds the metadata in a PNG or JPEG file, replacing the
+// metadata written previously. The format is detected from the content.
+func WriteMetadata(path string, m *Metadata) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("img: couldn't read file %s: %w", path, err)
+	}
+	data, err = EmbedMetadata(data, m)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("img: couldn't write file %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("img: couldn't rename %s: %w", tmp, err)
+	}
+	return nil
+}
+
+// ReadMetadata reads the metadata embedded in a PNG or JPEG file.
+// It returns nil if the file has no metadata.
+func ReadMetadata(path string) (*Metadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("img: couldn't read file %s: %w", path, err)
+	}
+	return ExtractMetadata(data)
+}
+
+// EmbedMetadata returns the image with the metadata embedded.
+// PNG images get a tEXt chunk per field, or an iTXt chunk if the value
+// isn't latin-1. JPEG images get EXIF and XMP segments.
+func EmbedMetadata(data []byte, m *Metadata) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return embedPNG(data, m)
+	case bytes.HasPrefix(data, jpegSOI):
+		return embedJPEG(data, m)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// ExtractMetadata returns the metadata embedded in the image, or nil if it
+// has none.
+func ExtractMetadata(data []byte) (*Metadata, error) {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return extractPNG(data)
+	case bytes.HasPrefix(data, jpegSOI):
+		return extractJPEG(data)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngChunks calls fn for each chunk of the PNG, with the offsets of the
+// chunk start and end.
+func pngChunks(data []byte, fn func(typ string, body []byte, start, end int) error) error {
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return errors.New("img: truncated png chunk")
+		}
+		n := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + n
+		if n < 0 || end > len(data) {
+			return errors.New("img: truncated png chunk")
+		}
+		if err := fn(string(data[pos+4:pos+8]), data[pos+8:pos+8+n], pos, end); err != nil {
+			return err
+		}
+		pos = end
+	}
+	return nil
+}
+
+func pngChunk(typ string, body []byte) []byte {
+	chunk := make([]byte, 8, 12+len(body))
+	binary.BigEndian.PutUint32(chunk, uint32(len(body)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, body...)
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(chunk[4:])
+	return binary.BigEndian.AppendUint32(chunk, crc.Sum32())
+}
+
+// textChunk parses a tEXt or iTXt chunk.
+func textChunk(typ string, body []byte) (string, string, bool) {
+	key, rest, ok := bytes.Cut(body, []byte{0})
+	if !ok {
+		return "", "", false
+	}
+	switch typ {
+	case "tEXt":
+		// Latin-1 to UTF-8
+		runes := make([]rune, len(rest))
+		for i, b := range rest {
+			runes[i] = rune(b)
+		}
+		return string(key), string(runes), true
+	case "iTXt":
+		// Compression flag, compression method, language and translated
+		// keyword
+		if len(rest) < 2 || rest[0] != 0 {
+			return "", "", false
+		}
+		rest = rest[2:]
+		for i := 0; i < 2; i++ {
+			if _, rest, ok = bytes.Cut(rest, []byte{0}); !ok {
+				return "", "", false
+			}
+		}
+		return string(key), string(rest), true
+	default:
+		return "", "", false
+	}
+}
+
+func embedPNG(data []byte, m *Metadata) ([]byte, error) {
+	var chunks [][]byte
+	for _, f := range m.fields() {
+		body := []byte(f[0] + "\x00")
+		if latin1, ok := toLatin1(f[1]); ok {
+			chunks = append(chunks, pngChunk("tEXt", append(body, latin1...)))
+			continue
+		}
+		body = append(body, 0, 0, 0, 0)
+		chunks = append(chunks, pngChunk("iTXt", append(body, f[1]...)))
+	}
+
+	out := make([]byte, 0, len(data)+1024)
+	out = append(out, pngSignature...)
+	if err := pngChunks(data, func(typ string, body []byte, start, end int) error {
+		// Previous metadata is replaced
+		if k, _, ok := textChunk(typ, body); ok {
+			if _, ok := xmpKeys[k]; ok {
+				return nil
+			}
+		}
+		out = append(out, data[start:end]...)
+		if typ == "IHDR" {
+			for _, c := range chunks {
+				out = append(out, c...)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func extractPNG(data []byte) (*Metadata, error) {
+	var m *Metadata
+	if err := pngChunks(data, func(typ string, body []byte, _, _ int) error {
+		k, v, ok := textChunk(typ, body)
+		if !ok {
+			return nil
+		}
+		if m == nil {
+			m = &Metadata{}
+		}
+		m.set(k, v)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if m != nil && *m == (Metadata{}) {
+		return nil, nil
+	}
+	return m, nil
+}
+
+func toLatin1(s string) ([]byte, bool) {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			return nil, false
+		}
+		b = append(b, byte(r))
+	}
+	return b, true
+}
+
+var (
+	jpegSOI    = []byte{0xff, 0xd8}
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// jpegSegments calls fn for each segment before the image data, with the
+// offsets of the segment start and end. It returns the offset of the image
+// data.
+func jpegSegments(data []byte, fn func(marker byte, body []byte, start, end int)) (int, error) {
+	pos := len(jpegSOI)
+	for {
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return 0, errors.New("img: invalid jpeg segment")
+		}
+		marker := data[pos+1]
+		// Start of scan, the image data follows
+		if marker == 0xda {
+			return pos, nil
+		}
+		n := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + n
+		if n < 2 || end > len(data) {
+			return 0, errors.New("img: truncated jpeg segment")
+		}
+		fn(marker, data[pos+4:end], pos, end)
+		pos = end
+	}
+}
+
+func jpegSegment(marker byte, body []byte) ([]byte, error) {
+	if len(body)+2 > 0xffff {
+		return nil, errors.New("img: metadata too large for a jpeg segment")
+	}
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(body)+2))
+	return append(seg, body...), nil
+}
+
+func embedJPEG(data []byte, m *Metadata) ([]byte, error) {
+	exif, err := jpegSegment(0xe1, append(append([]byte{}, exifHeader...), exifTIFF(m)...))
+	if err != nil {
+		return nil, err
+	}
+	xmp, err := jpegSegment(0xe1, append(append([]byte{}, xmpHeader...), xmpPacket(m)...))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(data)+len(exif)+len(xmp))
+	out = append(out, jpegSOI...)
+	inserted := false
+	insert := func() {
+		if !inserted {
+			out = append(out, exif...)
+			out = append(out, xmp...)
+			inserted = true
+		}
+	}
+	sos, err := jpegSegments(data, func(marker byte, body []byte, start, end int) {
+		// Previous metadata is replaced
+		if marker == 0xe1 && (bytes.HasPrefix(body, exifHeader) || bytes.HasPrefix(body, xmpHeader)) {
+			return
+		}
+		// The JFIF segment must stay first
+		if marker != 0xe0 {
+			insert()
+		}
+		out = append(out, data[start:end]...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	insert()
+	return append(out, data[sos:]...), nil
+}
+
+func extractJPEG(data []byte) (*Metadata, error) {
+	var m *Metadata
+	var description string
+	if _, err := jpegSegments(data, func(marker byte, body []byte, _, _ int) {
+		if marker != 0xe1 {
+			return
+		}
+		switch {
+		case bytes.HasPrefix(body, xmpHeader):
+			m = parseXMP(body[len(xmpHeader):])
+		case bytes.HasPrefix(body, exifHeader):
+			description = exifDescription(body[len(exifHeader):])
+		}
+	}); err != nil {
+		return nil, err
+	}
+	// Files only with EXIF get the prompt from the image description
+	if m == nil && description != "" {
+		m = &Metadata{Prompt: description}
+	}
+	return m, nil
+}
+
+const (
+	tagImageDescription = 0x010e
+	tagSoftware         = 0x0131
+	typeASCII           = 2
+)
+
+// exifTIFF returns a little endian TIFF structure with an IFD with the
+// prompt as image description and the software.
+func exifTIFF(m *Metadata) []byte {
+	type entry struct {
+		tag   uint16
+		value []byte
+	}
+	var entries []entry
+	if m.Prompt != "" {
+		entries = append(entries, entry{tagImageDescription, append([]byte(m.Prompt), 0)})
+	}
+	entries = append(entries, entry{tagSoftware, append([]byte(Software), 0)})
+
+	le := binary.LittleEndian
+	ifdSize := 2 + 12*len(entries) + 4
+	buf := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	buf = le.AppendUint16(buf, uint16(len(entries)))
+	offset := 8 + ifdSize
+	var values []byte
+	for _, e := range entries {
+		buf = le.AppendUint16(buf, e.tag)
+		buf = le.AppendUint16(buf, typeASCII)
+		buf = le.AppendUint32(buf, uint32(len(e.value)))
+		if len(e.value) <= 4 {
+			v := make([]byte, 4)
+			copy(v, e.value)
+			buf = append(buf, v...)
+			continue
+		}
+		buf = le.AppendUint32(buf, uint32(offset+len(values)))
+		values = append(values, e.value...)
+		if len(values)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	// No next IFD
+	buf = le.AppendUint32(buf, 0)
+	return append(buf, values...)
+}
+
+// exifDescription returns the image description of the first IFD of the
+// TIFF structure.
+func exifDescription(tiff []byte) string {
+	if len(tiff) < 8 {
+		return ""
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return ""
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return ""
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		e := ifd + 2 + 12*i
+		if e+12 > len(tiff) {
+			return ""
+		}
+		if order.Uint16(tiff[e:]) != tagImageDescription || order.Uint16(tiff[e+2:]) != typeASCII {
+			continue
+		}
+		count := int(order.Uint32(tiff[e+4:]))
+		value := tiff[e+8 : e+12]
+		if count > 4 {
+			off := int(order.Uint32(tiff[e+8:]))
+			if off < 0 || off+count > len(tiff) {
+				return ""
+			}
+			value = tiff[off : off+count]
+		} else {
+			value = value[:count]
+		}
+		return strings.TrimRight(string(value), "\x00")
+	}
+	return ""
+}
+
+// xmpNamespace is the namespace of the bulkai XMP properties.
+const xmpNamespace = "https://github.com/ZYKJShadow/bulkai/ns/1.0/"
+
+// xmpKeys maps the metadata keys to the XMP properties, its keys are also
+// the PNG text chunks replaced when embedding metadata.
+var xmpKeys = map[string]string{
+	"Prompt":          "prompt",
+	"Response Prompt": "responsePrompt",
+	"Bot":             "bot",
+	"Seed":            "seed",
+	"Album":           "album",
+	"Source":          "source",
+	"Software":        "software",
+}
+
+func xmpPacket(m *Metadata) []byte {
+	var b bytes.Buffer
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/">` + "\n")
+	b.WriteString(` <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` + "\n")
+	b.WriteString(`  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:bulkai="` + xmpNamespace + `"`)
+	for _, f := range m.fields() {
+		b.WriteString("\n   bulkai:" + xmpKeys[f[0]] + `="`)
+		_ = xml.EscapeText(&b, []byte(f[1]))
+		b.WriteString(`"`)
+	}
+	b.WriteString(">\n")
+	if m.Prompt != "" {
+		b.WriteString(`   <dc:description><rdf:Alt><rdf:li xml:lang="x-default">`)
+		_ = xml.EscapeText(&b, []byte(m.Prompt))
+		b.WriteString("</rdf:li></rdf:Alt></dc:description>\n")
+	}
+	b.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>")
+	return b.Bytes()
+}
+
+func parseXMP(data []byte) *Metadata {
+	keys := make(map[string]string)
+	for k, v := range xmpKeys {
+		keys[v] = k
+	}
+	var m *Metadata
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return m
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok || el.Name.Local != "Description" {
+			continue
+		}
+		for _, attr := range el.Attr {
+			if attr.Name.Space != xmpNamespace {
+				continue
+			}
+			if k, ok := keys[attr.Name.Local]; ok {
+				if m == nil {
+					m = &Metadata{}
+				}
+				m.set(k, attr.Value)
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package img
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	m.Set(1, 1, color.RGBA{R: 255, A: 255})
+	var pngData, jpegData bytes.Buffer
+	if err := png.Encode(&pngData, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&jpegData, m, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	seed := int64(42)
+	want := &Metadata{
+		Prompt:         "a cute cat & a \"dog\" 可爱",
+		ResponsePrompt: "a cute cat --v 5.2",
+		Bot:            "midjourney",
+		Seed:           &seed,
+		Album:          "animals",
+		URL:            "https://example.com/cat.png?a=1&b=2",
+	}
+	tests := []struct {
+		name   string
+		data   []byte
+		decode func(io.Reader) (image.Image, error)
+	}{
+		{"png", pngData.Bytes(), png.Decode},
+		{"jpeg", jpegData.Bytes(), jpeg.Decode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExtractMetadata(tt.data)
+			if err != nil || got != nil {
+				t.Fatalf("expected no metadata, got %+v, %v", got, err)
+			}
+			data, err := EmbedMetadata(tt.data, &Metadata{Prompt: "old"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Embedding again replaces the previous metadata
+			data, err = EmbedMetadata(data, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tt.decode(bytes.NewReader(data)); err != nil {
+				t.Fatalf("couldn't decode image: %v", err)
+			}
+			got, err = ExtractMetadata(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %+v, got %+v", want, got)
+			}
+			if n := bytes.Count(data, []byte("old")); n != 0 {
+				t.Errorf("expected previous metadata to be removed, found %d", n)
+			}
+		})
+	}
+
+	if _, err := EmbedMetadata([]byte("RIFF0000WEBP"), want); err != ErrUnsupportedFormat {
+		t.Errorf("expected unsupported format, got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+// Package logging creates the structured loggers shared by all the packages.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Redacted replaces the sensitive values in the logs.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are the parts of the attribute keys whose values are
+// redacted.
+var sensitiveKeys = []string{"token", "cookie", "secret", "password", "authorization"}
+
+// minSecretLength is the minimum length of the secret values redacted from
+// the logs, shorter values would redact unrelated text.
+const minSecretLength = 4
+
+// Config is the configuration of a logger.
+type Config struct {
+	// Level is debug, info, warn or error, info if empty
+	Level string
+	// Format is text or json, text if empty
+	Format string
+	// Secrets are values redacted from the messages and the attributes
+	Secrets []string
+}
+
+// New returns a logger that writes to w.
+func New(w io.Writer, cfg *Config) (*slog.Logger, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	var secrets []string
+	for _, s := range cfg.Secrets {
+		if len(s) >= minSecretLength {
+			secrets = append(secrets, s)
+		}
+	}
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			return redact(a, secrets)
+		},
+	}
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("logging: invalid format %q", cfg.Format)
+	}
+}
+
+// ParseLevel returns the level of the given name, info if empty.
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("logging: invalid level %q", s)
+	}
+	return level, nil
+}
+
+// Discard returns a logger that drops everything.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
+
+// OrDefault returns the logger, or the default one if it is nil.
+func OrDefault(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
+
+// IsSensitive reports whether the values of the attribute key must be
+// redacted.
+func IsSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range sensitiveKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func redact(a slog.Attr, secrets []string) slog.Attr {
+	if IsSensitive(a.Key) {
+		if a.Value.Kind() == slog.KindString && a.Value.String() == "" {
+			return a
+		}
+		return slog.String(a.Key, Redacted)
+	}
+	if len(secrets) == 0 {
+		return a
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, replace(a.Value.String(), secrets))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, replace(err.Error(), secrets))
+		}
+		if s, ok := a.Value.Any().(fmt.Stringer); ok {
+			return slog.String(a.Key, replace(s.String(), secrets))
+		}
+	}
+	return a
+}
+
+func replace(s string, secrets []string) string {
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+	return s
+}
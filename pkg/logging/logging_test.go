@@ -0,0 +1,71 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := New(&buf, &Config{
+		Level:   "debug",
+		Format:  "json",
+		Secrets: []string{"s3cr3t-token", "ab"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Debug("connecting with s3cr3t-token",
+		"token", "foo",
+		"Cookie", "bar",
+		"webhook_secret", "",
+		"error", errors.New("invalid s3cr3t-token"),
+		"bot", "ab",
+	)
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"level":          "DEBUG",
+		"msg":            "connecting with " + Redacted,
+		"token":          Redacted,
+		"Cookie":         Redacted,
+		"webhook_secret": "",
+		"error":          "invalid " + Redacted,
+		"bot":            "ab",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, got[k])
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := New(&buf, &Config{Level: "warn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Info("hidden")
+	log.With("bot", "midjourney").Warn("shown", "prompt", 3)
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Errorf("unexpected info message in %q", out)
+	}
+	if !strings.Contains(out, "level=WARN msg=shown bot=midjourney prompt=3") {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	if _, err := New(&buf, &Config{Level: "verbose"}); err == nil {
+		t.Error("expected error for invalid level")
+	}
+	if _, err := New(&buf, &Config{Format: "xml"}); err == nil {
+		t.Error("expected error for invalid format")
+	}
+}
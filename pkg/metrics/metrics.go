@@ -0,0 +1,304 @@
+// Package metrics collects counters, gauges and histograms and exposes them
+// in the Prometheus text format.
+//
+// Metrics created from a nil registry are nil and their methods do nothing,
+// so packages can be instrumented without requiring a registry.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DurationBuckets are the default histogram buckets for durations in
+// seconds, from a second to twenty minutes.
+var DurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200}
+
+type kind string
+
+const (
+	counterKind   kind = "counter"
+	gaugeKind     kind = "gauge"
+	histogramKind kind = "histogram"
+)
+
+// Registry holds the metrics exposed by a handler.
+type Registry struct {
+	lck      sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Counter returns the counter of the given name, it is created if it
+// doesn't exist. Its values are distinguished by the given labels.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	f := r.family(name, help, counterKind, labels, nil)
+	if f == nil {
+		return nil
+	}
+	return &Counter{f: f}
+}
+
+// Gauge returns the gauge of the given name, it is created if it doesn't
+// exist. Its values are distinguished by the given labels.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	f := r.family(name, help, gaugeKind, labels, nil)
+	if f == nil {
+		return nil
+	}
+	return &Gauge{f: f}
+}
+
+// Histogram returns the histogram of the given name with the upper bounds
+// of its buckets, it is created if it doesn't exist. Its values are
+// distinguished by the given labels.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	f := r.family(name, help, histogramKind, labels, buckets)
+	if f == nil {
+		return nil
+	}
+	return &Histogram{f: f}
+}
+
+func (r *Registry) family(name, help string, k kind, labels []string, buckets []float64) *family {
+	if r == nil {
+		return nil
+	}
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.kind != k || len(f.labels) != len(labels) {
+			panic(fmt.Sprintf("metrics: %s registered with a different type or labels", name))
+		}
+		return f
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    k,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+// Write writes the metrics in the text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.lck.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	families := make([]*family, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		families = append(families, r.families[name])
+	}
+	r.lck.Unlock()
+
+	var sb strings.Builder
+	for _, f := range families {
+		f.write(&sb)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// ServeHTTP writes the metrics to the response.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_ = r.Write(w)
+}
+
+// Counter is a value that only increases.
+type Counter struct {
+	f *family
+}
+
+// Inc adds one to the counter of the label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v, that must be positive, to the counter of the label values.
+func (c *Counter) Add(v float64, values ...string) {
+	if c == nil || v < 0 {
+		return
+	}
+	c.f.update(values, func(s *series) { s.value += v })
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	f *family
+}
+
+// Set sets the gauge of the label values.
+func (g *Gauge) Set(v float64, values ...string) {
+	if g == nil {
+		return
+	}
+	g.f.update(values, func(s *series) { s.value = v })
+}
+
+// Add adds v to the gauge of the label values.
+func (g *Gauge) Add(v float64, values ...string) {
+	if g == nil {
+		return
+	}
+	g.f.update(values, func(s *series) { s.value += v })
+}
+
+// Inc adds one to the gauge of the label values.
+func (g *Gauge) Inc(values ...string) {
+	g.Add(1, values...)
+}
+
+// Dec subtracts one from the gauge of the label values.
+func (g *Gauge) Dec(values ...string) {
+	g.Add(-1, values...)
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	f *family
+}
+
+// Observe adds an observation to the histogram of the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	if h == nil {
+		return
+	}
+	h.f.update(values, func(s *series) {
+		if s.counts == nil {
+			s.counts = make([]uint64, len(h.f.buckets))
+		}
+		for i, b := range h.f.buckets {
+			if v <= b {
+				s.counts[i]++
+			}
+		}
+		s.count++
+		s.value += v
+	})
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+
+	lck    sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	// value is the sum of the observations of histograms
+	value float64
+	// counts are the cumulative bucket counts of histograms
+	counts []uint64
+	count  uint64
+}
+
+func (f *family) update(values []string, fn func(*series)) {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.lck.Lock()
+	defer f.lck.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+func (f *family) write(sb *strings.Builder) {
+	f.lck.Lock()
+	defer f.lck.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n", f.name, escape(f.help, false))
+	fmt.Fprintf(sb, "# TYPE %s %s\n", f.name, f.kind)
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.kind != histogramKind {
+			fmt.Fprintf(sb, "%s%s %s\n", f.name, f.labelPairs(s.values, "", 0), formatFloat(s.value))
+			continue
+		}
+		for i, b := range f.buckets {
+			var n uint64
+			if s.counts != nil {
+				n = s.counts[i]
+			}
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", f.name, f.labelPairs(s.values, "le", b), n)
+		}
+		fmt.Fprintf(sb, "%s_bucket%s %d\n", f.name, f.labelPairs(s.values, "le", math.Inf(1)), s.count)
+		fmt.Fprintf(sb, "%s_sum%s %s\n", f.name, f.labelPairs(s.values, "", 0), formatFloat(s.value))
+		fmt.Fprintf(sb, "%s_count%s %d\n", f.name, f.labelPairs(s.values, "", 0), s.count)
+	}
+}
+
+// labelPairs returns the labels of the series, along with an extra label
+// if its name isn't empty.
+func (f *family) labelPairs(values []string, extra string, extraValue float64) string {
+	var pairs []string
+	for i, l := range f.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", l, escape(values[i], true)))
+	}
+	if extra != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra, formatFloat(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escape escapes the backslashes and line feeds of help texts, and also the
+// double quotes of label values.
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
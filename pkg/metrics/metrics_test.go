@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	errs := r.Counter("test_errors_total", "Errors by class.", "class")
+	errs.Inc("queue-full")
+	errs.Add(2, `say "hi"`)
+	errs.Inc("queue-full")
+	inflight := r.Gauge("test_inflight", "Tasks being processed.")
+	inflight.Inc()
+	inflight.Inc()
+	inflight.Dec()
+	latency := r.Histogram("test_duration_seconds", "Job duration.", []float64{10, 1}, "job")
+	latency.Observe(0.5, "imagine")
+	latency.Observe(5, "imagine")
+	latency.Observe(30, "imagine")
+
+	// Metrics are shared by name
+	if r.Counter("test_errors_total", "", "class") == nil {
+		t.Fatal("expected counter")
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("unexpected content type %s", ct)
+	}
+	want := `# HELP test_duration_seconds Job duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{job="imagine",le="1"} 1
+test_duration_seconds_bucket{job="imagine",le="10"} 2
+test_duration_seconds_bucket{job="imagine",le="+Inf"} 3
+test_duration_seconds_sum{job="imagine"} 35.5
+test_duration_seconds_count{job="imagine"} 3
+# HELP test_errors_total Errors by class.
+# TYPE test_errors_total counter
+test_errors_total{class="queue-full"} 2
+test_errors_total{class="say \"hi\""} 2
+# HELP test_inflight Tasks being processed.
+# TYPE test_inflight gauge
+test_inflight 1
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestNil(t *testing.T) {
+	var r *Registry
+	r.Counter("a", "").Inc()
+	r.Gauge("b", "").Set(1)
+	r.Histogram("c", "", DurationBuckets).Observe(1)
+	var sb strings.Builder
+	if err := NewRegistry().Write(&sb); err != nil || sb.Len() != 0 {
+		t.Errorf("unexpected output %q: %v", sb.String(), err)
+	}
+}
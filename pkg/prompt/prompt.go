@@ -0,0 +1,492 @@
+// Package prompt loads prompts from files and expands their templates.
+//
+// Prompts can use `{{name}}` variables and `{a|b|c}` alternations, each
+// prompt is expanded to the cartesian product of its alternations:
+//
+//	a {red|green} {{animal}} {walking|running}
+//
+// generates 4 prompts.
+//
+// Entries can also set their own suffix and generation options, which
+// override the default ones of the config.
+package prompt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+)
+
+// MaxCombinations is the maximum number of prompts that can be generated
+// without sampling or a max count.
+const MaxCombinations = 100000
+
+// Config configures how prompts are loaded.
+type Config struct {
+	// Files enables reading the entries with a .txt, .csv or .jsonl
+	// extension as files
+	Files bool
+	// Variables are the values of the {{name}} templates
+	Variables map[string]string
+	// Prefix and Suffix are added to all the prompts before expanding them
+	Prefix string
+	Suffix string
+	// Sample is the number of prompts randomly taken from all the
+	// combinations, zero takes all of them
+	Sample int
+	// Seed is the seed of the random sampling, zero uses a random seed
+	Seed int64
+	// Max is the maximum number of prompts, zero means no limit
+	Max int
+	// Options are the generation options of the entries that don't set
+	// their own
+	Options ai.Options
+}
+
+// Entry is a prompt template along with its own variables and options.
+// It can be decoded from either a plain string or an object.
+type Entry struct {
+	Prompt    string            `json:"prompt" yaml:"prompt"`
+	Variables map[string]string `json:"variables,omitempty" yaml:"variables"`
+	// Suffix is added to the prompt before the suffix of the config
+	Suffix string `json:"suffix,omitempty" yaml:"suffix"`
+	// Upscale are the indexes of the grid images to upscale, an empty list
+	// keeps the grid as a preview and nil uses the default
+	Upscale []int `json:"upscale" yaml:"upscale"`
+	// Variation enables or disables variations, nil uses the default
+	Variation *bool `json:"variation,omitempty" yaml:"variation"`
+	// Rounds is the number of variation rounds, setting it enables
+	// variations unless they are disabled
+	Rounds int `json:"rounds,omitempty" yaml:"rounds"`
+}
+
+// UnmarshalJSON decodes the entry from a string or an object.
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*e = Entry{}
+		return json.Unmarshal(data, &e.Prompt)
+	}
+	type alias Entry
+	var a alias
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+	*e = Entry(a)
+	return nil
+}
+
+// UnmarshalYAML decodes the entry from a string or an object.
+func (e *Entry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*e = Entry{Prompt: s}
+		return nil
+	}
+	type alias Entry
+	var a alias
+	if err := unmarshal(&a); err != nil {
+		return err
+	}
+	*e = Entry(a)
+	return nil
+}
+
+// Options returns the generation options of the entry, the defaults are used
+// for the ones it doesn't set.
+func (e *Entry) Options(defaults ai.Options) ai.Options {
+	o := defaults
+	if e.Upscale != nil {
+		o.Upscale = e.Upscale
+	}
+	if e.Rounds != 0 {
+		o.Rounds = e.Rounds
+		o.Variation = true
+	}
+	if e.Variation != nil {
+		o.Variation = *e.Variation
+	}
+	return o
+}
+
+// inherit fills the settings the entry doesn't set with the ones of the
+// parent, used for the entries of a prompts file.
+func (e *Entry) inherit(parent *Entry) {
+	if e.Suffix == "" {
+		e.Suffix = parent.Suffix
+	}
+	if e.Upscale == nil {
+		e.Upscale = parent.Upscale
+	}
+	if e.Variation == nil {
+		e.Variation = parent.Variation
+	}
+	if e.Rounds == 0 {
+		e.Rounds = parent.Rounds
+	}
+	for k, v := range parent.Variables {
+		if _, ok := e.Variables[k]; ok {
+			continue
+		}
+		if e.Variables == nil {
+			e.Variables = make(map[string]string)
+		}
+		e.Variables[k] = v
+	}
+}
+
+// Result are the loaded prompts.
+type Result struct {
+	Prompts []*ai.Prompt
+	// Duplicates are the prompts that were generated more than once, only
+	// their first occurrence and its options are kept in the prompts
+	Duplicates []string
+}
+
+// Load reads the entries and expands them to prompts.
+// The entries of a prompts file inherit the suffix, variables and options of
+// the entry that points to it.
+func Load(entries []*Entry, cfg *Config) (*Result, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	var all []*Entry
+	for _, e := range entries {
+		if cfg.Files && IsFile(e.Prompt) {
+			fileEntries, err := ReadFile(e.Prompt)
+			if err != nil {
+				return nil, err
+			}
+			for _, fe := range fileEntries {
+				fe.inherit(e)
+			}
+			all = append(all, fileEntries...)
+			continue
+		}
+		all = append(all, e)
+	}
+	return Expand(all, cfg)
+}
+
+// Entries returns the entries of the plain prompts.
+func Entries(prompts []string) []*Entry {
+	entries := make([]*Entry, 0, len(prompts))
+	for _, p := range prompts {
+		entries = append(entries, &Entry{Prompt: p})
+	}
+	return entries
+}
+
+// IsFile reports whether the entry is a path to a prompts file: it has a
+// supported extension and no spaces.
+func IsFile(entry string) bool {
+	if strings.ContainsAny(entry, " \t") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(entry)) {
+	case ".txt", ".csv", ".jsonl":
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadFile reads the entries of a prompts file.
+//
+//   - .txt files have a prompt per line, empty lines and lines starting with
+//     # are skipped.
+//   - .csv files take the prompts from the "prompt" column and the rest of
+//     columns are used as variables. Without a header the first column is
+//     used.
+//   - .jsonl files have an entry per line, either a string or an object with
+//     the prompt, its variables and its options.
+func ReadFile(path string) ([]*Entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("prompt: couldn't read file: %w", err)
+	}
+	var entries []*Entry
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		entries, err = readCSV(bytes.NewReader(data))
+	case ".jsonl":
+		entries, err = readJSONL(bytes.NewReader(data))
+	default:
+		entries, err = readTXT(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("prompt: couldn't parse %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+func readTXT(r io.Reader) ([]*Entry, error) {
+	var entries []*Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, &Entry{Prompt: line})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func readCSV(r io.Reader) ([]*Entry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	column := -1
+	header := records[0]
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), "prompt") {
+			column = i
+			break
+		}
+	}
+	if column < 0 {
+		header = nil
+		column = 0
+	} else {
+		records = records[1:]
+	}
+
+	var entries []*Entry
+	for n, record := range records {
+		if len(record) <= column {
+			return nil, fmt.Errorf("line %d: missing prompt column", n+1)
+		}
+		p := strings.TrimSpace(record[column])
+		if p == "" {
+			continue
+		}
+		e := &Entry{Prompt: p}
+		for i, name := range header {
+			if i == column || i >= len(record) {
+				continue
+			}
+			if e.Variables == nil {
+				e.Variables = make(map[string]string)
+			}
+			e.Variables[strings.TrimSpace(name)] = record[i]
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func readJSONL(r io.Reader) ([]*Entry, error) {
+	var entries []*Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if strings.TrimSpace(e.Prompt) == "" {
+			return nil, fmt.Errorf("line %d: missing prompt", n)
+		}
+		entries = append(entries, &e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+var (
+	variableRegex    = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+	alternationRegex = regexp.MustCompile(`\{([^{}]*\|[^{}]*)\}`)
+)
+
+// template is a prompt split in literal parts and alternations.
+type template struct {
+	// parts has a literal before each group and a last one after them
+	parts  []string
+	groups [][]string
+	count  int64
+	// options are the generation options of the prompts
+	options ai.Options
+}
+
+func parse(e *Entry, cfg *Config) (*template, error) {
+	text := cfg.Prefix + e.Prompt
+	if e.Suffix != "" {
+		text += " " + e.Suffix
+	}
+	text += cfg.Suffix
+
+	// Replace variables
+	var err error
+	text = variableRegex.ReplaceAllStringFunc(text, func(m string) string {
+		name := variableRegex.FindStringSubmatch(m)[1]
+		if v, ok := e.Variables[name]; ok {
+			return v
+		}
+		if v, ok := cfg.Variables[name]; ok {
+			return v
+		}
+		if err == nil {
+			err = fmt.Errorf("prompt: unknown variable %q in %q", name, e.Prompt)
+		}
+		return m
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	options := e.Options(cfg.Options)
+	if err := options.Validate(); err != nil {
+		return nil, fmt.Errorf("prompt: invalid options of %q: %w", e.Prompt, err)
+	}
+
+	// Split alternations
+	t := &template{count: 1, options: options}
+	last := 0
+	for _, loc := range alternationRegex.FindAllStringSubmatchIndex(text, -1) {
+		t.parts = append(t.parts, text[last:loc[0]])
+		var options []string
+		for _, o := range strings.Split(text[loc[2]:loc[3]], "|") {
+			options = append(options, strings.TrimSpace(o))
+		}
+		t.groups = append(t.groups, options)
+		if t.count > math.MaxInt64/int64(len(options)) {
+			return nil, fmt.Errorf("prompt: too many combinations in %q", e.Prompt)
+		}
+		t.count *= int64(len(options))
+		last = loc[1]
+	}
+	t.parts = append(t.parts, text[last:])
+	return t, nil
+}
+
+// prompt returns the combination of the given index.
+func (t *template) prompt(index int64) *ai.Prompt {
+	var sb strings.Builder
+	for i, g := range t.groups {
+		sb.WriteString(t.parts[i])
+		sb.WriteString(g[index%int64(len(g))])
+		index /= int64(len(g))
+	}
+	sb.WriteString(t.parts[len(t.parts)-1])
+	return &ai.Prompt{
+		Text:    strings.Join(strings.Fields(sb.String()), " "),
+		Options: t.options,
+	}
+}
+
+// Expand generates the prompts of the entries.
+func Expand(entries []*Entry, cfg *Config) (*Result, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	var templates []*template
+	var total int64
+	for _, e := range entries {
+		t, err := parse(e, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if total > math.MaxInt64-t.count {
+			return nil, errors.New("prompt: too many combinations")
+		}
+		total += t.count
+		templates = append(templates, t)
+	}
+
+	var indexes []int64
+	if cfg.Sample > 0 && int64(cfg.Sample) < total {
+		indexes = sample(total, cfg.Sample, cfg.Seed)
+	} else if total > MaxCombinations && (cfg.Max <= 0 || cfg.Max > MaxCombinations) {
+		return nil, fmt.Errorf("prompt: %d combinations, use sample or max to limit them", total)
+	}
+
+	res := &Result{}
+	seen := make(map[string]int)
+	add := func(p *ai.Prompt) bool {
+		seen[p.Text]++
+		switch seen[p.Text] {
+		case 1:
+			res.Prompts = append(res.Prompts, p)
+		case 2:
+			res.Duplicates = append(res.Duplicates, p.Text)
+		}
+		return cfg.Max > 0 && len(res.Prompts) >= cfg.Max
+	}
+
+	if indexes != nil {
+		var t int
+		var offset int64
+		for _, idx := range indexes {
+			for idx >= offset+templates[t].count {
+				offset += templates[t].count
+				t++
+			}
+			if add(templates[t].prompt(idx - offset)) {
+				break
+			}
+		}
+		return res, nil
+	}
+	for _, t := range templates {
+		for i := int64(0); i < t.count; i++ {
+			if add(t.prompt(i)) {
+				return res, nil
+			}
+		}
+	}
+	return res, nil
+}
+
+// sample returns n distinct sorted indexes lower than total.
+func sample(total int64, n int, seed int64) []int64 {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	// Floyd's algorithm
+	picked := make(map[int64]struct{}, n)
+	for j := total - int64(n); j < total; j++ {
+		v := rnd.Int63n(j + 1)
+		if _, ok := picked[v]; ok {
+			v = j
+		}
+		picked[v] = struct{}{}
+	}
+	indexes := make([]int64, 0, n)
+	for v := range picked {
+		indexes = append(indexes, v)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return indexes
+}
@@ -0,0 +1,215 @@
+package prompt
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+	"gopkg.in/yaml.v2"
+)
+
+func texts(prompts []*ai.Prompt) []string {
+	var s []string
+	for _, p := range prompts {
+		s = append(s, p.Text)
+	}
+	return s
+}
+
+func TestLoad(t *testing.T) {
+	cfg := &Config{
+		Files:     true,
+		Variables: map[string]string{"animal": "monkey"},
+		Suffix:    " --ar 3:2",
+		Options:   ai.DefaultOptions(false, true),
+	}
+	variation := true
+	res, err := Load([]*Entry{
+		{Prompt: "testdata/prompts.txt"},
+		{Prompt: "testdata/prompts.csv", Variation: &variation},
+		{Prompt: "testdata/prompts.jsonl", Upscale: []int{}},
+		{Prompt: "a cute {{animal}}"},
+	}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"a cute monkey --ar 3:2",
+		"a red bird --ar 3:2",
+		"a blue bird --ar 3:2",
+		"a fox in the forest --ar 3:2",
+		"a cat, sleeping --ar 3:2",
+		"a plain prompt --ar 3:2",
+		"a dog walking --no trees --ar 3:2",
+		"a dog running --no trees --ar 3:2",
+	}
+	if got := texts(res.Prompts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	// Entries of a file inherit the options of the entry unless they set
+	// their own
+	wantOptions := []ai.Options{
+		ai.DefaultOptions(false, true),
+		ai.DefaultOptions(false, true),
+		ai.DefaultOptions(false, true),
+		ai.DefaultOptions(true, true),
+		ai.DefaultOptions(true, true),
+		{Upscale: []int{}},
+		{Upscale: []int{0, 2}},
+		{Upscale: []int{0, 2}},
+	}
+	for i, p := range res.Prompts {
+		if !reflect.DeepEqual(p.Options, wantOptions[i]) {
+			t.Errorf("prompt %d: expected options %+v, got %+v", i, wantOptions[i], p.Options)
+		}
+	}
+	if !reflect.DeepEqual(res.Duplicates, []string{"a cute monkey --ar 3:2"}) {
+		t.Errorf("unexpected duplicates: %q", res.Duplicates)
+	}
+
+	// Files are only read if enabled
+	res, err = Load(Entries([]string{"testdata/prompts.txt"}), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := texts(res.Prompts); !reflect.DeepEqual(got, []string{"testdata/prompts.txt"}) {
+		t.Errorf("unexpected prompts: %q", got)
+	}
+	if _, err := Load(Entries([]string{"missing.txt"}), &Config{Files: true}); err == nil {
+		t.Error("expected error for a missing file")
+	}
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		cfg     Config
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "product",
+			entries: []string{"{a|b} {1|2}"},
+			want:    []string{"a 1", "b 1", "a 2", "b 2"},
+		},
+		{
+			name:    "prefix alternation",
+			entries: []string{"cat"},
+			cfg:     Config{Prefix: "{red|blue} "},
+			want:    []string{"red cat", "blue cat"},
+		},
+		{
+			name:    "not an alternation",
+			entries: []string{"{cat}"},
+			want:    []string{"{cat}"},
+		},
+		{
+			name:    "max",
+			entries: []string{"{a|b|c}", "d"},
+			cfg:     Config{Max: 2},
+			want:    []string{"a", "b"},
+		},
+		{
+			name:    "unknown variable",
+			entries: []string{"a {{dog}}"},
+			wantErr: true,
+		},
+		{
+			name:    "too many combinations",
+			entries: []string{"{0|1|2|3|4|5|6|7|8|9}{0|1|2|3|4|5|6|7|8|9}{0|1|2|3|4|5|6|7|8|9}{0|1|2|3|4|5|6|7|8|9}{0|1|2|3|4|5|6|7|8|9}{0|1|2|3|4|5|6|7|8|9}"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Expand(Entries(tt.entries), &tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := texts(res.Prompts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSample(t *testing.T) {
+	digits := "{0|1|2|3|4|5|6|7|8|9}"
+	entries := []*Entry{{Prompt: digits + digits + digits + digits + digits + digits}}
+	cfg := &Config{Sample: 50, Seed: 42}
+	res, err := Expand(entries, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Prompts) != 50 || len(res.Duplicates) != 0 {
+		t.Fatalf("expected 50 unique prompts, got %d (%d duplicates)", len(res.Prompts), len(res.Duplicates))
+	}
+	again, err := Expand(entries, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(texts(res.Prompts), texts(again.Prompts)) {
+		t.Error("expected the same sample with the same seed")
+	}
+}
+
+func TestEntry(t *testing.T) {
+	var fromYAML []*Entry
+	if err := yaml.UnmarshalStrict([]byte(`
+- a cat
+- prompt: a dog
+  suffix: --ar 3:2
+  upscale: [1, 3]
+- prompt: a bird
+  rounds: 2
+- prompt: a fish
+  upscale: []
+  variation: false
+`), &fromYAML); err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON []*Entry
+	if err := json.Unmarshal([]byte(`[
+		"a cat",
+		{"prompt": "a dog", "suffix": "--ar 3:2", "upscale": [1, 3]},
+		{"prompt": "a bird", "rounds": 2},
+		{"prompt": "a fish", "upscale": [], "variation": false}
+	]`), &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := ai.DefaultOptions(true, true)
+	want := []ai.Options{
+		defaults,
+		{Upscale: []int{1, 3}, Variation: true},
+		{Upscale: defaults.Upscale, Variation: true, Rounds: 2},
+		{Upscale: []int{}},
+	}
+	for name, entries := range map[string][]*Entry{"yaml": fromYAML, "json": fromJSON} {
+		res, err := Expand(entries, &Config{Options: defaults})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := texts(res.Prompts); !reflect.DeepEqual(got, []string{"a cat", "a dog --ar 3:2", "a bird", "a fish"}) {
+			t.Errorf("%s: unexpected prompts: %q", name, got)
+		}
+		for i, p := range res.Prompts {
+			if !reflect.DeepEqual(p.Options, want[i]) {
+				t.Errorf("%s: prompt %d: expected options %+v, got %+v", name, i, want[i], p.Options)
+			}
+		}
+	}
+
+	if _, err := Expand([]*Entry{{Prompt: "a cat", Upscale: []int{4}}}, &Config{}); err == nil {
+		t.Error("expected error for an invalid upscale index")
+	}
+}
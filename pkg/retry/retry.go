@@ -0,0 +1,67 @@
+package retry
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Policy defines how many times an operation is attempted and how long to
+// wait between attempts.
+// The wait grows exponentially from Base by Factor and is limited by Cap.
+type Policy struct {
+	// MaxAttempts is the total number of attempts, including the first one
+	MaxAttempts int
+	// Base is the wait after the first failed attempt
+	Base time.Duration
+	// Cap is the maximum wait, zero means no limit
+	Cap time.Duration
+	// Factor multiplies the wait after each failed attempt, 2 if zero
+	Factor float64
+	// Jitter randomizes the wait by the given fraction (e.g. 0.1 is ±10%)
+	Jitter float64
+	// Overrides are used instead of this policy for specific errors
+	Overrides []Override
+}
+
+// Override is a policy applied to the errors matching Err using errors.Is.
+type Override struct {
+	Err    error
+	Policy Policy
+}
+
+// Match returns the policy to use for the error.
+// The boolean is true if the policy is an override for the error.
+func (p *Policy) Match(err error) (*Policy, bool) {
+	for i := range p.Overrides {
+		o := &p.Overrides[i]
+		if errors.Is(err, o.Err) {
+			return &o.Policy, true
+		}
+	}
+	return p, false
+}
+
+// Delay returns the time to wait after the given number of failed attempts.
+// It returns false if there are no attempts left.
+func (p *Policy) Delay(attempts int) (time.Duration, bool) {
+	if attempts >= p.MaxAttempts {
+		return 0, false
+	}
+	if p.Base <= 0 || attempts < 1 {
+		return 0, true
+	}
+	factor := p.Factor
+	if factor <= 0 {
+		factor = 2
+	}
+	d := float64(p.Base) * math.Pow(factor, float64(attempts-1))
+	if p.Cap > 0 && d > float64(p.Cap) {
+		d = float64(p.Cap)
+	}
+	if p.Jitter > 0 {
+		d = d * (1 - p.Jitter + 2*p.Jitter*rand.Float64())
+	}
+	return time.Duration(d), true
+}
@@ -0,0 +1,65 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	p := &Policy{
+		MaxAttempts: 4,
+		Base:        10 * time.Minute,
+		Factor:      3,
+		Cap:         60 * time.Minute,
+	}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+		ok       bool
+	}{
+		{attempts: 1, want: 10 * time.Minute, ok: true},
+		{attempts: 2, want: 30 * time.Minute, ok: true},
+		{attempts: 3, want: 60 * time.Minute, ok: true},
+		{attempts: 4, ok: false},
+	}
+	for _, tt := range tests {
+		got, ok := p.Delay(tt.attempts)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Delay(%d) = %s, %v, want %s, %v", tt.attempts, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	p := &Policy{
+		MaxAttempts: 2,
+		Base:        time.Second,
+		Jitter:      0.5,
+	}
+	for i := 0; i < 100; i++ {
+		got, _ := p.Delay(1)
+		if got < 500*time.Millisecond || got > 1500*time.Millisecond {
+			t.Fatalf("Delay(1) = %s, want between 500ms and 1.5s", got)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	errFoo := errors.New("foo")
+	p := &Policy{
+		MaxAttempts: 5,
+		Overrides: []Override{
+			{Err: errFoo, Policy: Policy{MaxAttempts: 1}},
+		},
+	}
+	got, ok := p.Match(fmt.Errorf("wrapped: %w", errFoo))
+	if !ok || got.MaxAttempts != 1 {
+		t.Errorf("Match() = %+v, %v, want override", got, ok)
+	}
+	got, ok = p.Match(errors.New("bar"))
+	if ok || got != p {
+		t.Errorf("Match() = %+v, %v, want default policy", got, ok)
+	}
+}
@@ -8,7 +8,7 @@ import (
 	"fmt"
 	"github.com/ZYKJShadow/bulkai"
 	"github.com/ZYKJShadow/bulkai/pkg/scrapfly"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
@@ -23,7 +23,12 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-func Run(ctx context.Context, profile bool, output, proxy string) error {
+// Run opens a browser to log in discord and saves the session to the output
+// file. Progress is logged to the logger, slog.Default() if nil.
+func Run(ctx context.Context, profile bool, output, proxy string, logger *slog.Logger) error {
+	if logger == nil {
+		logger = slog.Default()
+	}
 	if output == "" {
 		return errors.New("output file is required")
 	}
@@ -31,8 +36,8 @@ func Run(ctx context.Context, profile bool, output, proxy string) error {
 		return fmt.Errorf("output file is a directory: %s", output)
 	}
 
-	log.Println("Starting browser")
-	defer log.Println("Browser stopped")
+	logger.Info("starting browser")
+	defer logger.Info("browser stopped")
 
 	opts := append(
 		chromedp.DefaultExecAllocatorOptions[3:],
@@ -111,7 +116,7 @@ func Run(ctx context.Context, profile bool, output, proxy string) error {
 	if ja3 == "" {
 		return errors.New("empty ja3")
 	}
-	log.Println("ja3:", ja3)
+	logger.Info("ja3 obtained", "ja3", ja3)
 
 	// obtain user agent
 	var userAgent, acceptLanguage string
@@ -136,7 +141,7 @@ func Run(ctx context.Context, profile bool, output, proxy string) error {
 				return errors.New("couldn't obtain info http")
 			}
 			var infoHTTP2 scrapfly.InfoHTTP2
-			log.Println(body)
+			logger.Debug("http2 info obtained", "body", body)
 			if err := json.Unmarshal([]byte(body), &infoHTTP2); err != nil {
 				return fmt.Errorf("couldn't unmarshal info http: %w", err)
 			}
@@ -150,13 +155,13 @@ func Run(ctx context.Context, profile bool, output, proxy string) error {
 			if userAgent == "" {
 				return errors.New("empty user agent")
 			}
-			log.Println("user-agent:", userAgent)
+			logger.Info("user agent obtained", "user_agent", userAgent)
 			v, ok := infoHTTP2.Headers["accept-language"]
 			if !ok || len(v) == 0 {
 				return errors.New("empty accept language")
 			}
 			acceptLanguage = strings.Split(v[0], ",")[0]
-			log.Println("language:", acceptLanguage)
+			logger.Info("language obtained", "language", acceptLanguage)
 			return nil
 		}),
 	); err != nil {
@@ -187,7 +192,7 @@ func Run(ctx context.Context, profile bool, output, proxy string) error {
 					lck.Lock()
 					if xDiscordLocale != h {
 						xDiscordLocale = h
-						log.Println("locale:", xDiscordLocale)
+						logger.Info("locale obtained", "locale", xDiscordLocale)
 					}
 					lck.Unlock()
 				}
@@ -195,7 +200,7 @@ func Run(ctx context.Context, profile bool, output, proxy string) error {
 					lck.Lock()
 					if xSuperProperties != h {
 						xSuperProperties = h
-						log.Println("super-properties:", xSuperProperties)
+						logger.Info("super properties obtained", "super_properties", xSuperProperties)
 					}
 					lck.Unlock()
 				}
@@ -203,7 +208,7 @@ func Run(ctx context.Context, profile bool, output, proxy string) error {
 					lck.Lock()
 					if cookie != h {
 						cookie = h
-						log.Println("cookie:", "...redacted...")
+						logger.Info("cookie obtained")
 					}
 					lck.Unlock()
 				}
@@ -211,7 +216,7 @@ func Run(ctx context.Context, profile bool, output, proxy string) error {
 					lck.Lock()
 					if token != h {
 						token = h
-						log.Println("token:", "...redacted...")
+						logger.Info("token obtained")
 					}
 					lck.Unlock()
 				}
@@ -259,7 +264,7 @@ func Run(ctx context.Context, profile bool, output, proxy string) error {
 	if err != nil {
 		return fmt.Errorf("couldn't marshal session: %w", err)
 	}
-	log.Println("Session successfully obtained")
+	logger.Info("session successfully obtained")
 
 	// If the file already exists, copy it to a backup file
 	if _, err := os.Stat(output); err == nil {
@@ -272,14 +277,14 @@ func Run(ctx context.Context, profile bool, output, proxy string) error {
 		if err := os.Rename(output, backup); err != nil {
 			return fmt.Errorf("couldn't backup session: %w", err)
 		}
-		log.Println("Previous session backed up to", backup)
+		logger.Info("previous session backed up", "path", backup)
 	}
 
 	// Write the session to the output file
 	if err := os.WriteFile(output, data, 0644); err != nil {
 		return fmt.Errorf("couldn't write session: %w", err)
 	}
-	log.Println("Session saved to", output)
+	logger.Info("session saved", "path", output)
 	return nil
 }
 
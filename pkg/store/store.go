@@ -0,0 +1,529 @@
+// Package store is an embedded on-disk store of generation jobs and their
+// prompts.
+//
+// Changes are appended to a log file and synced before returning, so the
+// state survives crashes. The log is compacted when it is opened and when it
+// grows too much.
+//
+// A store can only be opened by one process at a time, the file is locked
+// using a lock file next to it.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+)
+
+// State is the state of a prompt item.
+type State string
+
+const (
+	Pending   State = "pending"
+	Imagining State = "imagining"
+	Upscaling State = "upscaling"
+	Done      State = "done"
+	Failed    State = "failed"
+)
+
+// Job is a group of prompts generated together.
+type Job struct {
+	ID        string    `json:"id"`
+	Seq       uint64    `json:"seq"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Item is a prompt of a job.
+type Item struct {
+	Job      string     `json:"job"`
+	Index    int        `json:"index"`
+	Prompt   string     `json:"prompt"`
+	Options  ai.Options `json:"options"`
+	State    State      `json:"state"`
+	Attempts int        `json:"attempts,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	// ReadyAt is the time after which a pending item can be claimed
+	ReadyAt   time.Time `json:"ready_at,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// record is a line of the log file.
+type record struct {
+	Job    *Job   `json:"job,omitempty"`
+	Item   *Item  `json:"item,omitempty"`
+	Delete string `json:"delete,omitempty"`
+}
+
+type entry struct {
+	job   Job
+	items []*Item
+}
+
+// ErrLocked is returned when the store is already opened by another process.
+var ErrLocked = errors.New("store: locked by another process")
+
+// compactMin is the minimum number of log records before compacting.
+const compactMin = 1000
+
+// Store is an embedded on-disk store of jobs.
+// It is safe for concurrent use.
+type Store struct {
+	lck     sync.Mutex
+	path    string
+	f       *os.File
+	lock    *os.File
+	closed  bool
+	seq     uint64
+	jobs    map[string]*entry
+	records int
+	// compactErr is the error of the last compaction, it is retried on the
+	// next write
+	compactErr error
+}
+
+// Open opens the store file, creating it if it doesn't exist.
+// Items that were being processed when the store was closed are set back to
+// pending. It returns ErrLocked if the store is opened by another process.
+func Open(path string) (*Store, error) {
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	s, err := open(path)
+	if err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+	s.lock = lock
+	return s, nil
+}
+
+func open(path string) (*Store, error) {
+	s := &Store{
+		path: path,
+		jobs: make(map[string]*entry),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("store: couldn't read %s: %w", path, err)
+	}
+	if err := s.load(data); err != nil {
+		return nil, err
+	}
+	for _, e := range s.jobs {
+		for _, it := range e.items {
+			if it.State == Imagining || it.State == Upscaling {
+				it.State = Pending
+			}
+		}
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replays the log. A truncated last line, left by a crash in the
+// middle of a write, is ignored.
+func (s *Store) load(data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var bad int
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if bad > 0 {
+			return fmt.Errorf("store: couldn't parse %s line %d", s.path, bad)
+		}
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			bad = n
+			continue
+		}
+		s.apply(&rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("store: couldn't read %s: %w", s.path, err)
+	}
+	return nil
+}
+
+func (s *Store) apply(rec *record) {
+	switch {
+	case rec.Delete != "":
+		delete(s.jobs, rec.Delete)
+	case rec.Job != nil:
+		e, ok := s.jobs[rec.Job.ID]
+		if !ok {
+			e = &entry{}
+			s.jobs[rec.Job.ID] = e
+		}
+		e.job = *rec.Job
+		if e.job.Seq > s.seq {
+			s.seq = e.job.Seq
+		}
+	case rec.Item != nil:
+		e, ok := s.jobs[rec.Item.Job]
+		if !ok {
+			return
+		}
+		it := *rec.Item
+		for len(e.items) <= it.Index {
+			e.items = append(e.items, nil)
+		}
+		e.items[it.Index] = &it
+	}
+}
+
+// compact rewrites the log with the current state. The current log is kept
+// if it fails.
+func (s *Store) compact() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	var n int
+	for _, e := range s.sorted() {
+		job := e.job
+		if err := enc.Encode(&record{Job: &job}); err != nil {
+			return fmt.Errorf("store: couldn't encode job: %w", err)
+		}
+		n++
+		for _, it := range e.items {
+			if it == nil {
+				continue
+			}
+			if err := enc.Encode(&record{Item: it}); err != nil {
+				return fmt.Errorf("store: couldn't encode item: %w", err)
+			}
+			n++
+		}
+	}
+
+	tmp := s.path + ".tmp"
+	if err := writeFile(tmp, buf.Bytes()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("store: couldn't rename %s: %w", tmp, err)
+	}
+	// The old file was replaced, so it can't be written anymore
+	if s.f != nil {
+		_ = s.f.Close()
+		s.f = nil
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("store: couldn't open %s: %w", s.path, err)
+	}
+	s.f = f
+	s.records = n
+	return nil
+}
+
+func writeFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("store: couldn't create %s: %w", path, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("store: couldn't write %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("store: couldn't sync %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("store: couldn't close %s: %w", path, err)
+	}
+	return nil
+}
+
+// write appends the records to the log, it must be called with the lock
+// held. Once the records are synced it doesn't fail, compaction errors are
+// reported by Err.
+func (s *Store) write(recs ...*record) error {
+	if s.closed {
+		return errors.New("store: closed")
+	}
+	if s.f == nil {
+		// A failed compaction left the log without an open file
+		f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("store: couldn't open %s: %w", s.path, err)
+		}
+		s.f = f
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return fmt.Errorf("store: couldn't encode record: %w", err)
+		}
+	}
+	if _, err := s.f.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("store: couldn't write %s: %w", s.path, err)
+	}
+	if err := s.f.Sync(); err != nil {
+		return fmt.Errorf("store: couldn't sync %s: %w", s.path, err)
+	}
+	s.records += len(recs)
+
+	var live int
+	for _, e := range s.jobs {
+		live += 1 + len(e.items)
+	}
+	if s.records > compactMin && s.records > 2*live {
+		s.compactErr = s.compact()
+	}
+	return nil
+}
+
+// Err returns the error of the last compaction of the log, if it failed.
+// The records were written anyway and compaction is retried on the next
+// write.
+func (s *Store) Err() error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.compactErr
+}
+
+// Close closes the store file and releases its lock.
+func (s *Store) Close() error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var err error
+	if s.f != nil {
+		err = s.f.Close()
+		s.f = nil
+	}
+	if s.lock != nil {
+		if lockErr := s.lock.Close(); err == nil {
+			err = lockErr
+		}
+		s.lock = nil
+	}
+	return err
+}
+
+// Enqueue adds a job to the end of the queue.
+// If the job already exists its prompts are kept, the options of its items
+// are updated and the items that aren't done are set back to pending.
+// Items with the indexes in done are marked as done.
+func (s *Store) Enqueue(id string, prompts []*ai.Prompt, done []int) (*Job, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	now := time.Now().UTC()
+	e, ok := s.jobs[id]
+	if !ok {
+		e = &entry{job: Job{ID: id, CreatedAt: now}}
+		for i, p := range prompts {
+			e.items = append(e.items, &Item{Job: id, Index: i, Prompt: p.Text, Options: p.Options})
+		}
+	}
+	s.seq++
+	e.job.Seq = s.seq
+	e.job.UpdatedAt = now
+
+	doneLookup := make(map[int]struct{})
+	for _, i := range done {
+		doneLookup[i] = struct{}{}
+	}
+	job := e.job
+	recs := []*record{{Job: &job}}
+	for _, it := range e.items {
+		if it == nil {
+			continue
+		}
+		state := Pending
+		if _, ok := doneLookup[it.Index]; ok {
+			state = Done
+		}
+		changed := false
+		if ok && it.Index < len(prompts) && !reflect.DeepEqual(it.Options, prompts[it.Index].Options) {
+			it.Options = prompts[it.Index].Options
+			changed = true
+		}
+		if ok && it.State == state && !changed {
+			continue
+		}
+		it.State = state
+		it.Attempts = 0
+		it.Error = ""
+		it.ReadyAt = time.Time{}
+		it.UpdatedAt = now
+		cp := *it
+		recs = append(recs, &record{Item: &cp})
+	}
+	s.jobs[id] = e
+	if err := s.write(recs...); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Claim marks the first pending item that is ready as imagining and returns
+// it. Jobs are taken in the order they were enqueued and only the ones
+// accepted by the filter are considered.
+// If there is no item ready it returns nil along with the time the next
+// item will be ready, which is zero if no item is waiting.
+func (s *Store) Claim(now time.Time, accept func(job string) bool) (*Item, time.Time, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	var next time.Time
+	for _, e := range s.sorted() {
+		if accept != nil && !accept(e.job.ID) {
+			continue
+		}
+		for _, it := range e.items {
+			if it == nil || it.State != Pending {
+				continue
+			}
+			if it.ReadyAt.After(now) {
+				if next.IsZero() || it.ReadyAt.Before(next) {
+					next = it.ReadyAt
+				}
+				continue
+			}
+			it.State = Imagining
+			it.UpdatedAt = now.UTC()
+			cp := *it
+			if err := s.write(&record{Item: &cp}); err != nil {
+				return nil, time.Time{}, err
+			}
+			return &cp, time.Time{}, nil
+		}
+	}
+	return nil, next, nil
+}
+
+// Update sets the state of an item, msg is the error message of failed
+// items.
+func (s *Store) Update(job string, index int, state State, msg string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	it, err := s.item(job, index)
+	if err != nil {
+		return err
+	}
+	it.State = state
+	it.Error = msg
+	it.UpdatedAt = time.Now().UTC()
+	cp := *it
+	return s.write(&record{Item: &cp})
+}
+
+// Retry sets an item back to pending so it can be claimed again after the
+// given time.
+func (s *Store) Retry(job string, index int, readyAt time.Time, msg string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	it, err := s.item(job, index)
+	if err != nil {
+		return err
+	}
+	it.State = Pending
+	it.Attempts++
+	it.Error = msg
+	it.ReadyAt = readyAt.UTC()
+	it.UpdatedAt = time.Now().UTC()
+	cp := *it
+	return s.write(&record{Item: &cp})
+}
+
+func (s *Store) item(job string, index int) (*Item, error) {
+	e, ok := s.jobs[job]
+	if !ok || index < 0 || index >= len(e.items) || e.items[index] == nil {
+		return nil, fmt.Errorf("store: item %s/%d not found", job, index)
+	}
+	return e.items[index], nil
+}
+
+// Delete removes a job and its items.
+func (s *Store) Delete(id string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return nil
+	}
+	delete(s.jobs, id)
+	return s.write(&record{Delete: id})
+}
+
+// Job returns a job and its items, or nil if it doesn't exist.
+func (s *Store) Job(id string) (*Job, []*Item) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	e, ok := s.jobs[id]
+	if !ok {
+		return nil, nil
+	}
+	job := e.job
+	var items []*Item
+	for _, it := range e.items {
+		if it == nil {
+			continue
+		}
+		cp := *it
+		items = append(items, &cp)
+	}
+	return &job, items
+}
+
+// Jobs returns the jobs in queue order.
+func (s *Store) Jobs() []*Job {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	var jobs []*Job
+	for _, e := range s.sorted() {
+		job := e.job
+		jobs = append(jobs, &job)
+	}
+	return jobs
+}
+
+// Count returns the number of items of a job in the given state.
+func (s *Store) Count(job string, state State) int {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	e, ok := s.jobs[job]
+	if !ok {
+		return 0
+	}
+	var n int
+	for _, it := range e.items {
+		if it != nil && it.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// sorted returns the jobs in queue order, it must be called with the lock
+// held.
+func (s *Store) sorted() []*entry {
+	entries := make([]*entry, 0, len(s.jobs))
+	for _, e := range s.jobs {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].job.Seq < entries[j].job.Seq
+	})
+	return entries
+}
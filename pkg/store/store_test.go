@@ -0,0 +1,192 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+)
+
+func TestClaim(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Enqueue("a", ai.NewPrompts([]string{"a0", "a1"}, ai.DefaultOptions(false, true)), []int{0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Enqueue("b", ai.NewPrompts([]string{"b0", "b1"}, ai.DefaultOptions(false, true)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Jobs are taken in order, skipping done items
+	now := time.Now()
+	var got []string
+	for {
+		it, _, err := s.Claim(now, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if it == nil {
+			break
+		}
+		if it.State != Imagining {
+			t.Errorf("expected %s, got %s", Imagining, it.State)
+		}
+		got = append(got, it.Prompt)
+	}
+	want := []string{"a1", "b0", "b1"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+
+	// Items waiting to be retried aren't claimed until they are ready
+	readyAt := now.Add(time.Minute)
+	if err := s.Retry("b", 0, readyAt, "timeout"); err != nil {
+		t.Fatal(err)
+	}
+	it, next, err := s.Claim(now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it != nil {
+		t.Fatalf("expected no item, got %s", it.Prompt)
+	}
+	if !next.Equal(readyAt) {
+		t.Errorf("expected next at %s, got %s", readyAt, next)
+	}
+	it, _, err = s.Claim(readyAt, func(job string) bool { return job != "b" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it != nil {
+		t.Fatalf("expected no item, got %s", it.Prompt)
+	}
+	it, _, err = s.Claim(readyAt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it == nil || it.Prompt != "b0" || it.Attempts != 1 {
+		t.Fatalf("expected b0 with 1 attempt, got %+v", it)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Enqueue("a", ai.NewPrompts([]string{"a0", "a1", "a2"}, ai.DefaultOptions(true, false)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Enqueue("b", ai.NewPrompts([]string{"b0"}, ai.Options{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := s.Claim(time.Now(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Update("a", 0, Done, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update("a", 1, Upscaling, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update("a", 2, Failed, "banned prompt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of a write
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"item":{"job":"b","ind`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	jobs := s.Jobs()
+	if len(jobs) != 2 || jobs[0].ID != "a" || jobs[1].ID != "b" {
+		t.Fatalf("unexpected jobs: %+v", jobs)
+	}
+	job, items := s.Job("a")
+	if job == nil {
+		t.Fatal("job not found")
+	}
+	if !items[0].Options.Variation {
+		t.Error("expected options to be stored")
+	}
+	// Items being processed are set back to pending
+	want := []State{Done, Pending, Failed}
+	for i, it := range items {
+		if it.State != want[i] {
+			t.Errorf("item %d: expected %s, got %s", i, want[i], it.State)
+		}
+	}
+	if items[2].Error != "banned prompt" {
+		t.Errorf("expected error to be stored, got %q", items[2].Error)
+	}
+	if n := s.Count("b", Pending); n != 1 {
+		t.Errorf("expected 1 pending item, got %d", n)
+	}
+
+	// Enqueueing again moves the job to the end and resets unfinished items
+	if _, err := s.Enqueue("a", nil, []int{0}); err != nil {
+		t.Fatal(err)
+	}
+	if jobs := s.Jobs(); jobs[1].ID != "a" {
+		t.Errorf("expected job a to be last, got %s", jobs[1].ID)
+	}
+	if n := s.Count("a", Pending); n != 2 {
+		t.Errorf("expected 2 pending items, got %d", n)
+	}
+	if err := s.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := s.Job("b"); job != nil {
+		t.Error("expected job b to be deleted")
+	}
+}
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected %v, got %v", ErrLocked, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
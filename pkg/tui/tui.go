@@ -0,0 +1,337 @@
+// Package tui displays the progress of a generation run in the terminal.
+package tui
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+)
+
+// maxFailures is the number of recent failures shown.
+const maxFailures = 5
+
+// promptWidth is the max number of characters of the prompts shown.
+const promptWidth = 60
+
+// barWidth is the number of characters of the progress bar.
+const barWidth = 30
+
+// refresh is how often the interactive display is redrawn.
+const refresh = 500 * time.Millisecond
+
+// IsTerminal reports whether the writer is a terminal.
+func IsTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Display renders the events of a run. Interactive displays redraw a status
+// block with the overall progress, the running prompts and the last
+// failures, otherwise a structured line is written for each event.
+type Display struct {
+	lck         sync.Mutex
+	w           io.Writer
+	interactive bool
+	prompts     []*ai.Prompt
+	progress    *ai.Progress
+	start       time.Time
+
+	queued   map[int]bool
+	running  map[int]*running
+	finished int
+	failed   int
+	failures []string
+	// lines is the number of lines of the last drawn block
+	lines int
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// running is the state of a prompt being processed.
+type running struct {
+	stage   ai.EventType
+	attempt int
+	since   time.Time
+}
+
+// New returns a display of the run of the prompts, finished prompts are
+// already done. Close must be called when the run ends.
+func New(w io.Writer, prompts []*ai.Prompt, finished []int, interactive bool) *Display {
+	d := &Display{
+		w:           w,
+		interactive: interactive,
+		prompts:     prompts,
+		progress:    ai.NewProgress(prompts, finished),
+		start:       time.Now(),
+		queued:      make(map[int]bool),
+		running:     make(map[int]*running),
+		finished:    len(finished),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if !interactive {
+		close(d.done)
+		return d
+	}
+	// Elapsed times are updated even without events
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				d.lck.Lock()
+				d.redraw()
+				d.lck.Unlock()
+			}
+		}
+	}()
+	return d
+}
+
+// Event updates the display with an event of the run.
+func (d *Display) Event(info *ai.GenerateInfo) {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	d.update(info)
+	if d.interactive {
+		d.redraw()
+		return
+	}
+	_, _ = io.WriteString(d.w, d.line(info))
+}
+
+// Write writes log lines above the status block so they don't break it.
+func (d *Display) Write(p []byte) (int, error) {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	if !d.interactive {
+		return d.w.Write(p)
+	}
+	d.clear()
+	n, err := d.w.Write(p)
+	if err == nil && len(p) > 0 && p[len(p)-1] != '\n' {
+		_, err = io.WriteString(d.w, "\n")
+	}
+	d.draw()
+	return n, err
+}
+
+// Close stops redrawing and writes the final state.
+// Calls after the first one do nothing.
+func (d *Display) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.stop)
+		<-d.done
+		err = d.summary()
+	})
+	return err
+}
+
+// summary writes the final state.
+func (d *Display) summary() error {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	if d.interactive {
+		d.redraw()
+		return nil
+	}
+	_, err := fmt.Fprintf(d.w, "%s type=summary progress=%.1f%% images=%d/%d prompts=%d/%d failed=%d\n",
+		time.Now().UTC().Format(time.RFC3339), d.progress.Percentage(), d.progress.Done(), d.progress.Total(),
+		d.finished, len(d.prompts), d.failed)
+	return err
+}
+
+func (d *Display) update(info *ai.GenerateInfo) {
+	idx := info.PromptIndex
+	switch info.Type {
+	case ai.EventPromptQueued:
+		d.queued[idx] = true
+		return
+	case ai.EventPromptStarted:
+		delete(d.queued, idx)
+		d.running[idx] = &running{stage: info.Type, attempt: info.Attempt, since: info.Time}
+		return
+	case ai.EventFatal:
+		d.fail(fmt.Sprintf("fatal: %v", info.Err))
+		return
+	case ai.EventDownloadFailed:
+		d.fail(fmt.Sprintf("#%d: %v", idx, info.Err))
+		return
+	case ai.EventPromptFailed:
+		d.failed++
+		d.fail(fmt.Sprintf("#%d: %v", idx, info.Err))
+		// Prompts without preview have nothing else to do
+		if r, ok := d.running[idx]; ok && (r.stage == ai.EventPromptStarted || r.stage == ai.EventImagineSent || r.stage == ai.EventJobQueued) {
+			delete(d.running, idx)
+		}
+		return
+	}
+	r, ok := d.running[idx]
+	// Downloads finish after the last image of the prompt
+	if !ok && info.Type != ai.EventDownloadDone {
+		r = &running{since: info.Time.Add(-info.Elapsed)}
+		d.running[idx] = r
+		delete(d.queued, idx)
+	}
+	if r != nil && info.Type != ai.EventDownloadDone {
+		r.stage = info.Type
+		r.attempt = info.Attempt
+	}
+	if info.Image != nil {
+		d.progress.Add(info)
+		if info.Image.IsLast {
+			d.finished++
+			delete(d.running, idx)
+		}
+	}
+}
+
+func (d *Display) fail(msg string) {
+	d.failures = append(d.failures, msg)
+	if len(d.failures) > maxFailures {
+		d.failures = d.failures[len(d.failures)-maxFailures:]
+	}
+}
+
+// line returns the structured line of an event.
+func (d *Display) line(info *ai.GenerateInfo) string {
+	var sb strings.Builder
+	t := info.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	fmt.Fprintf(&sb, "%s type=%s", t.UTC().Format(time.RFC3339), info.Type)
+	if info.PromptIndex >= 0 && info.Type != ai.EventFatal {
+		fmt.Fprintf(&sb, " prompt=%d", info.PromptIndex)
+	}
+	if info.Attempt > 0 {
+		fmt.Fprintf(&sb, " attempt=%d", info.Attempt)
+	}
+	if info.Duration > 0 {
+		fmt.Fprintf(&sb, " duration=%s", info.Duration.Round(time.Millisecond))
+	}
+	if info.Elapsed > 0 {
+		fmt.Fprintf(&sb, " elapsed=%s", info.Elapsed.Round(time.Millisecond))
+	}
+	if img := info.Image; img != nil {
+		fmt.Fprintf(&sb, " image=%d url=%s", img.ImageIndex, strconv.Quote(img.URL))
+	}
+	if info.Err != nil {
+		fmt.Fprintf(&sb, " error=%s", strconv.Quote(info.Err.Error()))
+	}
+	fmt.Fprintf(&sb, " progress=%.1f%%", d.progress.Percentage())
+	if eta := d.progress.ETA(); !eta.IsZero() && info.Image != nil {
+		fmt.Fprintf(&sb, " eta=%s", eta.UTC().Format(time.RFC3339))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// render returns the status block.
+func (d *Display) render() string {
+	var sb strings.Builder
+	now := time.Now()
+
+	pct := d.progress.Percentage()
+	filled := int(pct * barWidth / 100)
+	fmt.Fprintf(&sb, "%5.1f%% [%s%s] %d/%d images · %s\n", pct,
+		strings.Repeat("#", filled), strings.Repeat("-", barWidth-filled),
+		d.progress.Done(), d.progress.Total(), now.Sub(d.start).Round(time.Second))
+
+	var byBot int
+	for _, r := range d.running {
+		if r.stage == ai.EventJobQueued {
+			byBot++
+		}
+	}
+	fmt.Fprintf(&sb, "prompts: %d/%d done · %d running · %d waiting · %d queued by bot · %d failed\n",
+		d.finished, len(d.prompts), len(d.running), len(d.queued), byBot, d.failed)
+
+	speed := fmt.Sprintf("%.1f images/min", d.progress.Rate()*60)
+	eta := "unknown"
+	if t := d.progress.ETA(); !t.IsZero() {
+		eta = fmt.Sprintf("%s (%s)", t.Local().Format("15:04:05"), time.Until(t).Round(time.Second))
+		if d.progress.Done() >= d.progress.Total() {
+			eta = "done"
+		}
+	}
+	fmt.Fprintf(&sb, "speed: %s · eta: %s\n", speed, eta)
+
+	idxs := make([]int, 0, len(d.running))
+	for i := range d.running {
+		idxs = append(idxs, i)
+	}
+	sort.Ints(idxs)
+	for _, i := range idxs {
+		r := d.running[i]
+		var text string
+		if i >= 0 && i < len(d.prompts) {
+			text = truncate(d.prompts[i].Text, promptWidth)
+		}
+		attempt := ""
+		if r.attempt > 1 {
+			attempt = fmt.Sprintf(" (attempt %d)", r.attempt)
+		}
+		fmt.Fprintf(&sb, "  #%-4d %-18s %8s  %s%s\n", i, r.stage, now.Sub(r.since).Round(time.Second), text, attempt)
+	}
+	if len(d.failures) > 0 {
+		sb.WriteString("failures:\n")
+		for _, f := range d.failures {
+			fmt.Fprintf(&sb, "  %s\n", truncate(strings.ReplaceAll(f, "\n", " "), 2*promptWidth))
+		}
+	}
+	return sb.String()
+}
+
+// redraw replaces the status block, it must be called with the lock held.
+func (d *Display) redraw() {
+	d.clear()
+	d.draw()
+}
+
+func (d *Display) clear() {
+	if d.lines == 0 {
+		return
+	}
+	// Move to the first line of the block and clear the rest of the screen
+	fmt.Fprintf(d.w, "\x1b[%dF\x1b[J", d.lines)
+	d.lines = 0
+}
+
+func (d *Display) draw() {
+	block := d.render()
+	_, _ = io.WriteString(d.w, block)
+	d.lines = strings.Count(block, "\n")
+}
+
+// truncate returns the first n characters of s.
+func truncate(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i] + "…"
+		}
+		n--
+	}
+	return s
+}
@@ -0,0 +1,119 @@
+package tui
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+)
+
+func events() []*ai.GenerateInfo {
+	now := time.Now().UTC()
+	return []*ai.GenerateInfo{
+		{Type: ai.EventPromptQueued, Status: ai.Wait, PromptIndex: 0, Time: now},
+		{Type: ai.EventPromptQueued, Status: ai.Wait, PromptIndex: 1, Time: now},
+		{Type: ai.EventPromptStarted, Status: ai.Started, PromptIndex: 0, Attempt: 1, Time: now},
+		{Type: ai.EventImagineSent, Status: ai.Stage, PromptIndex: 0, Attempt: 1, Time: now},
+		{Type: ai.EventPromptStarted, Status: ai.Started, PromptIndex: 1, Attempt: 2, Time: now},
+		{Type: ai.EventJobQueued, Status: ai.Stage, PromptIndex: 1, Attempt: 2, Time: now},
+		{Type: ai.EventPreviewReceived, Status: ai.Complete, PromptIndex: 0, Attempt: 1, Time: now.Add(time.Minute),
+			Duration: time.Minute, Elapsed: time.Minute,
+			Image: &ai.Image{URL: "https://foo.bar/a.png", Preview: true, IsLast: true}},
+		{Type: ai.EventPromptFailed, Status: ai.Fail, PromptIndex: 1, Attempt: 2, Time: now.Add(time.Minute),
+			Err: errors.New("banned prompt")},
+	}
+}
+
+func TestPlain(t *testing.T) {
+	var buf bytes.Buffer
+	prompts := ai.NewPrompts([]string{"a cat", "a dog"}, ai.Options{})
+	d := New(&buf, prompts, nil, false)
+	for _, info := range events() {
+		d.Event(info)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 9 {
+		t.Fatalf("expected 9 lines, got %d:\n%s", len(lines), buf.String())
+	}
+	for i, want := range []string{
+		"type=prompt.queued prompt=0 progress=0.0%",
+		"type=job.queued prompt=1 attempt=2",
+		`type=preview.received prompt=0 attempt=1 duration=1m0s elapsed=1m0s image=0 url="https://foo.bar/a.png" progress=50.0%`,
+		`type=prompt.failed prompt=1 attempt=2 error="banned prompt"`,
+		"type=summary progress=50.0% images=4/8 prompts=1/2 failed=1",
+	} {
+		idx := []int{0, 5, 6, 7, 8}[i]
+		if !strings.Contains(lines[idx], want) {
+			t.Errorf("line %d: expected %q, got %q", idx, want, lines[idx])
+		}
+	}
+}
+
+func TestInteractive(t *testing.T) {
+	var buf bytes.Buffer
+	prompts := ai.NewPrompts([]string{"a cat", "a dog", "a bird"}, ai.Options{})
+	d := New(&buf, prompts, nil, true)
+	evs := events()
+	// The second prompt is still queued by the bot
+	for _, info := range evs[:len(evs)-1] {
+		d.Event(info)
+	}
+	d.lck.Lock()
+	block := d.render()
+	d.lck.Unlock()
+	for _, want := range []string{
+		" 33.3% [#########---------------------] 4/12 images",
+		"prompts: 1/3 done · 1 running · 0 waiting · 1 queued by bot · 0 failed",
+		"speed: 4.0 images/min",
+		"#1    job.queued",
+		"a dog (attempt 2)",
+	} {
+		if !strings.Contains(block, want) {
+			t.Errorf("expected %q in:\n%s", want, block)
+		}
+	}
+
+	// Log lines are written above the block
+	if _, err := d.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	d.Event(evs[len(evs)-1])
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "\x1b[J") || !strings.Contains(out, "hello\n") {
+		t.Errorf("unexpected output %q", out)
+	}
+	if !strings.HasSuffix(out, "failures:\n  #1: banned prompt\n") {
+		t.Errorf("expected failures at the end of %q", out)
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	var buf bytes.Buffer
+	prompts := ai.NewPrompts([]string{"a cat"}, ai.Options{})
+	d := New(&buf, prompts, nil, false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = d.Close()
+		}()
+	}
+	wg.Wait()
+	// The summary is written once
+	if n := strings.Count(buf.String(), "type=summary"); n != 1 {
+		t.Errorf("expected 1 summary, got %d:\n%s", n, buf.String())
+	}
+}
@@ -0,0 +1,330 @@
+// Package webhook delivers signed JSON payloads to HTTP endpoints.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/logging"
+	"github.com/ZYKJShadow/bulkai/pkg/retry"
+)
+
+// Headers sent with each delivery.
+const (
+	SignatureHeader = "X-Bulkai-Signature"
+	EventHeader     = "X-Bulkai-Event"
+)
+
+// Config configures the webhook deliveries.
+type Config struct {
+	// URLs are the endpoints that receive the payloads
+	URLs []string
+	// Secret signs the payloads with HMAC-SHA256, they aren't signed if empty
+	Secret string
+	// Retry is the policy used when a delivery fails, DefaultRetryPolicy if
+	// nil
+	Retry *retry.Policy
+	// DeadLetter is the file where the payloads that couldn't be delivered
+	// are appended, they are only logged if empty
+	DeadLetter string
+	// Client is the http client, a client with a 30 seconds timeout is
+	// used if nil
+	Client *http.Client
+	// CloseTimeout is how long Close waits for the queued payloads to be
+	// delivered, DefaultCloseTimeout if zero. Payloads still pending are
+	// written to the dead letter file.
+	CloseTimeout time.Duration
+	// Logger is used for the failed deliveries, slog.Default() if nil
+	Logger *slog.Logger
+}
+
+// DefaultCloseTimeout is how long Close waits for the queued payloads by
+// default.
+const DefaultCloseTimeout = 10 * time.Second
+
+// DefaultRetryPolicy returns the policy used to retry deliveries: up to 5
+// attempts waiting from 1 second to 1 minute between them.
+func DefaultRetryPolicy() *retry.Policy {
+	return &retry.Policy{
+		MaxAttempts: 5,
+		Base:        time.Second,
+		Cap:         time.Minute,
+		Jitter:      0.1,
+	}
+}
+
+// DeadLetter is a payload that couldn't be delivered.
+type DeadLetter struct {
+	Time     time.Time       `json:"time"`
+	URL      string          `json:"url"`
+	Event    string          `json:"event"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+type delivery struct {
+	event   string
+	payload []byte
+}
+
+// Notifier posts payloads to the configured URLs.
+// Each URL has its own worker so payloads are delivered in order and a slow
+// endpoint doesn't delay the rest.
+type Notifier struct {
+	cfg    *Config
+	client *http.Client
+	policy *retry.Policy
+	log    *slog.Logger
+	wg     sync.WaitGroup
+	// ctx is cancelled when Close gives up waiting, it interrupts the
+	// requests and the waits between attempts
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lck     sync.Mutex
+	closed  bool
+	queues  []*queue
+	deadLck sync.Mutex
+}
+
+type queue struct {
+	url     string
+	lck     sync.Mutex
+	pending []*delivery
+	changed chan struct{}
+	closed  bool
+}
+
+// New creates a notifier and starts its workers.
+func New(cfg *Config) (*Notifier, error) {
+	for _, u := range cfg.URLs {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("webhook: invalid url %q", u)
+		}
+	}
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	policy := cfg.Retry
+	if policy == nil {
+		policy = DefaultRetryPolicy()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		cfg:    cfg,
+		client: client,
+		policy: policy,
+		log:    logging.OrDefault(cfg.Logger),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for _, u := range cfg.URLs {
+		q := &queue{url: u, changed: make(chan struct{}, 1)}
+		n.queues = append(n.queues, q)
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			n.run(q)
+		}()
+	}
+	return n, nil
+}
+
+// Send queues the payload to be delivered to all the URLs, event is its
+// type and is sent in the event header.
+func (n *Notifier) Send(event string, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("webhook: couldn't marshal payload: %w", err)
+	}
+	n.lck.Lock()
+	defer n.lck.Unlock()
+	if n.closed {
+		return fmt.Errorf("webhook: notifier closed")
+	}
+	d := &delivery{event: event, payload: payload}
+	for _, q := range n.queues {
+		q.lck.Lock()
+		q.pending = append(q.pending, d)
+		q.lck.Unlock()
+		select {
+		case q.changed <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Close stops accepting payloads and waits until the queued ones are
+// delivered or written to the dead letter file. Deliveries still pending
+// after the close timeout are interrupted and written to the dead letter
+// file.
+func (n *Notifier) Close() error {
+	n.lck.Lock()
+	if n.closed {
+		n.lck.Unlock()
+		return nil
+	}
+	n.closed = true
+	for _, q := range n.queues {
+		q.lck.Lock()
+		q.closed = true
+		q.lck.Unlock()
+		select {
+		case q.changed <- struct{}{}:
+		default:
+		}
+	}
+	n.lck.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	timeout := n.cfg.CloseTimeout
+	if timeout <= 0 {
+		timeout = DefaultCloseTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	defer n.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+	}
+	n.cancel()
+	<-done
+	return fmt.Errorf("webhook: payloads not delivered in %s were written to the dead letter file", timeout)
+}
+
+// run delivers the payloads of the queue until it is closed and drained.
+func (n *Notifier) run(q *queue) {
+	for {
+		q.lck.Lock()
+		if len(q.pending) == 0 {
+			closed := q.closed
+			q.lck.Unlock()
+			if closed {
+				return
+			}
+			<-q.changed
+			continue
+		}
+		d := q.pending[0]
+		q.pending = q.pending[1:]
+		q.lck.Unlock()
+		n.deliver(q.url, d)
+	}
+}
+
+// deliver posts the payload, retrying until the policy gives up or the
+// notifier is closed. Payloads that couldn't be delivered are written to the
+// dead letter file.
+func (n *Notifier) deliver(u string, d *delivery) {
+	err := fmt.Errorf("webhook: notifier closed")
+	attempts := 0
+	for n.ctx.Err() == nil {
+		err = n.post(u, d)
+		attempts++
+		if err == nil {
+			return
+		}
+		wait, ok := n.policy.Delay(attempts)
+		if !ok {
+			break
+		}
+		n.log.Warn("webhook: delivery will be retried", "url", u, "event", d.event, "wait", wait, "error", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-n.ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+	n.log.Error("webhook: couldn't deliver", "url", u, "event", d.event, "attempts", attempts, "error", err)
+	if err := n.deadLetter(&DeadLetter{
+		Time:     time.Now().UTC(),
+		URL:      u,
+		Event:    d.event,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Payload:  d.payload,
+	}); err != nil {
+		n.log.Error("webhook: couldn't write dead letter", "error", err)
+	}
+}
+
+func (n *Notifier) post(u string, d *delivery) error {
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodPost, u, bytes.NewReader(d.payload))
+	if err != nil {
+		return fmt.Errorf("webhook: couldn't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, d.event)
+	if n.cfg.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(n.cfg.Secret, d.payload))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: couldn't post: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (n *Notifier) deadLetter(dl *DeadLetter) error {
+	if n.cfg.DeadLetter == "" {
+		return nil
+	}
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("webhook: couldn't marshal dead letter: %w", err)
+	}
+	n.deadLck.Lock()
+	defer n.deadLck.Unlock()
+	if err := os.MkdirAll(filepath.Dir(n.cfg.DeadLetter), 0755); err != nil {
+		return fmt.Errorf("webhook: couldn't create directory: %w", err)
+	}
+	f, err := os.OpenFile(n.cfg.DeadLetter, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("webhook: couldn't open dead letter file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("webhook: couldn't write dead letter: %w", err)
+	}
+	return nil
+}
+
+// Sign returns the signature header value of the payload.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether the signature header value matches the payload.
+func Verify(secret string, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, payload)), []byte(signature))
+}
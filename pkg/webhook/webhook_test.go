@@ -0,0 +1,181 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/retry"
+)
+
+type receiver struct {
+	*httptest.Server
+	lck    sync.Mutex
+	fail   int
+	events []string
+	bodies []string
+	sigs   []string
+}
+
+func newReceiver(fail int) *receiver {
+	r := &receiver{fail: fail}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.lck.Lock()
+		defer r.lck.Unlock()
+		if r.fail != 0 {
+			r.fail--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.events = append(r.events, req.Header.Get(EventHeader))
+		r.bodies = append(r.bodies, string(body))
+		r.sigs = append(r.sigs, req.Header.Get(SignatureHeader))
+	}))
+	return r
+}
+
+func testPolicy(attempts int) *retry.Policy {
+	return &retry.Policy{MaxAttempts: attempts, Base: time.Millisecond}
+}
+
+func TestSend(t *testing.T) {
+	r := newReceiver(2)
+	defer r.Close()
+	n, err := New(&Config{
+		URLs:   []string{r.URL},
+		Secret: "secret",
+		Retry:  testPolicy(3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{"prompt.started", "image.completed"} {
+		if err := n.Send(e, map[string]string{"type": e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Send("album.finished", nil); err == nil {
+		t.Error("expected error sending to a closed notifier")
+	}
+
+	// The first payload is retried and the order is kept
+	want := []string{"prompt.started", "image.completed"}
+	if len(r.events) != len(want) {
+		t.Fatalf("expected %v, got %v", want, r.events)
+	}
+	for i := range want {
+		if r.events[i] != want[i] {
+			t.Errorf("expected %s, got %s", want[i], r.events[i])
+		}
+		if !Verify("secret", []byte(r.bodies[i]), r.sigs[i]) {
+			t.Errorf("invalid signature %s for %s", r.sigs[i], r.bodies[i])
+		}
+		if Verify("other", []byte(r.bodies[i]), r.sigs[i]) {
+			t.Error("signature verified with the wrong secret")
+		}
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	r := newReceiver(-1)
+	defer r.Close()
+	ok := newReceiver(0)
+	defer ok.Close()
+	file := filepath.Join(t.TempDir(), "dead_letter.jsonl")
+	n, err := New(&Config{
+		URLs:       []string{r.URL, ok.URL},
+		Retry:      testPolicy(2),
+		DeadLetter: file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Send("prompt.failed", map[string]int{"index": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ok.events) != 1 {
+		t.Errorf("expected 1 delivery to the working url, got %d", len(ok.events))
+	}
+	if ok.sigs[0] != "" {
+		t.Errorf("expected no signature, got %s", ok.sigs[0])
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dl DeadLetter
+	if err := json.Unmarshal(data, &dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.URL != r.URL || dl.Event != "prompt.failed" || dl.Attempts != 2 {
+		t.Errorf("unexpected dead letter: %+v", dl)
+	}
+	if string(dl.Payload) != `{"index":3}` {
+		t.Errorf("unexpected payload: %s", dl.Payload)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	// The endpoint never answers
+	block := make(chan struct{})
+	r := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-block
+	}))
+	defer r.Close()
+	defer close(block)
+	file := filepath.Join(t.TempDir(), "dead_letter.jsonl")
+	n, err := New(&Config{
+		URLs:         []string{r.URL},
+		Retry:        testPolicy(5),
+		DeadLetter:   file,
+		CloseTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{"prompt.started", "album.stopped"} {
+		if err := n.Send(e, map[string]string{"type": e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	if err := n.Close(); err == nil {
+		t.Error("expected error closing with pending payloads")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("close took %s", elapsed)
+	}
+
+	// The interrupted and the queued payloads are written to the dead
+	// letter file
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(line), &dl); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, dl.Event)
+	}
+	if len(events) != 2 || events[0] != "prompt.started" || events[1] != "album.stopped" {
+		t.Errorf("unexpected dead letters %v", events)
+	}
+}
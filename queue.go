@@ -0,0 +1,271 @@
+package bulkai
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+	"github.com/ZYKJShadow/bulkai/pkg/store"
+)
+
+// QueueFileName is the name of the job store in the output directory.
+const QueueFileName = "queue.db"
+
+// jobQueue is the queue of the client workers. The prompts of the running
+// jobs are claimed from the store, so jobs are processed in the order they
+// were submitted and their progress survives restarts.
+type jobQueue struct {
+	store   *store.Store
+	log     *slog.Logger
+	metrics *generationMetrics
+
+	lck     sync.Mutex
+	jobs    map[string]*queuedJob
+	changed chan struct{}
+}
+
+type queuedJob struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	out    chan *ai.GenerateInfo
+	ended  chan struct{}
+	// inflight is the number of tasks of the job being processed
+	inflight int
+	// err is the error that stopped the job
+	err error
+}
+
+func newJobQueue(s *store.Store, logger *slog.Logger, m *generationMetrics) *jobQueue {
+	return &jobQueue{
+		store:   s,
+		log:     logger,
+		metrics: m,
+		jobs:    make(map[string]*queuedJob),
+		changed: make(chan struct{}),
+	}
+}
+
+// add registers a job enqueued in the store so its prompts can be claimed by
+// the workers. The returned channel receives the job events and is closed
+// once the job has no more pending prompts or its context is done.
+func (q *jobQueue) add(ctx context.Context, id string) (<-chan *ai.GenerateInfo, error) {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	if _, ok := q.jobs[id]; ok {
+		return nil, errors.New("job is already running")
+	}
+	// Each run of the job has its own context, so it gets a new budget
+	ctx, cancel := context.WithCancel(ctx)
+	j := &queuedJob{
+		ctx:    ctx,
+		cancel: cancel,
+		out:    make(chan *ai.GenerateInfo),
+		ended:  make(chan struct{}),
+	}
+	q.jobs[id] = j
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.lck.Lock()
+			defer q.lck.Unlock()
+			q.check(id)
+		case <-j.ended:
+		}
+	}()
+	q.check(id)
+	q.notify()
+	return j.out, nil
+}
+
+// Next claims the first pending prompt of the running jobs.
+func (q *jobQueue) Next(ctx context.Context) (*ai.Task, bool) {
+	for {
+		q.lck.Lock()
+		it, next, err := q.store.Claim(time.Now(), func(id string) bool {
+			j, ok := q.jobs[id]
+			return ok && j.ctx.Err() == nil && j.err == nil
+		})
+		if err != nil {
+			q.log.Error("couldn't claim prompt", "error", err)
+			next = time.Now().Add(time.Second)
+		}
+		if it != nil {
+			j := q.jobs[it.Job]
+			j.inflight++
+			q.metrics.inflight.Inc()
+			q.lck.Unlock()
+			t := &ai.Task{
+				Job:      it.Job,
+				Prompt:   it.Prompt,
+				Index:    it.Index,
+				Options:  it.Options,
+				Attempts: it.Attempts,
+			}
+			t = t.WithContext(j.ctx)
+			j.out <- &ai.GenerateInfo{
+				Status:      ai.Started,
+				Type:        ai.EventPromptStarted,
+				Task:        t,
+				PromptIndex: t.Index,
+				Attempt:     t.Attempts + 1,
+				Time:        time.Now().UTC(),
+			}
+			return t, true
+		}
+		changed := q.changed
+		q.lck.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil, false
+		}
+	}
+}
+
+// Imagined marks the prompt as upscaling.
+func (q *jobQueue) Imagined(t *ai.Task) {
+	if err := q.store.Update(t.Job, t.Index, store.Upscaling, ""); err != nil {
+		q.log.Error("couldn't update prompt", "album", t.Job, "prompt", t.Index, "error", err)
+	}
+}
+
+// Retry sets the prompt back to pending until the delay has passed.
+func (q *jobQueue) Retry(t *ai.Task, delay time.Duration, err error) {
+	q.metrics.done(err, true)
+	if err := q.store.Retry(t.Job, t.Index, time.Now().Add(delay), err.Error()); err != nil {
+		q.log.Error("couldn't retry prompt", "album", t.Job, "prompt", t.Index, "error", err)
+	}
+	q.release(t)
+}
+
+// Done marks the prompt as done or failed. Prompts stopped by a fatal error
+// or by their job being cancelled are set back to pending so they are
+// processed when the job is resumed.
+func (q *jobQueue) Done(t *ai.Task, err error) {
+	state := store.Done
+	var msg string
+	if err != nil {
+		state = store.Failed
+		msg = err.Error()
+		var aiErr ai.Error
+		if (errors.As(err, &aiErr) && aiErr.Fatal()) || errors.Is(err, context.Canceled) || t.Context().Err() != nil {
+			state = store.Pending
+		}
+	}
+	// Prompts set back to pending will be processed again
+	q.metrics.done(err, state == store.Pending)
+	if err := q.store.Update(t.Job, t.Index, state, msg); err != nil {
+		q.log.Error("couldn't update prompt", "album", t.Job, "prompt", t.Index, "error", err)
+	}
+	if err := q.store.Err(); err != nil {
+		q.log.Warn("couldn't compact job store", "error", err)
+	}
+	q.release(t)
+}
+
+// Stop pauses the job of the task, its pending prompts aren't claimed and the
+// job ends with the error once its running prompts are done.
+func (q *jobQueue) Stop(t *ai.Task, err error) {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	j, ok := q.jobs[t.Job]
+	if !ok {
+		return
+	}
+	if j.err == nil {
+		j.err = err
+	}
+	q.check(t.Job)
+}
+
+func (q *jobQueue) release(t *ai.Task) {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	if j, ok := q.jobs[t.Job]; ok {
+		j.inflight--
+	}
+	q.check(t.Job)
+	q.notify()
+}
+
+// emit sends an event to the job of the task.
+func (q *jobQueue) emit(t *ai.Task, info *ai.GenerateInfo) {
+	q.metrics.event(info)
+	q.lck.Lock()
+	j, ok := q.jobs[t.Job]
+	q.lck.Unlock()
+	if ok {
+		j.out <- info
+	}
+}
+
+// check ends the job if it has nothing left to do, it must be called with
+// the lock held.
+func (q *jobQueue) check(id string) {
+	j, ok := q.jobs[id]
+	if !ok || j.inflight > 0 {
+		return
+	}
+	if j.ctx.Err() == nil && j.err == nil && q.store.Count(id, store.Pending) > 0 {
+		return
+	}
+	delete(q.jobs, id)
+	// The error of a stopped job is sent without holding the lock
+	go j.end(nil)
+}
+
+// drain removes all the jobs, it is called once the workers have stopped
+// so the jobs can be ended.
+func (q *jobQueue) drain() []*queuedJob {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	jobs := make([]*queuedJob, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		jobs = append(jobs, j)
+	}
+	q.jobs = make(map[string]*queuedJob)
+	return jobs
+}
+
+// end closes the job events, err is the fatal error that stopped the
+// workers if any. Jobs stopped by their own error end with it.
+func (j *queuedJob) end(err error) {
+	close(j.ended)
+	j.cancel()
+	if j.err != nil {
+		err = j.err
+	}
+	if err != nil {
+		j.out <- &ai.GenerateInfo{
+			Status:      ai.Fatal,
+			Type:        ai.EventFatal,
+			Err:         err,
+			PromptIndex: -1,
+			Time:        time.Now().UTC(),
+		}
+	}
+	close(j.out)
+}
+
+// notify wakes up the workers waiting for prompts, it must be called with
+// the lock held.
+func (q *jobQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
@@ -0,0 +1,106 @@
+package bulkai
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai/midjourney"
+	"github.com/ZYKJShadow/bulkai/pkg/discord"
+	"github.com/ZYKJShadow/bulkai/pkg/retry"
+)
+
+// RetryPolicy configures how temporary errors are retried.
+// Unset fields keep the default values and new overrides inherit the values
+// of the parent policy. Overrides are keyed by error class (e.g. queue-full)
+// and are also applied to non temporary errors of that class.
+type RetryPolicy struct {
+	MaxAttempts *int                    `yaml:"max-attempts"`
+	Base        *time.Duration          `yaml:"base"`
+	Cap         *time.Duration          `yaml:"cap"`
+	Factor      *float64                `yaml:"factor"`
+	Jitter      *float64                `yaml:"jitter"`
+	Overrides   map[string]*RetryPolicy `yaml:"overrides"`
+}
+
+// retryErrors are the error classes that can be used in retry overrides.
+var retryErrors = map[string]error{
+	"timeout":           context.DeadlineExceeded,
+	"bad-gateway":       discord.ErrBadGateway,
+	"unknown-message":   discord.ErrMessageNotFound,
+	"message-not-found": midjourney.ErrMessageNotFound,
+	"invalid-parameter": midjourney.ErrInvalidParameter,
+	"invalid-link":      midjourney.ErrInvalidLink,
+	"banned-prompt":     midjourney.ErrBannedPrompt,
+	"action-needed":     midjourney.ErrActionNeeded,
+	"job-queued":        midjourney.ErrJobQueued,
+	"queue-full":        midjourney.ErrQueueFull,
+}
+
+// apply returns a copy of the base policy with the configured values.
+func (r *RetryPolicy) apply(base *retry.Policy) (*retry.Policy, error) {
+	if r == nil {
+		return base, nil
+	}
+	p := *base
+	p.Overrides = nil
+	r.set(&p)
+	if p.MaxAttempts < 1 {
+		return nil, fmt.Errorf("invalid max attempts: %d", p.MaxAttempts)
+	}
+
+	// Default overrides are kept unless they are configured
+	overrides := make(map[error]retry.Policy)
+	var order []error
+	for _, o := range base.Overrides {
+		if r.MaxAttempts != nil {
+			o.Policy.MaxAttempts = *r.MaxAttempts
+		}
+		overrides[o.Err] = o.Policy
+		order = append(order, o.Err)
+	}
+	names := make([]string, 0, len(r.Overrides))
+	for name := range r.Overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err, ok := retryErrors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown error class: %s", name)
+		}
+		o, ok := overrides[err]
+		if !ok {
+			o = p
+			order = append(order, err)
+		}
+		r.Overrides[name].set(&o)
+		overrides[err] = o
+	}
+	for _, err := range order {
+		p.Overrides = append(p.Overrides, retry.Override{Err: err, Policy: overrides[err]})
+	}
+	return &p, nil
+}
+
+func (r *RetryPolicy) set(p *retry.Policy) {
+	if r == nil {
+		return
+	}
+	if r.MaxAttempts != nil {
+		p.MaxAttempts = *r.MaxAttempts
+	}
+	if r.Base != nil {
+		p.Base = *r.Base
+	}
+	if r.Cap != nil {
+		p.Cap = *r.Cap
+	}
+	if r.Factor != nil {
+		p.Factor = *r.Factor
+	}
+	if r.Jitter != nil {
+		p.Jitter = *r.Jitter
+	}
+}
@@ -0,0 +1,51 @@
+package bulkai
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+	"github.com/ZYKJShadow/bulkai/pkg/ai/midjourney"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	data := `
+max-attempts: 3
+base: 1m
+jitter: 0.1
+overrides:
+  queue-full:
+    base: 30s
+    max-attempts: 10
+`
+	var cfg RetryPolicy
+	if err := yaml.UnmarshalStrict([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	p, err := cfg.apply(ai.DefaultRetryPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxAttempts != 3 || p.Base != time.Minute || p.Cap != 10*time.Minute || p.Jitter != 0.1 {
+		t.Errorf("unexpected policy: %+v", p)
+	}
+
+	// Default timeout override is kept
+	got, ok := p.Match(context.DeadlineExceeded)
+	if !ok || got.Base != 0 || got.MaxAttempts != 3 {
+		t.Errorf("unexpected timeout policy: %+v", got)
+	}
+
+	// Configured override inherits the parent values
+	got, ok = p.Match(midjourney.ErrQueueFull)
+	if !ok || got.Base != 30*time.Second || got.MaxAttempts != 10 || got.Jitter != 0.1 {
+		t.Errorf("unexpected queue full policy: %+v", got)
+	}
+
+	cfg.Overrides["unknown"] = &RetryPolicy{}
+	if _, err := cfg.apply(ai.DefaultRetryPolicy()); err == nil {
+		t.Error("expected error for unknown error class")
+	}
+}
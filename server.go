@@ -0,0 +1,638 @@
+package bulkai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+	"github.com/ZYKJShadow/bulkai/pkg/album"
+	"github.com/ZYKJShadow/bulkai/pkg/prompt"
+)
+
+// JobsFileName is the file in the output directory where the jobs of the
+// server are stored.
+const JobsFileName = "jobs.json"
+
+// Job statuses set by the server, the rest are taken from the album status
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobFailed  = "failed"
+)
+
+// Job is a generation submitted to the server.
+// Each job generates an album with the same id.
+type Job struct {
+	ID      string       `json:"id"`
+	Prompts []*ai.Prompt `json:"prompts"`
+	// Variation and Upscale are the default options of the prompts
+	Variation bool      `json:"variation"`
+	Upscale   bool      `json:"upscale"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Progress taken from the album
+	Percentage float32    `json:"percentage"`
+	ETA        *time.Time `json:"eta,omitempty"`
+	Finished   int        `json:"finished"`
+	Images     int        `json:"images"`
+}
+
+// JobRequest is the body used to submit a job.
+// Prompts are either strings or objects with their own options, variation
+// and upscale are the defaults of the prompts and default to the
+// configuration values.
+type JobRequest struct {
+	ID        string          `json:"id"`
+	Prompts   []*prompt.Entry `json:"prompts"`
+	Variation *bool           `json:"variation"`
+	Upscale   *bool           `json:"upscale"`
+}
+
+// Event is an ai.GenerateInfo sent to the event stream of a job.
+// Durations are in milliseconds.
+type Event struct {
+	Type        string      `json:"type"`
+	Status      string      `json:"status"`
+	PromptIndex int         `json:"prompt_index"`
+	Attempt     int         `json:"attempt,omitempty"`
+	Time        time.Time   `json:"time"`
+	Duration    int64       `json:"duration,omitempty"`
+	Elapsed     int64       `json:"elapsed,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	Image       *EventImage `json:"image,omitempty"`
+}
+
+type EventImage struct {
+	URL         string `json:"url"`
+	Prompt      string `json:"prompt"`
+	Preview     bool   `json:"preview"`
+	PromptIndex int    `json:"prompt_index"`
+	ImageIndex  int    `json:"image_index"`
+	GridIndex   int    `json:"grid_index"`
+	Variation   int    `json:"variation"`
+	IsLast      bool   `json:"is_last"`
+}
+
+func newEvent(info *ai.GenerateInfo) *Event {
+	e := &Event{
+		Type:        string(info.Type),
+		Status:      info.Status.String(),
+		PromptIndex: info.PromptIndex,
+		Attempt:     info.Attempt,
+		Time:        info.Time,
+		Duration:    info.Duration.Milliseconds(),
+		Elapsed:     info.Elapsed.Milliseconds(),
+	}
+	if info.Err != nil {
+		e.Error = info.Err.Error()
+	}
+	if img := info.Image; img != nil {
+		e.Image = &EventImage{
+			URL:         img.URL,
+			Prompt:      img.Prompt,
+			Preview:     img.Preview,
+			PromptIndex: img.PromptIndex,
+			ImageIndex:  img.ImageIndex,
+			GridIndex:   img.GridIndex,
+			Variation:   img.Variation,
+			IsLast:      img.IsLast,
+		}
+	}
+	return e
+}
+
+// Server exposes the client as an HTTP/JSON API.
+//
+//	GET  /jobs                 list jobs
+//	POST /jobs                 submit a job
+//	GET  /jobs/{id}            get a job
+//	GET  /jobs/{id}/images     list the images of a job
+//	GET  /jobs/{id}/files/...  download the files of a job
+//	GET  /jobs/{id}/events     stream the job events (server-sent events)
+//	POST /jobs/{id}/cancel     cancel a running job
+//	POST /jobs/{id}/resume     resume a stopped job
+type Server struct {
+	cli  *AiDrawClient
+	ctx  context.Context
+	file string
+
+	lck  sync.Mutex
+	jobs map[string]*job
+	ids  []string
+	wg   sync.WaitGroup
+}
+
+type job struct {
+	Job
+	cancel context.CancelFunc
+	// started is closed once the job container was created
+	started chan struct{}
+	// done is closed once the job stopped and its status was saved
+	done chan struct{}
+}
+
+// NewServer creates a server using the client.
+// Jobs stored in the output directory are loaded and the ones that were
+// running are resumed. They are cancelled when the context is done.
+func NewServer(ctx context.Context, cli *AiDrawClient) (*Server, error) {
+	s := &Server{
+		cli:  cli,
+		ctx:  ctx,
+		file: filepath.Join(cli.cfg.Output, JobsFileName),
+		jobs: make(map[string]*job),
+	}
+	data, err := os.ReadFile(s.file)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("couldn't read jobs file: %w", err)
+	default:
+		var jobs []*Job
+		if err := json.Unmarshal(data, &jobs); err != nil {
+			return nil, fmt.Errorf("couldn't parse jobs file %s: %w", s.file, err)
+		}
+		for _, j := range jobs {
+			s.jobs[j.ID] = &job{Job: *j}
+			s.ids = append(s.ids, j.ID)
+		}
+	}
+
+	var runs []func()
+	s.lck.Lock()
+	for _, id := range s.ids {
+		j := s.jobs[id]
+		if j.Status != JobQueued && j.Status != JobRunning {
+			continue
+		}
+		cli.log.Info("resuming job", "album", id)
+		runs = append(runs, s.start(j))
+	}
+	s.lck.Unlock()
+	for _, run := range runs {
+		run()
+	}
+	return s, nil
+}
+
+// Wait waits for the running jobs to stop.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+// Serve listens on the address until the context is done, then it waits for
+// the running jobs to stop.
+func Serve(ctx context.Context, cli *AiDrawClient, addr string) error {
+	s, err := NewServer(ctx, cli)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: s,
+	}
+	errC := make(chan error, 1)
+	go func() {
+		cli.log.Info("server listening", "addr", addr)
+		errC <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errC:
+		return fmt.Errorf("couldn't serve: %w", err)
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		cli.log.Error("couldn't shutdown server", "error", err)
+	}
+	s.Wait()
+	return nil
+}
+
+var jobIDRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Submit adds a new job and starts it.
+func (s *Server) Submit(req *JobRequest) (*Job, error) {
+	if len(req.Prompts) == 0 {
+		return nil, errors.New("missing prompts")
+	}
+	id := req.ID
+	if id == "" {
+		id = time.Now().UTC().Format("20060102_150405.000")
+	}
+	if !jobIDRegex.MatchString(id) {
+		return nil, fmt.Errorf("invalid job id %q", id)
+	}
+	variation := s.cli.cfg.Variation
+	if req.Variation != nil {
+		variation = *req.Variation
+	}
+	upscale := s.cli.cfg.Upscale
+	if req.Upscale != nil {
+		upscale = *req.Upscale
+	}
+	// Prompt files aren't read so clients can't access the server files
+	prompts, err := LoadPrompts(s.cli.cfg, req.Prompts, false, ai.DefaultOptions(variation, upscale))
+	if err != nil {
+		return nil, err
+	}
+
+	s.lck.Lock()
+	if _, ok := s.jobs[id]; ok {
+		s.lck.Unlock()
+		return nil, fmt.Errorf("%w: %s", errJobExists, id)
+	}
+	if _, err := os.Stat(filepath.Join(s.cli.cfg.Output, id)); err == nil {
+		s.lck.Unlock()
+		return nil, fmt.Errorf("%w: album %s", errJobExists, id)
+	}
+	now := time.Now().UTC()
+	j := &job{
+		Job: Job{
+			ID:        id,
+			Prompts:   prompts,
+			Variation: variation,
+			Upscale:   upscale,
+			Status:    JobQueued,
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+	}
+	s.jobs[id] = j
+	s.ids = append(s.ids, id)
+	run := s.start(j)
+	js := j.Job
+	s.lck.Unlock()
+	run()
+	return &js, nil
+}
+
+var errJobExists = errors.New("job already exists")
+var errJobNotFound = errors.New("job not found")
+var errJobState = errors.New("invalid job state")
+
+// Cancel stops a running job.
+func (s *Server) Cancel(id string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return errJobNotFound
+	}
+	if j.cancel == nil {
+		return fmt.Errorf("%w: job %s isn't running", errJobState, id)
+	}
+	j.cancel()
+	return nil
+}
+
+// Resume starts again a job that was stopped.
+func (s *Server) Resume(id string) error {
+	s.lck.Lock()
+	j, ok := s.jobs[id]
+	if !ok {
+		s.lck.Unlock()
+		return errJobNotFound
+	}
+	if j.cancel != nil {
+		s.lck.Unlock()
+		return fmt.Errorf("%w: job %s is running", errJobState, id)
+	}
+	if j.Status == "finished" {
+		s.lck.Unlock()
+		return fmt.Errorf("%w: job %s is finished", errJobState, id)
+	}
+	j.Error = ""
+	run := s.start(j)
+	s.lck.Unlock()
+	run()
+	return nil
+}
+
+// Job returns a job along with its progress.
+func (s *Server) Job(id string) (*Job, error) {
+	s.lck.Lock()
+	j, ok := s.jobs[id]
+	var js Job
+	if ok {
+		js = j.Job
+	}
+	s.lck.Unlock()
+	if !ok {
+		return nil, errJobNotFound
+	}
+	a, err := s.album(id)
+	if err != nil {
+		return nil, err
+	}
+	if a != nil {
+		js.Percentage = a.Percentage
+		js.ETA = a.ETA
+		js.Finished = len(a.Finished)
+		js.Images = len(a.Images)
+	}
+	return &js, nil
+}
+
+// Jobs returns all the jobs in submission order.
+func (s *Server) Jobs() ([]*Job, error) {
+	s.lck.Lock()
+	ids := append([]string{}, s.ids...)
+	s.lck.Unlock()
+	jobs := make([]*Job, 0, len(ids))
+	for _, id := range ids {
+		j, err := s.Job(id)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+func (s *Server) album(id string) (*Album, error) {
+	return LoadAlbum(filepath.Join(s.cli.cfg.Output, id, album.FileName))
+}
+
+// start registers the job as running, it must be called with the lock held.
+// The returned function launches the generation and must be called without
+// the lock, so requests aren't blocked while the album is set up.
+func (s *Server) start(j *job) func() {
+	ctx, cancel := context.WithCancel(s.ctx)
+	started := make(chan struct{})
+	j.cancel = cancel
+	j.started = started
+	j.done = make(chan struct{})
+	j.Status = JobRunning
+	j.UpdatedAt = time.Now().UTC()
+	s.save()
+	s.wg.Add(1)
+	return func() { s.run(ctx, cancel, j, started) }
+}
+
+// run generates the job until it stops and saves its final status.
+func (s *Server) run(ctx context.Context, cancel context.CancelFunc, j *job, started chan struct{}) {
+	// The job container is created before returning so subscribers don't
+	// miss events
+	err := s.cli.GeneratePrompts(ctx, j.Prompts, j.ID)
+	var sub *Subscription
+	if err == nil {
+		sub = s.cli.Subscribe(j.ID, false)
+	}
+	close(started)
+
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+		if sub != nil {
+			for range sub.C() {
+			}
+		}
+
+		// Take the status from the album
+		status := JobFailed
+		if err == nil {
+			a, albumErr := s.album(j.ID)
+			switch {
+			case albumErr != nil:
+				err = albumErr
+			case a != nil:
+				status = a.Status
+			}
+		}
+
+		s.lck.Lock()
+		defer s.lck.Unlock()
+		j.cancel = nil
+		// Jobs stopped by a shutdown are kept as running so they are resumed
+		// after a restart
+		if s.ctx.Err() == nil {
+			j.Status = status
+			if err != nil {
+				j.Error = err.Error()
+			}
+			j.UpdatedAt = time.Now().UTC()
+			s.save()
+		}
+		close(j.done)
+	}()
+}
+
+// save writes the jobs file, it must be called with the lock held.
+func (s *Server) save() {
+	jobs := make([]*Job, 0, len(s.ids))
+	for _, id := range s.ids {
+		js := s.jobs[id].Job
+		jobs = append(jobs, &js)
+	}
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		s.cli.log.Error("couldn't marshal jobs", "error", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0755); err != nil {
+		s.cli.log.Error("couldn't create output directory", "error", err)
+		return
+	}
+	tmp := s.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		s.cli.log.Error("couldn't write jobs file", "error", err)
+		return
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		s.cli.log.Error("couldn't write jobs file", "error", err)
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.SplitN(path, "/", 4)
+	if parts[0] != "jobs" {
+		s.writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		jobs, err := s.Jobs()
+		if err != nil {
+			s.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, jobs)
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		var req JobRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+			return
+		}
+		j, err := s.Submit(&req)
+		if err != nil {
+			s.writeError(w, statusCode(err, http.StatusBadRequest), err)
+			return
+		}
+		s.writeJSON(w, http.StatusCreated, j)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		j, err := s.Job(parts[1])
+		if err != nil {
+			s.writeError(w, statusCode(err, http.StatusInternalServerError), err)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, j)
+	case len(parts) == 3 && parts[2] == "images" && r.Method == http.MethodGet:
+		if _, err := s.Job(parts[1]); err != nil {
+			s.writeError(w, statusCode(err, http.StatusInternalServerError), err)
+			return
+		}
+		a, err := s.album(parts[1])
+		if err != nil {
+			s.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		images := []*Image{}
+		if a != nil {
+			images = a.Images
+		}
+		s.writeJSON(w, http.StatusOK, images)
+	case len(parts) >= 3 && parts[2] == "files" && r.Method == http.MethodGet:
+		if _, err := s.Job(parts[1]); err != nil {
+			s.writeError(w, statusCode(err, http.StatusInternalServerError), err)
+			return
+		}
+		prefix := fmt.Sprintf("/jobs/%s/files", parts[1])
+		dir := filepath.Join(s.cli.cfg.Output, parts[1])
+		http.StripPrefix(prefix, http.FileServer(http.Dir(dir))).ServeHTTP(w, r)
+	case len(parts) == 3 && parts[2] == "events" && r.Method == http.MethodGet:
+		s.serveEvents(w, r, parts[1])
+	case len(parts) == 3 && parts[2] == "cancel" && r.Method == http.MethodPost:
+		s.serveAction(w, parts[1], s.Cancel)
+	case len(parts) == 3 && parts[2] == "resume" && r.Method == http.MethodPost:
+		s.serveAction(w, parts[1], s.Resume)
+	default:
+		s.writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (s *Server) serveAction(w http.ResponseWriter, id string, action func(string) error) {
+	if err := action(id); err != nil {
+		s.writeError(w, statusCode(err, http.StatusInternalServerError), err)
+		return
+	}
+	j, err := s.Job(id)
+	if err != nil {
+		s.writeError(w, statusCode(err, http.StatusInternalServerError), err)
+		return
+	}
+	s.writeJSON(w, http.StatusAccepted, j)
+}
+
+// serveEvents streams the events of the job until it stops. A last "end"
+// event contains the job.
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+	s.lck.Lock()
+	j, ok := s.jobs[id]
+	var started, done chan struct{}
+	if ok && j.cancel != nil {
+		started, done = j.started, j.done
+	}
+	s.lck.Unlock()
+	if !ok {
+		s.writeError(w, http.StatusNotFound, errJobNotFound)
+		return
+	}
+	// Running jobs replay their past events once they have started
+	var events <-chan *ai.GenerateInfo
+	if done != nil {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-started:
+		}
+		if sub := s.cli.Subscribe(id, true); sub != nil {
+			defer sub.Close()
+			events = sub.C()
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for events != nil {
+		select {
+		case <-r.Context().Done():
+			return
+		case info, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			s.writeEvent(w, "info", newEvent(info))
+			flusher.Flush()
+		}
+	}
+	// Wait for the job status to be saved
+	if done != nil {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-done:
+		}
+	}
+	js, err := s.Job(id)
+	if err != nil {
+		return
+	}
+	s.writeEvent(w, "end", js)
+	flusher.Flush()
+}
+
+func (s *Server) writeEvent(w http.ResponseWriter, name string, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		s.cli.log.Error("couldn't marshal event", "error", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, js)
+}
+
+func statusCode(err error, fallback int) int {
+	switch {
+	case errors.Is(err, errJobNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errJobExists), errors.Is(err, errJobState):
+		return http.StatusConflict
+	default:
+		return fallback
+	}
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.cli.log.Error("couldn't write response", "error", err)
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, err error) {
+	s.writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,195 @@
+package bulkai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai/fake"
+	"github.com/ZYKJShadow/bulkai/pkg/prompt"
+)
+
+func newTestServer(t *testing.T, ctx context.Context, output string, latency time.Duration) (*Server, *httptest.Server) {
+	t.Helper()
+	cli, err := NewCli(ctx, &Config{
+		Bot:       "fake",
+		Output:    output,
+		Download:  true,
+		Thumbnail: true,
+		Upscale:   false,
+		Fake:      &fake.Config{Size: 16, Latency: latency},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cli.Close() })
+	s, err := NewServer(ctx, cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func doJSON(t *testing.T, method, u string, body, out interface{}) int {
+	t.Helper()
+	var r *bytes.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(js)
+	} else {
+		r = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	_, ts := newTestServer(t, ctx, t.TempDir(), 100*time.Millisecond)
+
+	var job Job
+	code := doJSON(t, http.MethodPost, ts.URL+"/jobs", &JobRequest{ID: "cats", Prompts: prompt.Entries([]string{"a cat", "a kitten"})}, &job)
+	if code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, code)
+	}
+	if job.ID != "cats" || job.Status != JobRunning {
+		t.Errorf("unexpected job %+v", job)
+	}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/jobs", &JobRequest{ID: "cats", Prompts: prompt.Entries([]string{"a cat"})}, nil); code != http.StatusConflict {
+		t.Errorf("expected status %d, got %d", http.StatusConflict, code)
+	}
+
+	// Follow the events until the job ends
+	resp, err := http.Get(ts.URL + "/jobs/cats/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var infos int
+	var end Job
+	scanner := bufio.NewScanner(resp.Body)
+	var event string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "info":
+			infos++
+		case strings.HasPrefix(line, "data: ") && event == "end":
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &end); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if infos == 0 {
+		t.Error("expected info events")
+	}
+	if end.Status != "finished" || end.Finished != 2 || end.Images != 8 || end.Percentage != 100 {
+		t.Errorf("unexpected end job %+v", end)
+	}
+
+	var images []*Image
+	if code := doJSON(t, http.MethodGet, ts.URL+"/jobs/cats/images", nil, &images); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if len(images) != 8 {
+		t.Fatalf("expected 8 images, got %d", len(images))
+	}
+	fileResp, err := http.Get(ts.URL + "/jobs/cats/files/" + images[0].File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileResp.Body.Close()
+	if fileResp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d for file, got %d", http.StatusOK, fileResp.StatusCode)
+	}
+
+	var jobs []*Job
+	doJSON(t, http.MethodGet, ts.URL+"/jobs", nil, &jobs)
+	if len(jobs) != 1 || jobs[0].ID != "cats" {
+		t.Errorf("unexpected jobs %+v", jobs)
+	}
+	if code := doJSON(t, http.MethodGet, ts.URL+"/jobs/dogs", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestServerCancel(t *testing.T) {
+	s, ts := newTestServer(t, context.Background(), t.TempDir(), time.Second)
+
+	doJSON(t, http.MethodPost, ts.URL+"/jobs", &JobRequest{ID: "slow", Prompts: prompt.Entries([]string{"a", "b", "c"})}, nil)
+	var job Job
+	if code := doJSON(t, http.MethodPost, ts.URL+"/jobs/slow/cancel", nil, &job); code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, code)
+	}
+	s.Wait()
+	got, err := s.Job("slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "cancelled" {
+		t.Errorf("expected status cancelled, got %s", got.Status)
+	}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/jobs/slow/cancel", nil, nil); code != http.StatusConflict {
+		t.Errorf("expected status %d, got %d", http.StatusConflict, code)
+	}
+}
+
+func TestServerRestart(t *testing.T) {
+	output := t.TempDir()
+
+	// Stop the server while the job is running
+	ctx, cancel := context.WithCancel(context.Background())
+	s, _ := newTestServer(t, ctx, output, time.Second)
+	if _, err := s.Submit(&JobRequest{ID: "restart", Prompts: prompt.Entries([]string{"a", "b"})}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	s.Wait()
+	if err := s.cli.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The job is resumed by the new server
+	s, _ = newTestServer(t, context.Background(), output, 0)
+	got, err := s.Job("restart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != JobRunning {
+		t.Errorf("expected status running, got %s", got.Status)
+	}
+	s.Wait()
+	got, err = s.Job("restart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "finished" || got.Finished != 2 {
+		t.Errorf("unexpected job %+v", got)
+	}
+}
@@ -0,0 +1,116 @@
+package bulkai
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/ZYKJShadow/bulkai/pkg/ai"
+	"github.com/ZYKJShadow/bulkai/pkg/webhook"
+)
+
+// WebhookDeadLetterFileName is the file in the output directory where the
+// webhook payloads that couldn't be delivered are appended.
+const WebhookDeadLetterFileName = "webhooks_dead_letter.jsonl"
+
+// Webhook event types
+const (
+	WebhookPromptStarted  = "prompt.started"
+	WebhookImageCompleted = "image.completed"
+	WebhookPromptFailed   = "prompt.failed"
+	WebhookAlbumFinished  = "album.finished"
+	// WebhookAlbumStopped is sent when the album ends without finishing,
+	// e.g. paused, cancelled or incomplete
+	WebhookAlbumStopped = "album.stopped"
+)
+
+// WebhookEvent is the payload posted to the webhooks.
+type WebhookEvent struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Album       string    `json:"album"`
+	Prompt      string    `json:"prompt,omitempty"`
+	PromptIndex *int      `json:"prompt_index,omitempty"`
+	Images      []*Image  `json:"images,omitempty"`
+	Status      string    `json:"status,omitempty"`
+	Percentage  float32   `json:"percentage,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// newNotifier creates the webhook notifier, it returns nil if there are no
+// webhooks configured.
+func newNotifier(cfg *Config, logger *slog.Logger) (*webhook.Notifier, error) {
+	if len(cfg.Webhooks) == 0 {
+		return nil, nil
+	}
+	policy, err := cfg.WebhookRetry.apply(webhook.DefaultRetryPolicy())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't configure webhook retry: %w", err)
+	}
+	n, err := webhook.New(&webhook.Config{
+		URLs:       cfg.Webhooks,
+		Secret:     cfg.WebhookSecret,
+		Retry:      policy,
+		DeadLetter: filepath.Join(cfg.Output, WebhookDeadLetterFileName),
+		Logger:     logger,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create webhooks: %w", err)
+	}
+	return n, nil
+}
+
+// notify sends the event to the webhooks if there are any.
+func (a *AiDrawClient) notify(e *WebhookEvent) {
+	if a.webhooks == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	if err := a.webhooks.Send(e.Type, e); err != nil {
+		a.log.Error("couldn't send webhook", "event", e.Type, "error", err)
+	}
+}
+
+// notifyInfo sends the webhook event of a generation event, images are the
+// album images created from it.
+func (a *AiDrawClient) notifyInfo(identify string, info *ai.GenerateInfo, images []*Image) {
+	e := &WebhookEvent{Album: identify}
+	switch {
+	case info.Status == ai.Started:
+		e.Type = WebhookPromptStarted
+	case info.Image != nil:
+		e.Type = WebhookImageCompleted
+		e.Images = images
+	case info.Status == ai.Fail:
+		e.Type = WebhookPromptFailed
+	default:
+		return
+	}
+	if info.Task != nil {
+		idx := info.Task.Index
+		e.Prompt = info.Task.Prompt
+		e.PromptIndex = &idx
+	}
+	if info.Err != nil {
+		e.Error = info.Err.Error()
+	}
+	a.notify(e)
+}
+
+// notifyAlbum sends the webhook event of an album that ended.
+func (a *AiDrawClient) notifyAlbum(album *Album, err error) {
+	e := &WebhookEvent{
+		Type:       WebhookAlbumStopped,
+		Album:      album.ID,
+		Status:     album.Status,
+		Percentage: album.Percentage,
+	}
+	if album.Status == "finished" {
+		e.Type = WebhookAlbumFinished
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	a.notify(e)
+}